@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Cluster identifies which kubeconfig a target or profile lives in.
+type Cluster string
+
+const (
+	// ManagementCluster is the cluster hosting the HyperShift operator and
+	// the hosted control plane namespaces.
+	ManagementCluster Cluster = "management"
+	// HostedCluster is the guest cluster created from a HostedCluster resource.
+	HostedCluster Cluster = "hosted"
+)
+
+// RolloutMode describes how a component picks up a new TLS profile.
+type RolloutMode string
+
+const (
+	// RolloutAutomatic components are reconciled (rolled out or reloaded) by
+	// their controller without any help from the runner.
+	RolloutAutomatic RolloutMode = "automatic"
+	// RolloutRestart components read the profile at startup only. The runner
+	// waits for a dynamic pickup first and deletes the pods if none happens.
+	RolloutRestart RolloutMode = "restart"
+)
+
+// Catalog is the on-disk list of TLS profile targets.
+type Catalog struct {
+	Targets []Target `json:"targets"`
+}
+
+// Target declares a single TLS-serving component: where to find it, which
+// APIServer TLS profile governs it and how to detect that it rolled out.
+type Target struct {
+	Name string `json:"name"`
+	// Cluster is where the component runs. Defaults to management.
+	Cluster Cluster `json:"cluster,omitempty"`
+	// ProfileSource is the APIServer whose tlsSecurityProfile the component
+	// must follow: the management cluster APIServer or the HostedCluster's
+	// spec.configuration.apiServer.
+	ProfileSource Cluster `json:"profileSource"`
+
+	Discovery      Discovery       `json:"discovery"`
+	ObservedConfig *ObservedConfig `json:"observedConfig,omitempty"`
+	Rollout        Rollout         `json:"rollout"`
+	// Certificate, if set, verifies the served certificate chain, SANs,
+	// expiry and client certificate policy alongside the TLS profile.
+	Certificate *CertificateCheck `json:"certificate,omitempty"`
+}
+
+// Discovery locates the component's pods and the port it serves TLS on.
+// Namespace and deployment entries are Go templates, see templateVars.
+type Discovery struct {
+	// Namespaces are tried in order; the first one containing one of the
+	// deployments wins.
+	Namespaces  []string `json:"namespaces"`
+	Deployments []string `json:"deployments"`
+	// Port is the container port serving TLS. Zero means the target has no
+	// probeable endpoint and is verified through ObservedConfig only.
+	Port int `json:"port,omitempty"`
+}
+
+// ObservedConfig points at a ConfigMap carrying the component's rendered
+// servingInfo (minTLSVersion/cipherSuites), as written by the
+// control-plane-operator for components such as the image registry.
+type ObservedConfig struct {
+	ConfigMap string `json:"configMap"`
+	Key       string `json:"key"`
+}
+
+// Rollout describes how to detect that a profile change reached the target.
+type Rollout struct {
+	Mode    RolloutMode `json:"mode"`
+	Timeout Duration    `json:"timeout,omitempty"`
+	// DynamicGrace is how long a restart-mode target gets to pick up the
+	// profile on its own before its pods are deleted.
+	DynamicGrace Duration `json:"dynamicGrace,omitempty"`
+}
+
+// Duration is a time.Duration that unmarshals from strings like "5m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", d.String())), nil
+}
+
+// templateVars are the values available to discovery templates.
+type templateVars struct {
+	HostedCluster          string
+	HostedClusterNamespace string
+	ControlPlaneNamespace  string
+	// Namespace is the discovered namespace; only set for certificate
+	// templates.
+	Namespace string
+}
+
+// LoadCatalog reads and validates a catalog file.
+func LoadCatalog(path string) (*Catalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	var c Catalog
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("target %d (%s): %w", i, t.Name, err)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return &c, nil
+}
+
+func (t *Target) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.Cluster == "" {
+		t.Cluster = ManagementCluster
+	}
+	if t.Cluster != ManagementCluster && t.Cluster != HostedCluster {
+		return fmt.Errorf("cluster must be %q or %q", ManagementCluster, HostedCluster)
+	}
+	if t.ProfileSource != ManagementCluster && t.ProfileSource != HostedCluster {
+		return fmt.Errorf("profileSource must be %q or %q", ManagementCluster, HostedCluster)
+	}
+	if len(t.Discovery.Namespaces) == 0 || len(t.Discovery.Deployments) == 0 {
+		return fmt.Errorf("discovery needs at least one namespace and one deployment")
+	}
+	if t.Discovery.Port == 0 && t.ObservedConfig == nil {
+		return fmt.Errorf("either discovery.port or observedConfig is required")
+	}
+	if t.ObservedConfig != nil && (t.ObservedConfig.ConfigMap == "" || t.ObservedConfig.Key == "") {
+		return fmt.Errorf("observedConfig needs configMap and key")
+	}
+	if t.Certificate != nil {
+		if t.Discovery.Port == 0 {
+			return fmt.Errorf("certificate checks need discovery.port")
+		}
+		if err := t.Certificate.validate(); err != nil {
+			return err
+		}
+	}
+	switch t.Rollout.Mode {
+	case RolloutAutomatic, RolloutRestart:
+	case "":
+		t.Rollout.Mode = RolloutAutomatic
+	default:
+		return fmt.Errorf("unknown rollout mode %q", t.Rollout.Mode)
+	}
+	if t.Rollout.Timeout.Duration == 0 {
+		t.Rollout.Timeout.Duration = 20 * time.Minute
+	}
+	if t.Rollout.DynamicGrace.Duration == 0 {
+		t.Rollout.DynamicGrace.Duration = 30 * time.Second
+	}
+	return nil
+}
+
+// NeedsHostedCluster reports whether any target depends on a HostedCluster,
+// either through its profile source or by running in the guest cluster.
+func (c *Catalog) NeedsHostedCluster() bool {
+	for _, t := range c.Targets {
+		if t.Cluster == HostedCluster || t.ProfileSource == HostedCluster {
+			return true
+		}
+	}
+	return false
+}
+
+func expand(tmpl string, vars templateVars) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+// ClientAuth is how a server treats client certificates.
+type ClientAuth string
+
+const (
+	ClientAuthNone     ClientAuth = "none"
+	ClientAuthOptional ClientAuth = "optional"
+	ClientAuthRequired ClientAuth = "required"
+)
+
+// CertificateCheck declares what a target's serving certificate must look
+// like. DNS names and the CA bundle name are templates; besides the
+// discovery variables they can use {{.Namespace}}, the discovered namespace.
+type CertificateCheck struct {
+	// CAFile is a local PEM bundle to verify the chain against.
+	CAFile string `json:"caFile,omitempty"`
+	// CABundle is an in-cluster bundle, e.g. the service-ca ConfigMap.
+	CABundle *CABundleRef `json:"caBundle,omitempty"`
+	// DNSNames must all be covered by the leaf certificate's SANs.
+	DNSNames []string `json:"dnsNames,omitempty"`
+	// MinValidity fails the check if the leaf expires sooner than this.
+	// Defaults to 30 days.
+	MinValidity Duration `json:"minValidity,omitempty"`
+	// ClientAuth is the expected client certificate policy. Empty skips
+	// the check.
+	ClientAuth ClientAuth `json:"clientAuth,omitempty"`
+}
+
+// CABundleRef points at a PEM bundle stored in a ConfigMap or Secret.
+type CABundleRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Namespace defaults to the target's namespace.
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+}
+
+func (c *CertificateCheck) validate() error {
+	if c.CABundle != nil {
+		if c.CABundle.Kind != "ConfigMap" && c.CABundle.Kind != "Secret" {
+			return fmt.Errorf("certificate.caBundle.kind must be ConfigMap or Secret")
+		}
+		if c.CABundle.Name == "" || c.CABundle.Key == "" {
+			return fmt.Errorf("certificate.caBundle needs name and key")
+		}
+	}
+	switch c.ClientAuth {
+	case "", ClientAuthNone, ClientAuthOptional, ClientAuthRequired:
+	default:
+		return fmt.Errorf("unknown certificate.clientAuth %q", c.ClientAuth)
+	}
+	if c.MinValidity.Duration == 0 {
+		c.MinValidity.Duration = 30 * 24 * time.Hour
+	}
+	return nil
+}
+
+// CertResult is what the server presented and how it treated a client
+// without a certificate.
+type CertResult struct {
+	Chain      []*x509.Certificate
+	ClientAuth ClientAuth
+	// ClientCertAccepted is set when a client certificate was configured
+	// and the server accepted a handshake presenting it.
+	ClientCertAccepted *bool
+}
+
+// ProbeCertificate handshakes once without a client certificate to collect
+// the served chain and detect client certificate requests, then once more
+// with clientCert (if any) when the server asks for one.
+func (p Prober) ProbeCertificate(ctx context.Context, addr string, clientCert *tls.Certificate) (*CertResult, error) {
+	res := &CertResult{ClientAuth: ClientAuthNone}
+	requested := false
+	var version uint16
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+		// Capture the chain during the handshake: with TLS 1.2 a server
+		// requiring client certs fails the handshake itself.
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			res.Chain = cs.PeerCertificates
+			version = cs.Version
+			return nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested = true
+			return &tls.Certificate{}, nil
+		},
+	}
+	handshakeDone, err := p.handshakeAndRead(ctx, addr, cfg)
+	if len(res.Chain) == 0 {
+		if err == nil {
+			err = errors.New("server presented no certificate")
+		}
+		return nil, err
+	}
+	switch {
+	case requested && clientCertRejected(err, version):
+		res.ClientAuth = ClientAuthRequired
+	case requested && !handshakeDone:
+		return nil, fmt.Errorf("server requested a client certificate, then failed the handshake: %w", err)
+	case requested:
+		// Closing or resetting an idle connection after the handshake is
+		// not a rejection of the missing certificate.
+		res.ClientAuth = ClientAuthOptional
+	case !handshakeDone:
+		return nil, err
+	}
+
+	if requested && clientCert != nil {
+		_, err := p.handshakeAndRead(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{*clientCert},
+		})
+		accepted := err == nil
+		res.ClientCertAccepted = &accepted
+	}
+	return res, nil
+}
+
+// clientCertRejected reports whether err is the alert a server sends when
+// the client has no acceptable certificate: certificate_required (TLS 1.3),
+// bad_certificate, or handshake_failure, which TLS 1.2 servers also use
+// for it. crypto/tls reports received alerts as a "remote error" OpError
+// wrapping an unexported type, so the alert is matched by its text.
+func clientCertRejected(err error, version uint16) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	switch opErr.Err.Error() {
+	case "tls: certificate required", "tls: bad certificate":
+		return true
+	case "tls: handshake failure":
+		return version != tls.VersionTLS13
+	}
+	return false
+}
+
+// handshakeAndRead completes a handshake and then waits briefly for the
+// server to reject the connection: in TLS 1.3 a missing client certificate
+// is only reported after the client considers the handshake complete. It
+// reports whether the handshake itself succeeded.
+func (p Prober) handshakeAndRead(ctx context.Context, addr string, cfg *tls.Config) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	d := tls.Dialer{NetDialer: &net.Dialer{}, Config: cfg}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true, nil
+		}
+		return true, err
+	}
+	return true, nil
+}
+
+// Evaluate checks the served chain against the CA pool, the expected DNS
+// names, the expiry window and the client certificate policy. A nil pool
+// skips chain verification.
+func (c *CertResult) Evaluate(spec *CertificateCheck, roots *x509.CertPool, dnsNames []string) []Finding {
+	var findings []Finding
+	leaf := c.Chain[0]
+	findings = append(findings, Finding{report.LevelInfo, fmt.Sprintf("leaf: subject=%q issuer=%q SANs=%v",
+		leaf.Subject.CommonName, leaf.Issuer.CommonName, leaf.DNSNames)})
+
+	if roots == nil {
+		findings = append(findings, Finding{report.LevelSkip, "chain verification: no CA configured"})
+	} else {
+		intermediates := x509.NewCertPool()
+		for _, cert := range c.Chain[1:] {
+			intermediates.AddCert(cert)
+		}
+		chains, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("chain does not verify against CA: %v", err)})
+		} else {
+			root := chains[0][len(chains[0])-1]
+			findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("chain verifies against CA %q (%d cert(s))", root.Subject.CommonName, len(chains[0]))})
+		}
+	}
+
+	for _, name := range dnsNames {
+		if err := leaf.VerifyHostname(name); err != nil {
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("SAN missing for %s", name)})
+		} else {
+			findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("SAN covers %s", name)})
+		}
+	}
+
+	now := time.Now()
+	for i, cert := range c.Chain {
+		what := "leaf"
+		if i > 0 {
+			what = fmt.Sprintf("chain[%d] %q", i, cert.Subject.CommonName)
+		}
+		switch {
+		case now.Before(cert.NotBefore):
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("%s not valid before %s", what, cert.NotBefore.Format(time.RFC3339))})
+		case now.After(cert.NotAfter):
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("%s expired at %s", what, cert.NotAfter.Format(time.RFC3339))})
+		}
+	}
+	if remaining := leaf.NotAfter.Sub(now); remaining > 0 {
+		if remaining < spec.MinValidity.Duration {
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("leaf expires in %s (minimum %s)", remaining.Round(time.Hour), spec.MinValidity.Duration)})
+		} else {
+			findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("leaf valid until %s", leaf.NotAfter.Format(time.RFC3339))})
+		}
+	}
+
+	if spec.ClientAuth != "" {
+		if c.ClientAuth == spec.ClientAuth {
+			findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("client certificates: %s", c.ClientAuth)})
+		} else {
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("client certificates: %s (expected %s)", c.ClientAuth, spec.ClientAuth)})
+		}
+	}
+	if c.ClientCertAccepted != nil {
+		if *c.ClientCertAccepted {
+			findings = append(findings, Finding{report.LevelPass, "handshake with configured client certificate accepted"})
+		} else {
+			findings = append(findings, Finding{report.LevelFail, "handshake with configured client certificate rejected"})
+		}
+	}
+	return findings
+}
+
+// loadCAPool builds the CA pool for a target: the target's own CA file or
+// in-cluster bundle, falling back to the global --ca-file. Returns nil if
+// no CA is configured.
+func (e *Endpoint) loadCAPool(ctx context.Context, spec *CertificateCheck, vars templateVars, defaultCAFile string) (*x509.CertPool, error) {
+	var pem []byte
+	switch {
+	case spec.CAFile != "":
+		data, err := os.ReadFile(spec.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pem = data
+	case spec.CABundle != nil:
+		data, err := e.readBundle(ctx, spec.CABundle, vars)
+		if err != nil {
+			return nil, err
+		}
+		pem = data
+	case defaultCAFile != "":
+		data, err := os.ReadFile(defaultCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pem = data
+	default:
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in CA bundle")
+	}
+	return pool, nil
+}
+
+func (e *Endpoint) readBundle(ctx context.Context, ref *CABundleRef, vars templateVars) ([]byte, error) {
+	ns := e.Namespace
+	if ref.Namespace != "" {
+		expanded, err := expand(ref.Namespace, vars)
+		if err != nil {
+			return nil, err
+		}
+		ns = expanded
+	}
+	var obj struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := e.client.getJSON(ctx, &obj, "get", strings.ToLower(ref.Kind), ref.Name, "-n", ns); err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	value, ok := obj.Data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("%s %s/%s has no key %q", ref.Kind, ns, ref.Name, ref.Key)
+	}
+	if ref.Kind == "Secret" {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return []byte(value), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate signed by parent, or a self-signed CA when
+// parent is nil.
+func testCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, notAfter time.Time, dnsNames ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     dnsNames,
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestCertResultEvaluate(t *testing.T) {
+	year := time.Now().Add(365 * 24 * time.Hour)
+	ca, caKey := testCert(t, "service-ca", nil, nil, year)
+	otherCA, _ := testCert(t, "other-ca", nil, nil, year)
+	leaf, _ := testCert(t, "api", ca, caKey, year, "api.openshift-apiserver.svc")
+	expiring, _ := testCert(t, "api", ca, caKey, time.Now().Add(24*time.Hour), "api.openshift-apiserver.svc")
+
+	pool := func(certs ...*x509.Certificate) *x509.CertPool {
+		p := x509.NewCertPool()
+		for _, c := range certs {
+			p.AddCert(c)
+		}
+		return p
+	}
+	accepted, rejected := true, false
+	spec := func(clientAuth ClientAuth) *CertificateCheck {
+		c := &CertificateCheck{ClientAuth: clientAuth}
+		if err := c.validate(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		result   CertResult
+		spec     *CertificateCheck
+		roots    *x509.CertPool
+		dnsNames []string
+		want     []string
+	}{
+		{
+			name:     "valid chain and SAN",
+			result:   CertResult{Chain: []*x509.Certificate{leaf}, ClientAuth: ClientAuthNone},
+			spec:     spec(ClientAuthNone),
+			roots:    pool(ca),
+			dnsNames: []string{"api.openshift-apiserver.svc"},
+		},
+		{
+			name:   "no CA configured skips verification",
+			result: CertResult{Chain: []*x509.Certificate{leaf}},
+			spec:   spec(""),
+		},
+		{
+			name:   "signed by another CA",
+			result: CertResult{Chain: []*x509.Certificate{leaf}},
+			spec:   spec(""),
+			roots:  pool(otherCA),
+			want:   []string{"chain does not verify against CA: x509: certificate signed by unknown authority"},
+		},
+		{
+			name:     "SAN missing",
+			result:   CertResult{Chain: []*x509.Certificate{leaf}},
+			spec:     spec(""),
+			dnsNames: []string{"api.openshift-apiserver.svc.cluster.local"},
+			want:     []string{"SAN missing for api.openshift-apiserver.svc.cluster.local"},
+		},
+		{
+			name:   "expires within the minimum validity",
+			result: CertResult{Chain: []*x509.Certificate{expiring}},
+			spec:   spec(""),
+			want:   []string{"leaf expires in 24h0m0s (minimum 720h0m0s)"},
+		},
+		{
+			name:   "client certificates required but not expected",
+			result: CertResult{Chain: []*x509.Certificate{leaf}, ClientAuth: ClientAuthRequired},
+			spec:   spec(ClientAuthNone),
+			want:   []string{"client certificates: required (expected none)"},
+		},
+		{
+			name:   "configured client certificate accepted",
+			result: CertResult{Chain: []*x509.Certificate{leaf}, ClientAuth: ClientAuthRequired, ClientCertAccepted: &accepted},
+			spec:   spec(ClientAuthRequired),
+		},
+		{
+			name:   "configured client certificate rejected",
+			result: CertResult{Chain: []*x509.Certificate{leaf}, ClientAuth: ClientAuthOptional, ClientCertAccepted: &rejected},
+			spec:   spec(ClientAuthOptional),
+			want:   []string{"handshake with configured client certificate rejected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := failures(tt.result.Evaluate(tt.spec, tt.roots, tt.dnsNames))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failures = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCertRejected(t *testing.T) {
+	alert := func(text string) error {
+		return &net.OpError{Op: "remote error", Err: errors.New(text)}
+	}
+	tests := []struct {
+		name    string
+		err     error
+		version uint16
+		want    bool
+	}{
+		{name: "certificate required", err: alert("tls: certificate required"), version: tls.VersionTLS13, want: true},
+		{name: "bad certificate", err: alert("tls: bad certificate"), version: tls.VersionTLS12, want: true},
+		{name: "handshake failure on TLS 1.2", err: alert("tls: handshake failure"), version: tls.VersionTLS12, want: true},
+		{name: "handshake failure on TLS 1.3", err: alert("tls: handshake failure"), version: tls.VersionTLS13},
+		{name: "other alert", err: alert("tls: internal error"), version: tls.VersionTLS13},
+		{name: "local error", err: &net.OpError{Op: "local error", Err: errors.New("tls: bad certificate")}, version: tls.VersionTLS12},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, version: tls.VersionTLS13},
+		{name: "no error", version: tls.VersionTLS13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientCertRejected(tt.err, tt.version); got != tt.want {
+				t.Errorf("clientCertRejected(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
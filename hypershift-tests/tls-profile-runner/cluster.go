@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	configv1 "github.com/openshift/api/config/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// oc runs the oc CLI against a single cluster. An empty kubeconfig uses the
+// current oc login, like the shell scripts do.
+type oc struct {
+	kubeconfig string
+}
+
+func (c oc) command(ctx context.Context, args ...string) *exec.Cmd {
+	if c.kubeconfig != "" {
+		args = append([]string{"--kubeconfig", c.kubeconfig}, args...)
+	}
+	return exec.CommandContext(ctx, "oc", args...)
+}
+
+func (c oc) run(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := c.command(ctx, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("oc %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (c oc) getJSON(ctx context.Context, into any, args ...string) error {
+	out, err := c.run(ctx, append(args, "-o", "json")...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out, into)
+}
+
+// deployment holds the few Deployment fields the runner needs.
+type deployment struct {
+	Spec struct {
+		Selector struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+	} `json:"spec"`
+}
+
+type pod struct {
+	Name string
+	UID  string
+	IP   string
+	// Restarts is the sum of the pod's container restart counts.
+	Restarts int32
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name              string  `json:"name"`
+			UID               string  `json:"uid"`
+			DeletionTimestamp *string `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+			ContainerStatuses []struct {
+				RestartCount int32 `json:"restartCount"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// Endpoint is a discovered target: the namespace and deployment that serve
+// it, and the label selector of its pods.
+type Endpoint struct {
+	Target     *Target
+	Namespace  string
+	Deployment string
+	Selector   string
+	client     oc
+}
+
+// discover resolves a target's namespace and deployment by trying each
+// configured candidate in order.
+func discover(ctx context.Context, client oc, t *Target, vars templateVars) (*Endpoint, error) {
+	var tried []string
+	for _, nsTmpl := range t.Discovery.Namespaces {
+		ns, err := expand(nsTmpl, vars)
+		if err != nil {
+			return nil, fmt.Errorf("namespace template %q: %w", nsTmpl, err)
+		}
+		for _, dTmpl := range t.Discovery.Deployments {
+			name, err := expand(dTmpl, vars)
+			if err != nil {
+				return nil, fmt.Errorf("deployment template %q: %w", dTmpl, err)
+			}
+			tried = append(tried, ns+"/"+name)
+			var d deployment
+			if err := client.getJSON(ctx, &d, "get", "deployment", name, "-n", ns); err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			return &Endpoint{
+				Target:     t,
+				Namespace:  ns,
+				Deployment: name,
+				Selector:   labelSelector(d.Spec.Selector.MatchLabels),
+				client:     client,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no deployment found (tried %s)", strings.Join(tried, ", "))
+}
+
+// isNotFound reports whether an oc error is the API server's NotFound, as
+// opposed to oc, authentication or the API server itself failing.
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "(NotFound)")
+}
+
+func labelSelector(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// readyPods lists the endpoint's running, ready and non-terminating pods.
+func (e *Endpoint) readyPods(ctx context.Context) ([]pod, error) {
+	var list podList
+	if err := e.client.getJSON(ctx, &list, "get", "pods", "-n", e.Namespace, "-l", e.Selector); err != nil {
+		return nil, err
+	}
+	var pods []pod
+	for _, item := range list.Items {
+		if item.Status.Phase != "Running" || item.Metadata.DeletionTimestamp != nil {
+			continue
+		}
+		for _, c := range item.Status.Conditions {
+			if c.Type == "Ready" && c.Status == "True" {
+				p := pod{Name: item.Metadata.Name, UID: item.Metadata.UID, IP: item.Status.PodIP}
+				for _, cs := range item.Status.ContainerStatuses {
+					p.Restarts += cs.RestartCount
+				}
+				pods = append(pods, p)
+				break
+			}
+		}
+	}
+	return pods, nil
+}
+
+// deletePods deletes the endpoint's pods without waiting, so the caller can
+// keep observing the endpoint while the deployment replaces them.
+func (e *Endpoint) deletePods(ctx context.Context) error {
+	_, err := e.client.run(ctx, "delete", "pods", "-n", e.Namespace, "-l", e.Selector, "--grace-period=10", "--wait=false")
+	return err
+}
+
+var forwardingRE = regexp.MustCompile(`Forwarding from 127\.0\.0\.1:(\d+)`)
+
+// portForward starts "oc port-forward" to the given pod and returns the
+// local address and a function that stops the forward.
+func (e *Endpoint) portForward(ctx context.Context, p pod, port int) (string, func(), error) {
+	pfCtx, cancel := context.WithCancel(ctx)
+	cmd := e.client.command(pfCtx, "port-forward", "-n", e.Namespace, "pod/"+p.Name, fmt.Sprintf(":%d", port))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return "", nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return "", nil, fmt.Errorf("failed to start port-forward: %w", err)
+	}
+	stop := func() {
+		cancel()
+		_ = cmd.Wait()
+	}
+
+	addr := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if m := forwardingRE.FindStringSubmatch(scanner.Text()); m != nil {
+				addr <- "127.0.0.1:" + m[1]
+				break
+			}
+		}
+		// Keep draining so oc never blocks on a full pipe.
+		for scanner.Scan() {
+		}
+	}()
+
+	select {
+	case a := <-addr:
+		return a, stop, nil
+	case <-time.After(20 * time.Second):
+		stop()
+		return "", nil, fmt.Errorf("port-forward to %s/%s:%d did not become ready", e.Namespace, p.Name, port)
+	}
+}
+
+// observedServingInfo reads minTLSVersion and cipherSuites from the
+// target's rendered config in its ConfigMap.
+func (e *Endpoint) observedServingInfo(ctx context.Context) (configv1.TLSProtocolVersion, []string, error) {
+	src := e.Target.ObservedConfig
+	var cm struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := e.client.getJSON(ctx, &cm, "get", "configmap", src.ConfigMap, "-n", e.Namespace); err != nil {
+		return "", nil, err
+	}
+	raw, ok := cm.Data[src.Key]
+	if !ok {
+		return "", nil, fmt.Errorf("configmap %s has no key %q", src.ConfigMap, src.Key)
+	}
+	var cfg struct {
+		ServingInfo struct {
+			MinTLSVersion string   `json:"minTLSVersion"`
+			CipherSuites  []string `json:"cipherSuites"`
+		} `json:"servingInfo"`
+	}
+	if err := yaml.Unmarshal([]byte(raw), &cfg); err != nil {
+		return "", nil, fmt.Errorf("failed to parse %s/%s: %w", src.ConfigMap, src.Key, err)
+	}
+	return configv1.TLSProtocolVersion(cfg.ServingInfo.MinTLSVersion), cfg.ServingInfo.CipherSuites, nil
+}
+
+// ProfileSource reads and patches the tlsSecurityProfile of either the
+// management APIServer or a HostedCluster.
+type ProfileSource struct {
+	Kind       Cluster
+	client     oc
+	hcName     string
+	hcNS       string
+	cpNS       string
+	kasTimeout time.Duration
+}
+
+func (s *ProfileSource) Get(ctx context.Context) (*configv1.TLSSecurityProfile, error) {
+	if s.Kind == ManagementCluster {
+		var apiserver configv1.APIServer
+		if err := s.client.getJSON(ctx, &apiserver, "get", "apiserver", "cluster"); err != nil {
+			return nil, err
+		}
+		return apiserver.Spec.TLSSecurityProfile, nil
+	}
+	var hc struct {
+		Spec struct {
+			Configuration struct {
+				APIServer *configv1.APIServerSpec `json:"apiServer"`
+			} `json:"configuration"`
+		} `json:"spec"`
+	}
+	if err := s.client.getJSON(ctx, &hc, "get", "hostedcluster", s.hcName, "-n", s.hcNS); err != nil {
+		return nil, err
+	}
+	if hc.Spec.Configuration.APIServer == nil {
+		return nil, nil
+	}
+	return hc.Spec.Configuration.APIServer.TLSSecurityProfile, nil
+}
+
+// Set patches the profile. A nil profile restores the default. As in the
+// shell tests, the field is reset first so no stale custom/old sections
+// survive the merge patch. Only tlsSecurityProfile is reset; the rest of a
+// HostedCluster's apiServer configuration is left alone.
+func (s *ProfileSource) Set(ctx context.Context, p *configv1.TLSSecurityProfile) error {
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	var reset, patch string
+	var args []string
+	if s.Kind == ManagementCluster {
+		args = []string{"patch", "apiserver", "cluster", "--type=merge", "-p"}
+		reset = `{"spec":{"tlsSecurityProfile":null}}`
+		patch = fmt.Sprintf(`{"spec":{"tlsSecurityProfile":%s}}`, encoded)
+	} else {
+		args = []string{"patch", "hostedcluster", s.hcName, "-n", s.hcNS, "--type=merge", "-p"}
+		reset = `{"spec":{"configuration":{"apiServer":{"tlsSecurityProfile":null}}}}`
+		patch = fmt.Sprintf(`{"spec":{"configuration":{"apiServer":{"tlsSecurityProfile":%s}}}}`, encoded)
+	}
+	if _, err := s.client.run(ctx, append(args, reset)...); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	_, err = s.client.run(ctx, append(args, patch)...)
+	return err
+}
+
+// WaitStable waits for the kube-apiserver governed by this source to finish
+// rolling out: the whole management cluster, or the hosted control plane's
+// kube-apiserver deployment.
+func (s *ProfileSource) WaitStable(ctx context.Context) error {
+	if s.Kind == ManagementCluster {
+		_, err := s.client.run(ctx, "adm", "wait-for-stable-cluster",
+			fmt.Sprintf("--timeout=%s", s.kasTimeout))
+		return err
+	}
+	_, err := s.client.run(ctx, "rollout", "status", "deployment/kube-apiserver", "-n", s.cpNS,
+		fmt.Sprintf("--timeout=%s", s.kasTimeout))
+	return err
+}
@@ -0,0 +1,155 @@
+// tls-profile-runner: checks that HyperShift components serve the TLS
+// security profile configured on the APIServer that governs them.
+//
+// Each component is declared in a target catalog (see targets.yaml) with
+// how to find its endpoint, which APIServer profile it follows (management
+// cluster or HostedCluster) and how it rolls out after a profile change.
+// This replaces per-component scripts like test-webhook-tls-profile.sh and
+// test-image-registry-tls-profile.sh with a single runner.
+//
+// Usage:
+//
+//	tls-profile-runner --catalog targets.yaml
+//	tls-profile-runner --hosted-cluster hc1 --namespace clusters --target image-registry-operator
+//	tls-profile-runner --hosted-cluster hc1 --namespace clusters --switch hosted --profiles Old,Modern
+//
+// With --switch, every governed target is sampled from the moment of the
+// patch, recording how long it took to serve the new profile, whether it
+// restarted or hot-reloaded, and any window where it served both profiles
+// or neither (see timeline.go).
+//
+// Targets with a certificate section also get their served chain verified
+// against a CA bundle, SANs checked against the service DNS names, expiry
+// and client certificate policy checked (see cert.go).
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+var (
+	catalogPath      = flag.String("catalog", "targets.yaml", "Path to the TLS target catalog")
+	kubeconfig       = flag.String("kubeconfig", "", "Management cluster kubeconfig (default: current oc login)")
+	hostedKubeconfig = flag.String("hosted-kubeconfig", "", "Hosted (guest) cluster kubeconfig; targets with cluster: hosted are skipped without it")
+	hostedCluster    = flag.String("hosted-cluster", "", "Name of the HostedCluster resource")
+	hcNamespace      = flag.String("namespace", "clusters", "Namespace of the HostedCluster (management cluster)")
+	targets          = flag.String("target", "", "Comma-separated target names to run (default: all)")
+	switchSource     = flag.String("switch", "", "Switch profiles on this APIServer: management or hosted (default: verify only)")
+	profiles         = flag.String("profiles", "Old,Intermediate,Modern", "Comma-separated profiles to walk through with --switch")
+	kasTimeout       = flag.Duration("kas-timeout", 30*time.Minute, "Timeout for the kube-apiserver rollout after each profile change")
+	probeTimeout     = flag.Duration("probe-timeout", 10*time.Second, "Timeout for a single TLS handshake")
+	sampleInterval   = flag.Duration("sample-interval", 10*time.Second, "Pause between samples while tracking a profile transition")
+	timelineOut      = flag.String("timeline-out", "", "Write the propagation timelines recorded by --switch to this JSON file")
+	caFile           = flag.String("ca-file", "", "Default CA bundle for certificate checks (targets can set their own)")
+	clientCertFile   = flag.String("client-cert", "", "Client certificate presented to targets that request one")
+	clientKeyFile    = flag.String("client-key", "", "Key for --client-cert")
+	dryRun           = flag.Bool("dry-run", false, "Read-only checks only (ignore --switch)")
+)
+
+func main() {
+	flag.Parse()
+
+	catalog, err := LoadCatalog(*catalogPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if catalog.NeedsHostedCluster() && *hostedCluster == "" {
+		fmt.Fprintln(os.Stderr, "warning: catalog has hosted cluster targets but --hosted-cluster is not set; they will be skipped")
+	}
+
+	reporter := &report.Reporter{}
+	runner := newRunner(catalog, reporter)
+	if *clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCertFile, *clientKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load client certificate: %v\n", err)
+			os.Exit(1)
+		}
+		runner.ClientCert = &cert
+	}
+
+	ctx := context.Background()
+	endpoints := runner.Discover(ctx)
+	runner.CheckAll(ctx, endpoints)
+
+	if *switchSource != "" {
+		if *dryRun {
+			reporter.Log(report.LevelSkip, "Profile switching skipped in dry-run mode")
+		} else if err := runner.SwitchProfiles(ctx, Cluster(*switchSource), splitList(*profiles), endpoints); err != nil {
+			reporter.Log(report.LevelFail, "profile switch: %v", err)
+		}
+		if *timelineOut != "" && len(runner.Timelines) > 0 {
+			if err := writeTimelines(*timelineOut, runner.Timelines); err != nil {
+				reporter.Log(report.LevelFail, "%v", err)
+			} else {
+				reporter.Info("Timelines written to %s", *timelineOut)
+			}
+		}
+	}
+
+	reporter.Summary()
+	fmt.Printf("  TOTAL:   %d\n\n", reporter.Pass+reporter.Fail+reporter.Skip)
+	if reporter.Fail > 0 {
+		fmt.Printf("%s%s%d test(s) failed.%s\n", report.Red, report.Bold, reporter.Fail, report.Reset)
+		os.Exit(1)
+	}
+	fmt.Printf("%s%sAll tests passed!%s\n", report.Green, report.Bold, report.Reset)
+}
+
+func newRunner(catalog *Catalog, reporter *report.Reporter) *Runner {
+	mgmt := &oc{kubeconfig: *kubeconfig}
+	r := &Runner{
+		Catalog:  catalog,
+		Clients:  map[Cluster]*oc{ManagementCluster: mgmt},
+		Sources:  map[Cluster]*ProfileSource{},
+		Prober:   Prober{Timeout: *probeTimeout},
+		Reporter: reporter,
+		Only:     map[string]bool{},
+
+		SampleInterval: *sampleInterval,
+		CAFile:         *caFile,
+	}
+	for _, name := range splitList(*targets) {
+		r.Only[name] = true
+	}
+	r.Sources[ManagementCluster] = &ProfileSource{Kind: ManagementCluster, client: *mgmt, kasTimeout: *kasTimeout}
+
+	if *hostedCluster != "" {
+		r.Vars = templateVars{
+			HostedCluster:          *hostedCluster,
+			HostedClusterNamespace: *hcNamespace,
+			ControlPlaneNamespace:  *hcNamespace + "-" + *hostedCluster,
+		}
+		r.Sources[HostedCluster] = &ProfileSource{
+			Kind:       HostedCluster,
+			client:     *mgmt,
+			hcName:     *hostedCluster,
+			hcNS:       *hcNamespace,
+			cpNS:       r.Vars.ControlPlaneNamespace,
+			kasTimeout: *kasTimeout,
+		}
+	}
+	if *hostedKubeconfig != "" {
+		r.Clients[HostedCluster] = &oc{kubeconfig: *hostedKubeconfig}
+	}
+	return r
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
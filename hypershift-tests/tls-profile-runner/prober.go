@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+// ProbeResult is what a single endpoint accepted during one probe pass.
+type ProbeResult struct {
+	// Versions maps each probed protocol version to whether a handshake
+	// pinned to that version succeeded.
+	Versions map[uint16]bool
+	// Suites lists the TLS 1.2 cipher suites (IANA names) the endpoint
+	// accepted when offered one at a time. Empty if TLS 1.2 is rejected.
+	Suites map[string]bool
+	// Cert is the certificate probe result, if one was requested.
+	Cert *CertResult
+}
+
+// Prober performs TLS handshakes against an address, one protocol version
+// or cipher suite at a time, like the openssl s_client loops in the shell
+// tests but without depending on the local openssl build.
+type Prober struct {
+	Timeout time.Duration
+}
+
+func (p Prober) handshake(ctx context.Context, addr string, cfg *tls.Config) (tls.ConnectionState, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	d := tls.Dialer{NetDialer: &net.Dialer{}, Config: cfg}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.(*tls.Conn).ConnectionState(), nil
+}
+
+// Probe checks every protocol version, then every TLS 1.2 cipher suite.
+func (p Prober) Probe(ctx context.Context, addr string) (*ProbeResult, error) {
+	res := &ProbeResult{Versions: map[uint16]bool{}, Suites: map[string]bool{}}
+	anyAccepted := false
+	var lastErr error
+	for _, v := range probedVersions {
+		_, err := p.handshake(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         v,
+			MaxVersion:         v,
+		})
+		res.Versions[v] = err == nil
+		if err == nil {
+			anyAccepted = true
+		} else {
+			lastErr = err
+		}
+	}
+	if !anyAccepted {
+		return nil, fmt.Errorf("no TLS handshake succeeded: %w", lastErr)
+	}
+	if !res.Versions[tls.VersionTLS12] {
+		return res, nil
+	}
+	for id, name := range tls12Suites() {
+		_, err := p.handshake(ctx, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{id},
+		})
+		if err == nil {
+			res.Suites[name] = true
+		}
+	}
+	return res, nil
+}
+
+// Finding is a single pass/fail/info line produced by comparing a probe
+// result or observed config against the expected profile.
+type Finding struct {
+	Level   report.Level
+	Message string
+}
+
+// Evaluate compares a probe result against the expected profile. Suites
+// the endpoint rejects despite the profile allowing them are only reported
+// as info, since they may simply not match the serving key type.
+func (r *ProbeResult) Evaluate(exp ExpectedProfile) []Finding {
+	var findings []Finding
+	minV := exp.minVersion()
+	for _, v := range probedVersions {
+		accepted := r.Versions[v]
+		switch {
+		case v < minV && accepted:
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("%s accepted (below %s)", versionName(v), exp.MinVersion)})
+		case v < minV:
+			findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("%s correctly rejected", versionName(v))})
+		case v == minV && accepted:
+			findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("%s accepted", versionName(v))})
+		case v == minV:
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("%s rejected (profile minimum)", versionName(v))})
+		case accepted:
+			findings = append(findings, Finding{report.LevelInfo, fmt.Sprintf("%s also accepted", versionName(v))})
+		default:
+			findings = append(findings, Finding{report.LevelInfo, fmt.Sprintf("%s not negotiated", versionName(v))})
+		}
+	}
+	if !r.Versions[tls.VersionTLS12] {
+		return findings
+	}
+
+	allowed := exp.allowedSuites()
+	accepted := 0
+	for _, name := range sortedKeys(r.Suites) {
+		if allowed[name] {
+			accepted++
+			continue
+		}
+		findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("cipher %s accepted but not in profile", name)})
+	}
+	switch {
+	case accepted > 0:
+		findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("%d TLS 1.2 profile cipher(s) accepted", accepted)})
+	case len(allowed) > 0:
+		findings = append(findings, Finding{report.LevelFail, "none of the profile's TLS 1.2 ciphers accepted"})
+	}
+	return findings
+}
+
+// Matches reports whether the probe result has no failing findings.
+func (r *ProbeResult) Matches(exp ExpectedProfile) bool {
+	return !hasFailure(r.Evaluate(exp))
+}
+
+// acceptsBoth reports whether the endpoint accepts the old and the new
+// profile at once: everything it accepts is allowed by one of them, and it
+// accepts a version or cipher only the old profile allows as well as one
+// only the new profile allows.
+func (r *ProbeResult) acceptsBoth(from, to ExpectedProfile) bool {
+	var oldOnly, newOnly bool
+	allowedByEither := func(inOld, inNew bool) bool {
+		oldOnly = oldOnly || inOld && !inNew
+		newOnly = newOnly || inNew && !inOld
+		return inOld || inNew
+	}
+	for _, v := range probedVersions {
+		if r.Versions[v] && !allowedByEither(v >= from.minVersion(), v >= to.minVersion()) {
+			return false
+		}
+	}
+	if r.Versions[tls.VersionTLS12] {
+		fromSuites, toSuites := from.allowedSuites(), to.allowedSuites()
+		for name := range r.Suites {
+			if !allowedByEither(fromSuites[name], toSuites[name]) {
+				return false
+			}
+		}
+	}
+	return oldOnly && newOnly
+}
+
+// evaluateServingInfo compares a rendered servingInfo against the profile.
+func evaluateServingInfo(minVersion string, suites []string, exp ExpectedProfile) []Finding {
+	var findings []Finding
+	if minVersion == string(exp.MinVersion) {
+		findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("servingInfo.minTLSVersion: %s", minVersion)})
+	} else {
+		findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("servingInfo.minTLSVersion: %q (expected %s)", minVersion, exp.MinVersion)})
+	}
+
+	// cipherSuites may be rendered with either naming scheme.
+	allowed := exp.allowedSuites()
+	for _, c := range exp.Ciphers {
+		allowed[c] = true
+	}
+	for _, s := range suites {
+		if !allowed[s] {
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("servingInfo cipher %s not in profile", s)})
+		}
+	}
+	if len(suites) > 0 || exp.minVersion() == tls.VersionTLS13 {
+		findings = append(findings, Finding{report.LevelPass, fmt.Sprintf("servingInfo lists %d cipher suite(s)", len(suites))})
+	} else {
+		findings = append(findings, Finding{report.LevelFail, "servingInfo lists no cipher suites"})
+	}
+	return findings
+}
+
+// logFindings logs each finding prefixed with the target label.
+func logFindings(r *report.Reporter, label string, findings []Finding) {
+	for _, f := range findings {
+		r.Log(f.Level, "[%s] %s", label, f.Message)
+	}
+}
+
+func hasFailure(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Level == report.LevelFail {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+
+	configv1 "github.com/openshift/api/config/v1"
+)
+
+// ExpectedProfile is the TLS configuration a target must serve, resolved
+// from an APIServer tlsSecurityProfile.
+type ExpectedProfile struct {
+	// Label is a human readable name such as "Intermediate" or "default".
+	Label      string
+	MinVersion configv1.TLSProtocolVersion
+	// Ciphers are OpenSSL-style names as used by the OpenShift API.
+	Ciphers []string
+}
+
+// resolveProfile turns a (possibly nil) tlsSecurityProfile into the
+// expected min version and cipher list. A nil profile means Intermediate,
+// matching the APIServer default.
+func resolveProfile(p *configv1.TLSSecurityProfile) (ExpectedProfile, error) {
+	if p == nil || p.Type == "" {
+		spec := configv1.TLSProfiles[configv1.TLSProfileIntermediateType]
+		return ExpectedProfile{Label: "default", MinVersion: spec.MinTLSVersion, Ciphers: spec.Ciphers}, nil
+	}
+	if p.Type == configv1.TLSProfileCustomType {
+		if p.Custom == nil {
+			return ExpectedProfile{}, fmt.Errorf("custom TLS profile has no custom section")
+		}
+		return ExpectedProfile{Label: "Custom", MinVersion: p.Custom.MinTLSVersion, Ciphers: p.Custom.Ciphers}, nil
+	}
+	spec, ok := configv1.TLSProfiles[p.Type]
+	if !ok {
+		return ExpectedProfile{}, fmt.Errorf("unknown TLS profile type %q", p.Type)
+	}
+	return ExpectedProfile{Label: string(p.Type), MinVersion: spec.MinTLSVersion, Ciphers: spec.Ciphers}, nil
+}
+
+// namedProfile builds a tlsSecurityProfile for one of the predefined types,
+// or nil for "default".
+func namedProfile(name string) (*configv1.TLSSecurityProfile, error) {
+	switch configv1.TLSProfileType(name) {
+	case configv1.TLSProfileOldType:
+		return &configv1.TLSSecurityProfile{Type: configv1.TLSProfileOldType, Old: &configv1.OldTLSProfile{}}, nil
+	case configv1.TLSProfileIntermediateType:
+		return &configv1.TLSSecurityProfile{Type: configv1.TLSProfileIntermediateType, Intermediate: &configv1.IntermediateTLSProfile{}}, nil
+	case configv1.TLSProfileModernType:
+		return &configv1.TLSSecurityProfile{Type: configv1.TLSProfileModernType, Modern: &configv1.ModernTLSProfile{}}, nil
+	}
+	if name == "default" {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported profile %q (use Old, Intermediate, Modern or default)", name)
+}
+
+var tlsVersions = map[configv1.TLSProtocolVersion]uint16{
+	configv1.VersionTLS10: tls.VersionTLS10,
+	configv1.VersionTLS11: tls.VersionTLS11,
+	configv1.VersionTLS12: tls.VersionTLS12,
+	configv1.VersionTLS13: tls.VersionTLS13,
+}
+
+// probedVersions are the protocol versions the prober attempts, in order.
+var probedVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// opensslToIANA maps the OpenSSL cipher names used by the OpenShift API to
+// the IANA names used by crypto/tls. Only suites crypto/tls can offer as a
+// client are listed; the rest (DHE-*, CBC-SHA384, ...) cannot be probed.
+var opensslToIANA = map[string]string{
+	"ECDHE-ECDSA-AES128-GCM-SHA256": "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-RSA-AES128-GCM-SHA256":   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"ECDHE-ECDSA-AES256-GCM-SHA384": "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-RSA-AES256-GCM-SHA384":   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"ECDHE-ECDSA-CHACHA20-POLY1305": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-RSA-CHACHA20-POLY1305":   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	"ECDHE-ECDSA-AES128-SHA256":     "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	"ECDHE-RSA-AES128-SHA256":       "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	"ECDHE-ECDSA-AES128-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-RSA-AES128-SHA":          "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	"ECDHE-ECDSA-AES256-SHA":        "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	"ECDHE-RSA-AES256-SHA":          "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	"AES128-GCM-SHA256":             "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	"AES256-GCM-SHA384":             "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	"AES128-SHA256":                 "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	"AES128-SHA":                    "TLS_RSA_WITH_AES_128_CBC_SHA",
+	"AES256-SHA":                    "TLS_RSA_WITH_AES_256_CBC_SHA",
+	"DES-CBC3-SHA":                  "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	"ECDHE-RSA-DES-CBC3-SHA":        "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+}
+
+// tls12Suites returns every TLS 1.2 suite crypto/tls can offer, keyed by ID.
+func tls12Suites() map[uint16]string {
+	suites := map[uint16]string{}
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range list {
+			for _, v := range s.SupportedVersions {
+				if v == tls.VersionTLS12 {
+					suites[s.ID] = s.Name
+				}
+			}
+		}
+	}
+	return suites
+}
+
+// allowedSuites returns the IANA names of the profile's TLS 1.2 ciphers.
+func (e ExpectedProfile) allowedSuites() map[string]bool {
+	allowed := map[string]bool{}
+	for _, c := range e.Ciphers {
+		if iana, ok := opensslToIANA[c]; ok {
+			allowed[iana] = true
+		}
+	}
+	return allowed
+}
+
+func (e ExpectedProfile) minVersion() uint16 {
+	if v, ok := tlsVersions[e.MinVersion]; ok {
+		return v
+	}
+	return tls.VersionTLS12
+}
+
+func (e ExpectedProfile) String() string {
+	return fmt.Sprintf("%s (min %s, %d ciphers)", e.Label, e.MinVersion, len(e.Ciphers))
+}
+
+func versionName(v uint16) string {
+	for name, id := range tlsVersions {
+		if id == v {
+			return string(name)
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
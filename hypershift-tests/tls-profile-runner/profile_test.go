@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"testing"
+
+	configv1 "github.com/openshift/api/config/v1"
+
+	"github.com/gangwgr/report"
+)
+
+func TestResolveProfile(t *testing.T) {
+	intermediate := configv1.TLSProfiles[configv1.TLSProfileIntermediateType]
+	modern := configv1.TLSProfiles[configv1.TLSProfileModernType]
+	tests := []struct {
+		name    string
+		profile *configv1.TLSSecurityProfile
+		want    ExpectedProfile
+		wantErr string
+	}{
+		{
+			name: "nil is the Intermediate default",
+			want: ExpectedProfile{Label: "default", MinVersion: intermediate.MinTLSVersion, Ciphers: intermediate.Ciphers},
+		},
+		{
+			name:    "empty type is the Intermediate default",
+			profile: &configv1.TLSSecurityProfile{},
+			want:    ExpectedProfile{Label: "default", MinVersion: intermediate.MinTLSVersion, Ciphers: intermediate.Ciphers},
+		},
+		{
+			name:    "Modern",
+			profile: &configv1.TLSSecurityProfile{Type: configv1.TLSProfileModernType},
+			want:    ExpectedProfile{Label: "Modern", MinVersion: modern.MinTLSVersion, Ciphers: modern.Ciphers},
+		},
+		{
+			name: "Custom",
+			profile: &configv1.TLSSecurityProfile{
+				Type: configv1.TLSProfileCustomType,
+				Custom: &configv1.CustomTLSProfile{TLSProfileSpec: configv1.TLSProfileSpec{
+					MinTLSVersion: configv1.VersionTLS12,
+					Ciphers:       []string{"ECDHE-RSA-AES128-GCM-SHA256"},
+				}},
+			},
+			want: ExpectedProfile{Label: "Custom", MinVersion: configv1.VersionTLS12, Ciphers: []string{"ECDHE-RSA-AES128-GCM-SHA256"}},
+		},
+		{
+			name:    "Custom without a custom section",
+			profile: &configv1.TLSSecurityProfile{Type: configv1.TLSProfileCustomType},
+			wantErr: "no custom section",
+		},
+		{
+			name:    "unknown type",
+			profile: &configv1.TLSSecurityProfile{Type: "Paranoid"},
+			wantErr: "unknown TLS profile type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveProfile(tt.profile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveProfile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveProfile() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveProfile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamedProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		wantType configv1.TLSProfileType
+		wantNil  bool
+		wantErr  bool
+	}{
+		{name: "Old", wantType: configv1.TLSProfileOldType},
+		{name: "Intermediate", wantType: configv1.TLSProfileIntermediateType},
+		{name: "Modern", wantType: configv1.TLSProfileModernType},
+		{name: "default", wantNil: true},
+		{name: "Custom", wantErr: true},
+		{name: "modern", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := namedProfile(tt.name)
+			switch {
+			case tt.wantErr:
+				if err == nil {
+					t.Fatalf("namedProfile(%q) = %+v, want an error", tt.name, got)
+				}
+			case err != nil:
+				t.Fatalf("namedProfile(%q) error = %v", tt.name, err)
+			case tt.wantNil:
+				if got != nil {
+					t.Errorf("namedProfile(%q) = %+v, want nil", tt.name, got)
+				}
+			case got == nil || got.Type != tt.wantType:
+				t.Errorf("namedProfile(%q) = %+v, want type %s", tt.name, got, tt.wantType)
+			}
+		})
+	}
+}
+
+func versions(accepted ...uint16) map[uint16]bool {
+	m := map[uint16]bool{}
+	for _, v := range probedVersions {
+		m[v] = false
+	}
+	for _, v := range accepted {
+		m[v] = true
+	}
+	return m
+}
+
+func suites(names ...string) map[string]bool {
+	m := map[string]bool{}
+	for _, n := range names {
+		m[n] = true
+	}
+	return m
+}
+
+func failures(findings []Finding) []string {
+	var out []string
+	for _, f := range findings {
+		if f.Level == report.LevelFail {
+			out = append(out, f.Message)
+		}
+	}
+	return out
+}
+
+func TestProbeResultEvaluate(t *testing.T) {
+	intermediate, _ := resolveProfile(nil)
+	modern, _ := resolveProfile(&configv1.TLSSecurityProfile{Type: configv1.TLSProfileModernType})
+	const (
+		gcm = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+		cbc = "TLS_RSA_WITH_AES_128_CBC_SHA"
+	)
+	tests := []struct {
+		name   string
+		result ProbeResult
+		exp    ExpectedProfile
+		want   []string
+	}{
+		{
+			name:   "Intermediate served",
+			result: ProbeResult{Versions: versions(tls.VersionTLS12, tls.VersionTLS13), Suites: suites(gcm)},
+			exp:    intermediate,
+		},
+		{
+			name:   "TLS 1.1 accepted below the minimum",
+			result: ProbeResult{Versions: versions(tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13), Suites: suites(gcm)},
+			exp:    intermediate,
+			want:   []string{"VersionTLS11 accepted (below VersionTLS12)"},
+		},
+		{
+			name:   "cipher outside the profile",
+			result: ProbeResult{Versions: versions(tls.VersionTLS12, tls.VersionTLS13), Suites: suites(gcm, cbc)},
+			exp:    intermediate,
+			want:   []string{"cipher " + cbc + " accepted but not in profile"},
+		},
+		{
+			name:   "no profile cipher accepted",
+			result: ProbeResult{Versions: versions(tls.VersionTLS12, tls.VersionTLS13), Suites: suites()},
+			exp:    intermediate,
+			want:   []string{"none of the profile's TLS 1.2 ciphers accepted"},
+		},
+		{
+			name:   "Modern served",
+			result: ProbeResult{Versions: versions(tls.VersionTLS13)},
+			exp:    modern,
+		},
+		{
+			name:   "Modern expected, Intermediate served",
+			result: ProbeResult{Versions: versions(tls.VersionTLS12, tls.VersionTLS13), Suites: suites(gcm)},
+			exp:    modern,
+			want: []string{
+				"VersionTLS12 accepted (below VersionTLS13)",
+				"cipher " + gcm + " accepted but not in profile",
+			},
+		},
+		{
+			name:   "minimum version rejected",
+			result: ProbeResult{Versions: versions(tls.VersionTLS13)},
+			exp:    intermediate,
+			want:   []string{"VersionTLS12 rejected (profile minimum)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := tt.result.Evaluate(tt.exp)
+			if got := failures(findings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failures = %q, want %q", got, tt.want)
+			}
+			if got := tt.result.Matches(tt.exp); got != (len(tt.want) == 0) {
+				t.Errorf("Matches() = %v, want %v", got, len(tt.want) == 0)
+			}
+		})
+	}
+}
+
+func TestEvaluateServingInfo(t *testing.T) {
+	intermediate, _ := resolveProfile(nil)
+	modern, _ := resolveProfile(&configv1.TLSSecurityProfile{Type: configv1.TLSProfileModernType})
+	tests := []struct {
+		name       string
+		minVersion string
+		suites     []string
+		exp        ExpectedProfile
+		want       []string
+	}{
+		{
+			name:       "OpenSSL names",
+			minVersion: "VersionTLS12",
+			suites:     []string{"ECDHE-RSA-AES128-GCM-SHA256"},
+			exp:        intermediate,
+		},
+		{
+			name:       "IANA names",
+			minVersion: "VersionTLS12",
+			suites:     []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			exp:        intermediate,
+		},
+		{
+			name:       "wrong minimum and extra cipher",
+			minVersion: "VersionTLS10",
+			suites:     []string{"ECDHE-RSA-AES128-GCM-SHA256", "AES128-SHA"},
+			exp:        intermediate,
+			want: []string{
+				`servingInfo.minTLSVersion: "VersionTLS10" (expected VersionTLS12)`,
+				"servingInfo cipher AES128-SHA not in profile",
+			},
+		},
+		{
+			name:       "no ciphers for a TLS 1.2 profile",
+			minVersion: "VersionTLS12",
+			exp:        intermediate,
+			want:       []string{"servingInfo lists no cipher suites"},
+		},
+		{
+			name:       "no ciphers for TLS 1.3 only",
+			minVersion: "VersionTLS13",
+			exp:        modern,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := failures(evaluateServingInfo(tt.minVersion, tt.suites, tt.exp))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("failures = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gangwgr/report"
+	configv1 "github.com/openshift/api/config/v1"
+)
+
+// Runner checks every catalog target against the TLS profile of its
+// profile source, and optionally walks the sources through a list of
+// profiles waiting for each target to roll out.
+type Runner struct {
+	Catalog  *Catalog
+	Clients  map[Cluster]*oc
+	Sources  map[Cluster]*ProfileSource
+	Vars     templateVars
+	Prober   Prober
+	Reporter *report.Reporter
+	// Only, if set, restricts the run to these target names.
+	Only map[string]bool
+	// SampleInterval is the pause between samples while tracking a
+	// profile transition.
+	SampleInterval time.Duration
+	// Timelines collects one entry per target and profile change.
+	Timelines []*Timeline
+	// CAFile is the default CA bundle for targets without their own.
+	CAFile string
+	// ClientCert is presented to targets that request client certificates.
+	ClientCert *tls.Certificate
+}
+
+// Discover resolves every selected target to an endpoint. Targets whose
+// cluster or profile source is not configured are skipped.
+func (r *Runner) Discover(ctx context.Context) []*Endpoint {
+	r.Reporter.Section("Discovering TLS targets")
+	var endpoints []*Endpoint
+	for i := range r.Catalog.Targets {
+		t := &r.Catalog.Targets[i]
+		if len(r.Only) > 0 && !r.Only[t.Name] {
+			continue
+		}
+		client, ok := r.Clients[t.Cluster]
+		if !ok {
+			r.Reporter.Log(report.LevelSkip, "[%s] no kubeconfig for %s cluster", t.Name, t.Cluster)
+			continue
+		}
+		if _, ok := r.Sources[t.ProfileSource]; !ok {
+			r.Reporter.Log(report.LevelSkip, "[%s] %s profile source not configured", t.Name, t.ProfileSource)
+			continue
+		}
+		ep, err := discover(ctx, *client, t, r.Vars)
+		if err != nil {
+			r.Reporter.Log(report.LevelFail, "[%s] %v", t.Name, err)
+			continue
+		}
+		r.Reporter.Log(report.LevelPass, "[%s] %s/%s (selector %s)", t.Name, ep.Namespace, ep.Deployment, ep.Selector)
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints
+}
+
+// expected resolves the profile currently configured on a source.
+func (r *Runner) expected(ctx context.Context, source Cluster) (ExpectedProfile, error) {
+	p, err := r.Sources[source].Get(ctx)
+	if err != nil {
+		return ExpectedProfile{}, err
+	}
+	return resolveProfile(p)
+}
+
+// check probes a target's endpoint and observed config once.
+func (r *Runner) check(ctx context.Context, ep *Endpoint, exp ExpectedProfile) []Finding {
+	var findings []Finding
+	if ep.Target.ObservedConfig != nil {
+		minVersion, suites, err := ep.observedServingInfo(ctx)
+		if err != nil {
+			findings = append(findings, Finding{report.LevelFail, err.Error()})
+		} else {
+			findings = append(findings, evaluateServingInfo(string(minVersion), suites, exp)...)
+		}
+	}
+	if ep.Target.Discovery.Port == 0 {
+		return findings
+	}
+
+	pods, err := ep.readyPods(ctx)
+	if err != nil || len(pods) == 0 {
+		return append(findings, Finding{report.LevelFail, fmt.Sprintf("no ready pods for %s/%s", ep.Namespace, ep.Deployment)})
+	}
+	cert := ep.Target.Certificate
+	res, err := r.probePod(ctx, ep, pods[0], cert != nil)
+	if err != nil {
+		return append(findings, Finding{report.LevelFail, err.Error()})
+	}
+	findings = append(findings, res.Evaluate(exp)...)
+	if cert != nil {
+		findings = append(findings, r.evaluateCert(ctx, ep, res.Cert)...)
+	}
+	return findings
+}
+
+// probePod port-forwards to a single pod and probes its TLS port, and its
+// serving certificate if withCert is set.
+func (r *Runner) probePod(ctx context.Context, ep *Endpoint, p pod, withCert bool) (*ProbeResult, error) {
+	addr, stop, err := ep.portForward(ctx, p, ep.Target.Discovery.Port)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	res, err := r.Prober.Probe(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %w", p.Name, ep.Target.Discovery.Port, err)
+	}
+	if withCert {
+		res.Cert, err = r.Prober.ProbeCertificate(ctx, addr, r.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: certificate probe: %w", p.Name, ep.Target.Discovery.Port, err)
+		}
+	}
+	return res, nil
+}
+
+// evaluateCert resolves the target's CA pool and DNS names and checks the
+// probed certificate against them.
+func (r *Runner) evaluateCert(ctx context.Context, ep *Endpoint, res *CertResult) []Finding {
+	spec := ep.Target.Certificate
+	vars := r.Vars
+	vars.Namespace = ep.Namespace
+
+	var findings []Finding
+	roots, err := ep.loadCAPool(ctx, spec, vars, r.CAFile)
+	if err != nil {
+		findings = append(findings, Finding{report.LevelFail, err.Error()})
+	}
+	var names []string
+	for _, tmpl := range spec.DNSNames {
+		name, err := expand(tmpl, vars)
+		if err != nil {
+			findings = append(findings, Finding{report.LevelFail, fmt.Sprintf("dnsNames template %q: %v", tmpl, err)})
+			continue
+		}
+		names = append(names, name)
+	}
+	return append(findings, res.Evaluate(spec, roots, names)...)
+}
+
+// CheckAll verifies each endpoint against its source's current profile.
+func (r *Runner) CheckAll(ctx context.Context, endpoints []*Endpoint) {
+	r.Reporter.Section("Verifying current TLS profiles")
+	for _, ep := range endpoints {
+		exp, err := r.expected(ctx, ep.Target.ProfileSource)
+		if err != nil {
+			r.Reporter.Log(report.LevelFail, "[%s] cannot read %s TLS profile: %v", ep.Target.Name, ep.Target.ProfileSource, err)
+			continue
+		}
+		r.Reporter.Step("%s: expecting %s from %s APIServer", ep.Target.Name, exp, ep.Target.ProfileSource)
+		logFindings(r.Reporter, ep.Target.Name, r.check(ctx, ep, exp))
+	}
+}
+
+// SwitchProfiles applies each named profile to the given source in turn,
+// tracks every target governed by that source through the transition,
+// verifies it, and finally restores the original profile.
+func (r *Runner) SwitchProfiles(ctx context.Context, source Cluster, profiles []string, endpoints []*Endpoint) error {
+	src, ok := r.Sources[source]
+	if !ok {
+		return fmt.Errorf("%s profile source not configured", source)
+	}
+	var governed []*Endpoint
+	for _, ep := range endpoints {
+		if ep.Target.ProfileSource == source {
+			governed = append(governed, ep)
+		}
+	}
+	if len(governed) == 0 {
+		return fmt.Errorf("no discovered targets follow the %s APIServer profile", source)
+	}
+
+	original, err := src.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read original profile: %w", err)
+	}
+	r.Reporter.Section(fmt.Sprintf("TLS Profile Switching on %s APIServer [Disruptive]", source))
+
+	for _, name := range profiles {
+		p, err := namedProfile(name)
+		if err != nil {
+			return err
+		}
+		if err := r.applyAndVerify(ctx, src, p, name, governed); err != nil {
+			return err
+		}
+	}
+
+	r.Reporter.Step("Restoring original %s TLS profile", source)
+	return r.applyAndVerify(ctx, src, original, "restored", governed)
+}
+
+// applyAndVerify patches the source and records a propagation timeline for
+// every governed target, sampling from the moment of the patch so the
+// transition window is captured, not just the final state.
+func (r *Runner) applyAndVerify(ctx context.Context, src *ProfileSource, p *configv1.TLSSecurityProfile, label string, governed []*Endpoint) error {
+	current, err := src.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read current %s profile: %w", src.Kind, err)
+	}
+	from, err := resolveProfile(current)
+	if err != nil {
+		return err
+	}
+	to, err := resolveProfile(p)
+	if err != nil {
+		return err
+	}
+
+	trackers := make([]*tracker, 0, len(governed))
+	for _, ep := range governed {
+		trackers = append(trackers, newTracker(ctx, r, ep, from, to, r.SampleInterval))
+	}
+
+	r.Reporter.Step("Patching %s APIServer → %s", src.Kind, label)
+	if err := src.Set(ctx, p); err != nil {
+		return fmt.Errorf("failed to patch %s profile: %w", src.Kind, err)
+	}
+	patchedAt := time.Now()
+	r.Reporter.Log(report.LevelPass, "Patched %s APIServer → %s", src.Kind, label)
+
+	kas := newKASRollout()
+	var wg sync.WaitGroup
+	for _, tr := range trackers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.run(ctx, patchedAt, kas, src.kasTimeout)
+		}()
+	}
+
+	r.Reporter.Info("Waiting for %s kube-apiserver rollout (timeout: %s)...", src.Kind, src.kasTimeout)
+	if err := src.WaitStable(ctx); err != nil {
+		r.Reporter.Log(report.LevelFail, "%s kube-apiserver did not stabilize: %v", src.Kind, err)
+	} else {
+		r.Reporter.Info("%s kube-apiserver stable after %s", src.Kind, time.Since(patchedAt).Round(time.Second))
+	}
+	kas.markDone()
+	wg.Wait()
+
+	for _, tr := range trackers {
+		r.Reporter.Step("%s: %s → %s", tr.ep.Target.Name, from.Label, to)
+		tr.timeline.report(r.Reporter)
+		logFindings(r.Reporter, tr.ep.Target.Name, r.check(ctx, tr.ep, to))
+		r.Timelines = append(r.Timelines, tr.timeline)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+// Phase classifies what a target served at one sample during a profile
+// transition.
+type Phase string
+
+const (
+	// PhaseOld means every reachable pod still serves the previous profile.
+	PhaseOld Phase = "old"
+	// PhaseNew means every reachable pod serves the new profile.
+	PhaseNew Phase = "new"
+	// PhaseMixed means some pods serve the old profile and others the new
+	// one, so clients get either depending on which pod they hit.
+	PhaseMixed Phase = "mixed"
+	// PhaseBoth means at least one pod accepts the union of the old and new
+	// profiles, so the same endpoint still negotiates what only the old
+	// profile allows while already negotiating what only the new one allows.
+	PhaseBoth Phase = "both"
+	// PhaseNeither means no pod was reachable, or at least one pod served
+	// something matching neither profile.
+	PhaseNeither Phase = "neither"
+)
+
+// Restart describes how the target got to the new profile.
+type Restart string
+
+const (
+	RestartNone    Restart = "hot-reload"
+	RestartRollout Restart = "rollout"
+	RestartForced  Restart = "forced"
+)
+
+// stableSamples is how many consecutive PhaseNew samples end tracking,
+// the same triple recheck the shell tests use.
+const stableSamples = 3
+
+// Sample is one observation of a target during a transition.
+type Sample struct {
+	// At is the time since the profile was patched.
+	At    Duration         `json:"at"`
+	Phase Phase            `json:"phase"`
+	Pods  map[string]Phase `json:"pods,omitempty"`
+	Error string           `json:"error,omitempty"`
+}
+
+// Window is a contiguous run of samples in the same transitional phase.
+type Window struct {
+	Phase Phase    `json:"phase"`
+	Start Duration `json:"start"`
+	End   Duration `json:"end"`
+}
+
+// Timeline records how one target moved from the old to the new profile.
+type Timeline struct {
+	Target    string    `json:"target"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	PatchedAt time.Time `json:"patchedAt"`
+	// Latency is the time from the patch until the target started serving
+	// the new profile for good. Nil if it never did.
+	Latency *Duration `json:"latency,omitempty"`
+	Restart Restart   `json:"restart"`
+	// Windows lists the mixed/both/neither windows seen during the
+	// transition.
+	Windows []Window `json:"windows,omitempty"`
+	Samples []Sample `json:"samples"`
+}
+
+// tracker samples one endpoint from the moment its profile source is
+// patched until the new profile has been served stably.
+type tracker struct {
+	runner   *Runner
+	ep       *Endpoint
+	from, to ExpectedProfile
+	interval time.Duration
+
+	initialPods map[string]int32
+	timeline    *Timeline
+}
+
+func newTracker(ctx context.Context, r *Runner, ep *Endpoint, from, to ExpectedProfile, interval time.Duration) *tracker {
+	tr := &tracker{
+		runner:      r,
+		ep:          ep,
+		from:        from,
+		to:          to,
+		interval:    interval,
+		initialPods: map[string]int32{},
+		timeline:    &Timeline{Target: ep.Target.Name, From: from.Label, To: to.Label, Restart: RestartNone},
+	}
+	pods, _ := ep.readyPods(ctx)
+	for _, p := range pods {
+		tr.initialPods[p.UID] = p.Restarts
+	}
+	return tr
+}
+
+// kasRollout signals when the governing kube-apiserver finished rolling
+// out after the patch.
+type kasRollout struct {
+	done chan struct{}
+	at   time.Time
+}
+
+func newKASRollout() *kasRollout { return &kasRollout{done: make(chan struct{})} }
+
+func (k *kasRollout) markDone() {
+	k.at = time.Now()
+	close(k.done)
+}
+
+func (k *kasRollout) finished() (time.Time, bool) {
+	select {
+	case <-k.done:
+		return k.at, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// run samples until the target is stable on the new profile or its
+// deadline passes. Restart-mode targets get their dynamic grace period
+// from the end of the kube-apiserver rollout before their pods are deleted.
+func (tr *tracker) run(ctx context.Context, patchedAt time.Time, kas *kasRollout, kasTimeout time.Duration) {
+	t := tr.ep.Target
+	tr.timeline.PatchedAt = patchedAt
+	deadline := patchedAt.Add(kasTimeout + t.Rollout.Timeout.Duration)
+	var stableAt time.Time
+	consecutive := 0
+
+	for {
+		s := tr.sample(ctx, time.Since(patchedAt))
+		tr.timeline.Samples = append(tr.timeline.Samples, s)
+		if s.Phase == PhaseNew {
+			if consecutive == 0 {
+				stableAt = patchedAt.Add(s.At.Duration)
+			}
+			consecutive++
+		} else {
+			consecutive = 0
+		}
+		if consecutive >= stableSamples {
+			latency := Duration{stableAt.Sub(patchedAt)}
+			tr.timeline.Latency = &latency
+			break
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+
+		if t.Rollout.Mode == RolloutRestart && tr.timeline.Restart != RestartForced && consecutive == 0 {
+			if at, ok := kas.finished(); ok && time.Since(at) >= t.Rollout.DynamicGrace.Duration {
+				tr.runner.Reporter.Info("[%s] no dynamic pickup within %s — restarting %s/%s",
+					t.Name, t.Rollout.DynamicGrace.Duration, tr.ep.Namespace, tr.ep.Deployment)
+				if err := tr.ep.deletePods(ctx); err != nil {
+					tr.runner.Reporter.Info("[%s] failed to delete pods: %v", t.Name, err)
+				}
+				tr.timeline.Restart = RestartForced
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			tr.finish()
+			return
+		case <-time.After(tr.interval):
+		}
+	}
+	tr.finish()
+}
+
+// sample probes every ready pod (and the observed config, if any) once.
+func (tr *tracker) sample(ctx context.Context, at time.Duration) Sample {
+	s := Sample{At: Duration{at}, Pods: map[string]Phase{}}
+	ep := tr.ep
+
+	var phases []Phase
+	if ep.Target.ObservedConfig != nil {
+		minVersion, suites, err := ep.observedServingInfo(ctx)
+		if err != nil {
+			s.Error = err.Error()
+			phases = append(phases, PhaseNeither)
+		} else {
+			phases = append(phases, classify(
+				!hasFailure(evaluateServingInfo(string(minVersion), suites, tr.from)),
+				!hasFailure(evaluateServingInfo(string(minVersion), suites, tr.to)),
+				false,
+			))
+		}
+	}
+
+	// Pods are listed for every target, so a rollout is noticed even where
+	// only the observed config can be checked.
+	pods, err := ep.readyPods(ctx)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	for _, p := range pods {
+		tr.notePod(p)
+	}
+
+	if ep.Target.Discovery.Port != 0 {
+		if len(pods) == 0 {
+			phases = append(phases, PhaseNeither)
+		}
+		for _, p := range pods {
+			res, err := tr.runner.probePod(ctx, ep, p, false)
+			phase := PhaseNeither
+			if err == nil {
+				phase = classify(res.Matches(tr.from), res.Matches(tr.to), res.acceptsBoth(tr.from, tr.to))
+			}
+			s.Pods[p.Name] = phase
+			phases = append(phases, phase)
+		}
+	}
+	s.Phase = combine(phases)
+	return s
+}
+
+// notePod records a pod replacement or container restart since the patch.
+func (tr *tracker) notePod(p pod) {
+	if tr.timeline.Restart != RestartNone {
+		return
+	}
+	restarts, known := tr.initialPods[p.UID]
+	if !known || p.Restarts > restarts {
+		tr.timeline.Restart = RestartRollout
+	}
+}
+
+// classify maps a pod's match against both profiles to a phase. When the
+// profiles are indistinguishable a match counts as new; a pod matching
+// neither but accepting their union serves both.
+func classify(matchesOld, matchesNew, acceptsBoth bool) Phase {
+	switch {
+	case matchesNew:
+		return PhaseNew
+	case matchesOld:
+		return PhaseOld
+	case acceptsBoth:
+		return PhaseBoth
+	default:
+		return PhaseNeither
+	}
+}
+
+// combine reduces the per-pod and observed-config phases of one sample to
+// the target's phase. A single endpoint serving both profiles is reported
+// ahead of a mixed rollout, since it outlives the rollout if left alone.
+func combine(phases []Phase) Phase {
+	if len(phases) == 0 {
+		return PhaseNeither
+	}
+	seen := map[Phase]bool{}
+	for _, p := range phases {
+		seen[p] = true
+	}
+	switch {
+	case seen[PhaseNeither]:
+		return PhaseNeither
+	case seen[PhaseBoth]:
+		return PhaseBoth
+	case seen[PhaseOld] && seen[PhaseNew]:
+		return PhaseMixed
+	case seen[PhaseOld]:
+		return PhaseOld
+	default:
+		return PhaseNew
+	}
+}
+
+// finish collapses the samples into mixed/both/neither windows.
+func (tr *tracker) finish() {
+	var cur *Window
+	for _, s := range tr.timeline.Samples {
+		transitional := s.Phase == PhaseMixed || s.Phase == PhaseBoth || s.Phase == PhaseNeither
+		if cur != nil && (!transitional || s.Phase != cur.Phase) {
+			tr.timeline.Windows = append(tr.timeline.Windows, *cur)
+			cur = nil
+		}
+		if transitional {
+			if cur == nil {
+				cur = &Window{Phase: s.Phase, Start: s.At}
+			}
+			cur.End = s.At
+		}
+	}
+	if cur != nil {
+		tr.timeline.Windows = append(tr.timeline.Windows, *cur)
+	}
+}
+
+// report logs the timeline's outcome.
+func (tl *Timeline) report(r *report.Reporter) {
+	if tl.Latency == nil {
+		r.Log(report.LevelFail, "[%s] never served %s stably (restart: %s)", tl.Target, tl.To, tl.Restart)
+	} else {
+		r.Log(report.LevelPass, "[%s] served %s after %s (restart: %s)", tl.Target, tl.To, tl.Latency.Round(time.Second), tl.Restart)
+	}
+	for _, w := range tl.Windows {
+		switch w.Phase {
+		case PhaseMixed:
+			r.Info("[%s] %s–%s: some pods served old (%s), others new (%s)",
+				tl.Target, w.Start.Round(time.Second), w.End.Round(time.Second), tl.From, tl.To)
+		case PhaseBoth:
+			r.Info("[%s] %s–%s: one endpoint accepted old (%s) and new (%s) profiles at once",
+				tl.Target, w.Start.Round(time.Second), w.End.Round(time.Second), tl.From, tl.To)
+		case PhaseNeither:
+			r.Info("[%s] %s–%s: neither profile served (no reachable pod or unexpected TLS config)",
+				tl.Target, w.Start.Round(time.Second), w.End.Round(time.Second))
+		}
+	}
+}
+
+// writeTimelines stores all recorded timelines as JSON.
+func writeTimelines(path string, timelines []*Timeline) error {
+	data, err := json.MarshalIndent(timelines, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write timeline: %w", err)
+	}
+	return nil
+}
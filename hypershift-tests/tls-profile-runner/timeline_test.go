@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+
+	configv1 "github.com/openshift/api/config/v1"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name                                string
+		matchesOld, matchesNew, acceptsBoth bool
+		want                                Phase
+	}{
+		{name: "old", matchesOld: true, want: PhaseOld},
+		{name: "new", matchesNew: true, want: PhaseNew},
+		{name: "indistinguishable profiles count as new", matchesOld: true, matchesNew: true, want: PhaseNew},
+		{name: "union of both", acceptsBoth: true, want: PhaseBoth},
+		{name: "neither", want: PhaseNeither},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classify(tt.matchesOld, tt.matchesNew, tt.acceptsBoth); got != tt.want {
+				t.Errorf("classify() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCombine(t *testing.T) {
+	tests := []struct {
+		name   string
+		phases []Phase
+		want   Phase
+	}{
+		{name: "nothing observed", want: PhaseNeither},
+		{name: "all old", phases: []Phase{PhaseOld, PhaseOld}, want: PhaseOld},
+		{name: "all new", phases: []Phase{PhaseNew, PhaseNew}, want: PhaseNew},
+		{name: "mixed rollout", phases: []Phase{PhaseOld, PhaseNew}, want: PhaseMixed},
+		{name: "one pod serving both", phases: []Phase{PhaseNew, PhaseBoth}, want: PhaseBoth},
+		{name: "both ahead of mixed", phases: []Phase{PhaseOld, PhaseBoth, PhaseNew}, want: PhaseBoth},
+		{name: "neither wins", phases: []Phase{PhaseBoth, PhaseNeither, PhaseNew}, want: PhaseNeither},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combine(tt.phases); got != tt.want {
+				t.Errorf("combine(%v) = %s, want %s", tt.phases, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	at := func(s int) Duration { return Duration{time.Duration(s) * time.Second} }
+	tests := []struct {
+		name   string
+		phases []Phase
+		want   []Window
+	}{
+		{
+			name:   "hot reload",
+			phases: []Phase{PhaseOld, PhaseNew, PhaseNew, PhaseNew},
+		},
+		{
+			name:   "rollout through mixed and neither",
+			phases: []Phase{PhaseOld, PhaseMixed, PhaseMixed, PhaseNeither, PhaseNew},
+			want: []Window{
+				{Phase: PhaseMixed, Start: at(1), End: at(2)},
+				{Phase: PhaseNeither, Start: at(3), End: at(3)},
+			},
+		},
+		{
+			name:   "separate windows of the same phase",
+			phases: []Phase{PhaseBoth, PhaseNew, PhaseBoth, PhaseBoth},
+			want: []Window{
+				{Phase: PhaseBoth, Start: at(0), End: at(0)},
+				{Phase: PhaseBoth, Start: at(2), End: at(3)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &tracker{timeline: &Timeline{}}
+			for i, p := range tt.phases {
+				tr.timeline.Samples = append(tr.timeline.Samples, Sample{At: at(i), Phase: p})
+			}
+			tr.finish()
+			if !reflect.DeepEqual(tr.timeline.Windows, tt.want) {
+				t.Errorf("windows = %+v, want %+v", tr.timeline.Windows, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeResultAcceptsBoth(t *testing.T) {
+	custom := func(min configv1.TLSProtocolVersion, ciphers ...string) ExpectedProfile {
+		return ExpectedProfile{Label: "Custom", MinVersion: min, Ciphers: ciphers}
+	}
+	from := custom(configv1.VersionTLS11, "ECDHE-RSA-AES128-GCM-SHA256", "ECDHE-RSA-AES256-GCM-SHA384")
+	to := custom(configv1.VersionTLS12, "ECDHE-RSA-AES256-GCM-SHA384", "ECDHE-RSA-CHACHA20-POLY1305")
+	const (
+		oldOnly = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+		shared  = "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+		newOnly = "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"
+		neither = "TLS_RSA_WITH_AES_128_CBC_SHA"
+	)
+	tests := []struct {
+		name   string
+		result ProbeResult
+		want   bool
+	}{
+		{
+			name:   "union of both profiles",
+			result: ProbeResult{Versions: versions(tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13), Suites: suites(oldOnly, shared, newOnly)},
+			want:   true,
+		},
+		{
+			name:   "old-only version with a new-only cipher",
+			result: ProbeResult{Versions: versions(tls.VersionTLS11, tls.VersionTLS12), Suites: suites(shared, newOnly)},
+			want:   true,
+		},
+		{
+			name:   "old profile only",
+			result: ProbeResult{Versions: versions(tls.VersionTLS11, tls.VersionTLS12), Suites: suites(oldOnly, shared)},
+		},
+		{
+			name:   "new profile only",
+			result: ProbeResult{Versions: versions(tls.VersionTLS12, tls.VersionTLS13), Suites: suites(shared, newOnly)},
+		},
+		{
+			name:   "something neither profile allows",
+			result: ProbeResult{Versions: versions(tls.VersionTLS11, tls.VersionTLS12), Suites: suites(oldOnly, newOnly, neither)},
+		},
+		{
+			name:   "version below both minimums",
+			result: ProbeResult{Versions: versions(tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12), Suites: suites(oldOnly, newOnly)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.acceptsBoth(from, to); got != tt.want {
+				t.Errorf("acceptsBoth() = %v, want %v", got, tt.want)
+			}
+			if tt.want && (tt.result.Matches(from) || tt.result.Matches(to)) {
+				t.Errorf("a union endpoint should match neither profile on its own")
+			}
+		})
+	}
+}
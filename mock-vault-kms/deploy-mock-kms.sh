@@ -7,6 +7,11 @@
 # plane nodes. The mock plugin accepts all vault-kube-kms flags but ignores
 # them, running a mock KMS v2 gRPC provider instead.
 #
+# On SIGTERM the plugin reports unhealthy (Status and /readyz) for
+# --shutdown-delay, then drains in-flight RPCs for up to
+# --shutdown-grace-period before removing its socket, so a static pod
+# restart does not fail apiserver decrypts mid-call.
+#
 # For TechPreview v2, the plugin lifecycle controller manages the plugin
 # automatically. This script is for manual testing when the lifecycle
 # controller is not yet available.
@@ -95,6 +100,9 @@ metadata:
 spec:
   hostNetwork: false
   priorityClassName: system-node-critical
+  # Must exceed --shutdown-delay + --shutdown-grace-period so the plugin
+  # finishes draining before the kubelet sends SIGKILL.
+  terminationGracePeriodSeconds: 30
   containers:
   - name: mock-vault-kms
     image: ${KMS_IMAGE}
@@ -106,6 +114,26 @@ spec:
     - "--transit-mount=transit"
     - "--transit-key=kms-key"
     - "--log-level=info"
+    - "--metrics-port=8080"
+    - "--shutdown-delay=5s"
+    - "--shutdown-grace-period=15s"
+    # One JSON record per RPC in the pod log, for kms-trace.
+    - "--audit-log=-"
+    ports:
+    - name: metrics
+      containerPort: 8080
+    readinessProbe:
+      httpGet:
+        path: /readyz
+        port: 8080
+      periodSeconds: 2
+      failureThreshold: 1
+    livenessProbe:
+      httpGet:
+        path: /healthz
+        port: 8080
+      periodSeconds: 10
+      failureThreshold: 3
     volumeMounts:
     - name: kmsplugin
       mountPath: /var/run/kmsplugin
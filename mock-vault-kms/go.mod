@@ -2,13 +2,15 @@ module github.com/gangwgr/mock-vault-kms
 
 go 1.25.0
 
-require k8s.io/kms v0.35.3
+require (
+	google.golang.org/grpc v1.80.0
+	k8s.io/kms v0.35.3
+)
 
 require (
 	golang.org/x/net v0.49.0 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/text v0.33.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20260120221211-b8f7ae30c516 // indirect
-	google.golang.org/grpc v1.80.0 // indirect
 	google.golang.org/protobuf v1.36.11 // indirect
 )
@@ -0,0 +1,212 @@
+// kms-loadgen: drives a KMS v2 plugin with a Decrypt burst and checks that
+// Status keeps answering within the apiserver's health check timeout.
+//
+// After a kube-apiserver restart its cache warm-up sends a flood of
+// Decrypts. If the plugin queues Status behind them, Status misses its
+// timeout and the apiserver reports KMS unhealthy although the plugin is
+// only busy. This tool reproduces that: it keeps --decrypt-workers
+// Decrypts in flight for --duration and calls Status every
+// --status-interval with --status-timeout, the way the apiserver does.
+//
+// It works against any KMS v2 plugin socket. Against mock-vault-kms, run
+// the plugin with --backend-latency so it is slow enough to saturate, and
+// pass --metrics-url to record its lane queue depths:
+//
+//	mock-vault-kms --listen-address=unix:///tmp/kms.sock --metrics-port=8080 --backend-latency=50ms
+//	kms-loadgen --endpoint unix:///tmp/kms.sock --metrics-url http://localhost:8080/metrics
+//
+// Run the plugin again with --priority-lanes=false to see the failure the
+// lanes prevent. The exit code is 1 if any Status call failed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gangwgr/report"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	kmsapi "k8s.io/kms/apis/v2"
+	"k8s.io/kms/pkg/util"
+)
+
+var (
+	endpoint       = flag.String("endpoint", "unix:///var/run/kmsplugin/kms.sock", "KMS v2 plugin endpoint")
+	duration       = flag.Duration("duration", 30*time.Second, "How long to generate load")
+	decryptWorkers = flag.Int("decrypt-workers", 200, "Decrypt calls kept in flight")
+	encryptWorkers = flag.Int("encrypt-workers", 0, "Encrypt calls kept in flight")
+	rpcTimeout     = flag.Duration("rpc-timeout", 3*time.Second, "Timeout for each Encrypt and Decrypt")
+	statusInterval = flag.Duration("status-interval", time.Second, "Time between Status calls")
+	statusTimeout  = flag.Duration("status-timeout", 3*time.Second, "Timeout for each Status call; the apiserver's default KMS timeout is 3s")
+	metricsURL     = flag.String("metrics-url", "", "Plugin metrics to sample for queue depth, e.g. http://localhost:8080/metrics")
+	queueMetric    = flag.String("queue-metric", "mock_vault_kms_queue_depth", "Gauge sampled from --metrics-url, by lane")
+	sampleInterval = flag.Duration("sample-interval", 500*time.Millisecond, "Time between --metrics-url scrapes")
+)
+
+func main() {
+	flag.Parse()
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "%sError:%s %v\n", report.Red, report.Reset, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context) error {
+	r := &report.Reporter{}
+	addr, err := util.ParseEndpoint(*endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid --endpoint: %w", err)
+	}
+	conn, err := grpc.NewClient("unix:"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	defer conn.Close()
+	client := kmsapi.NewKeyManagementServiceClient(conn)
+
+	r.Section("KMS Load Test")
+	r.Info("Endpoint:  %s", addr)
+	r.Info("Load:      %d Decrypt and %d Encrypt worker(s) for %s", *decryptWorkers, *encryptWorkers, *duration)
+	r.Info("Status:    every %s, timeout %s", *statusInterval, *statusTimeout)
+
+	// A ciphertext to decrypt, from the plugin itself.
+	cctx, ccancel := context.WithTimeout(ctx, *rpcTimeout)
+	seed, err := client.Encrypt(cctx, &kmsapi.EncryptRequest{Plaintext: []byte("kms-loadgen"), Uid: "kms-loadgen-seed"})
+	ccancel()
+	if err != nil {
+		return fmt.Errorf("seed Encrypt failed: %w", err)
+	}
+	r.Info("Key ID:    %s", seed.KeyId)
+
+	stats := newStats()
+	var depth *queueSampler
+	if *metricsURL != "" {
+		depth = newQueueSampler(*metricsURL, *queueMetric)
+	}
+
+	loadCtx, stop := context.WithTimeout(ctx, *duration)
+	defer stop()
+	var wg sync.WaitGroup
+	worker := func(method string, call func(ctx context.Context, uid string) error) {
+		defer wg.Done()
+		for i := 0; loadCtx.Err() == nil; i++ {
+			rctx, rcancel := context.WithTimeout(loadCtx, *rpcTimeout)
+			start := time.Now()
+			err := call(rctx, fmt.Sprintf("kms-loadgen-%s-%d", method, i))
+			rcancel()
+			if loadCtx.Err() != nil {
+				return // cut off by the end of the run, not the plugin
+			}
+			stats.add(method, time.Since(start), err)
+		}
+	}
+	for range *decryptWorkers {
+		wg.Add(1)
+		go worker("Decrypt", func(ctx context.Context, uid string) error {
+			_, err := client.Decrypt(ctx, &kmsapi.DecryptRequest{Ciphertext: seed.Ciphertext, KeyId: seed.KeyId, Annotations: seed.Annotations, Uid: uid})
+			return err
+		})
+	}
+	for range *encryptWorkers {
+		wg.Add(1)
+		go worker("Encrypt", func(ctx context.Context, uid string) error {
+			_, err := client.Encrypt(ctx, &kmsapi.EncryptRequest{Plaintext: []byte("kms-loadgen"), Uid: uid})
+			return err
+		})
+	}
+
+	// Status runs on its own schedule, like the apiserver health check,
+	// and is not cut off by the end of the run.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(*statusInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-loadCtx.Done():
+				return
+			case <-t.C:
+			}
+			sctx, scancel := context.WithTimeout(ctx, *statusTimeout)
+			start := time.Now()
+			resp, err := client.Status(sctx, &kmsapi.StatusRequest{})
+			scancel()
+			if err == nil && resp.Healthz != "ok" {
+				err = fmt.Errorf("healthz %q", resp.Healthz)
+			}
+			stats.add("Status", time.Since(start), err)
+		}
+	}()
+
+	// Scrapes get their own schedule so that a slow /metrics never delays
+	// a Status call.
+	if depth != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.NewTicker(*sampleInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-loadCtx.Done():
+					return
+				case <-t.C:
+				}
+				depth.sample(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	r.Section("Results")
+	for _, method := range []string{"Status", "Encrypt", "Decrypt"} {
+		s := stats.summary(method)
+		if s.count == 0 {
+			continue
+		}
+		r.Info("%-8s %7d calls  %6.0f/s  p50 %-9s p99 %-9s max %-9s errors %d",
+			method, s.count, float64(s.count)/duration.Seconds(), s.p50, s.p99, s.max, s.errors)
+		for _, msg := range sortedKeys(s.errorKinds) {
+			r.Warn("%-8s %d x %s", method, s.errorKinds[msg], msg)
+		}
+	}
+	if depth != nil {
+		if depth.err != nil {
+			r.Warn("Could not sample %s: %v", *metricsURL, depth.err)
+		}
+		for _, lane := range depth.lanes() {
+			r.Info("Peak queue depth %-8s %d", lane, depth.peak[lane])
+		}
+	}
+
+	r.Section("Checks")
+	st := stats.summary("Status")
+	switch {
+	case st.count == 0:
+		r.Failf("No Status call completed; increase --duration or lower --status-interval")
+	case st.errors > 0:
+		r.Failf("%d of %d Status call(s) failed or exceeded %s; the apiserver would report KMS unhealthy", st.errors, st.count, *statusTimeout)
+	default:
+		r.Passf("All %d Status calls answered within %s (max %s)", st.count, *statusTimeout, st.max)
+	}
+	if d := stats.summary("Decrypt"); d.count > 0 && d.errors == d.count {
+		r.Failf("Every Decrypt failed")
+	}
+	r.Summary()
+	if r.Fail > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
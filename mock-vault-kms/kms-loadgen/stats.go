@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// stats collects per-method latencies and errors.
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]map[string]int // method -> gRPC code -> count
+}
+
+func newStats() *stats {
+	return &stats{latencies: map[string][]time.Duration{}, errors: map[string]map[string]int{}}
+}
+
+func (s *stats) add(method string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[method] = append(s.latencies[method], d)
+	if err != nil {
+		if s.errors[method] == nil {
+			s.errors[method] = map[string]int{}
+		}
+		kind := status.Code(err).String()
+		if _, ok := status.FromError(err); !ok {
+			kind = err.Error()
+		}
+		s.errors[method][kind]++
+	}
+}
+
+type methodSummary struct {
+	count, errors int
+	p50, p99, max time.Duration
+	errorKinds    map[string]int
+}
+
+func (s *stats) summary(method string) methodSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := slices.Clone(s.latencies[method])
+	out := methodSummary{count: len(l), errorKinds: s.errors[method]}
+	for _, n := range out.errorKinds {
+		out.errors += n
+	}
+	if len(l) == 0 {
+		return out
+	}
+	slices.Sort(l)
+	pct := func(p float64) time.Duration {
+		return l[int(p*float64(len(l)-1))].Round(time.Microsecond)
+	}
+	out.p50, out.p99, out.max = pct(0.50), pct(0.99), l[len(l)-1].Round(time.Microsecond)
+	return out
+}
+
+// queueSampler records the peak of a per-lane gauge from the plugin's
+// Prometheus metrics.
+type queueSampler struct {
+	url, metric string
+	client      *http.Client
+	peak        map[string]int
+	err         error // last scrape error
+}
+
+func newQueueSampler(url, metric string) *queueSampler {
+	return &queueSampler{url: url, metric: metric, client: &http.Client{Timeout: 2 * time.Second}, peak: map[string]int{}}
+}
+
+func (q *queueSampler) sample(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, q.url, nil)
+	if err != nil {
+		q.err = err
+		return
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		q.err = err
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		q.err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		return
+	}
+	// Lines look like: mock_vault_kms_queue_depth{lane="Decrypt"} 12
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		rest, ok := strings.CutPrefix(line, q.metric+"{")
+		if !ok {
+			continue
+		}
+		labels, value, ok := strings.Cut(rest, "} ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+		lane := labels
+		for _, l := range strings.Split(labels, ",") {
+			if name, ok := strings.CutPrefix(l, "lane="); ok {
+				lane = strings.Trim(name, `"`)
+			}
+		}
+		if int(v) > q.peak[lane] {
+			q.peak[lane] = int(v)
+		} else if _, seen := q.peak[lane]; !seen {
+			q.peak[lane] = 0
+		}
+	}
+	q.err = sc.Err()
+}
+
+func (q *queueSampler) lanes() []string {
+	return sortedKeys(q.peak)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
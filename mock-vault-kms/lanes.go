@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// lane is a concurrency limit and FIFO queue for one kind of RPC.
+type lane struct {
+	name     string
+	priority int // higher is dispatched first
+	limit    int
+	// shared lanes also take a slot from the scheduler's pool. Status
+	// is not shared, so a Decrypt burst can never hold all its slots.
+	shared  bool
+	active  int
+	waiting []*waiter
+}
+
+type waiter struct {
+	lane    *lane
+	granted chan struct{}
+	start   time.Time
+}
+
+// scheduler admits RPCs into their lanes. After an apiserver restart the
+// Decrypt burst from its cache warm-up can be large enough that a Status
+// queued behind it misses its timeout and the apiserver marks KMS
+// unhealthy. With lanes, Status has its own slots and is always dispatched
+// before Encrypt, which is dispatched before Decrypt.
+type scheduler struct {
+	mu       sync.Mutex
+	lanes    map[string]*lane
+	ordered  []*lane // by priority
+	fallback *lane   // for methods without a lane of their own
+	pool     int     // slots shared by the shared lanes
+	used     int
+	maxQueue int
+	metrics  *metrics
+}
+
+// laneConfig is the --lanes flag: comma-separated method=limit pairs, in
+// priority order. A method not listed uses the last lane.
+type laneConfig struct {
+	names  []string
+	limits []int
+}
+
+func parseLaneConfig(s string) (laneConfig, error) {
+	var c laneConfig
+	for _, part := range strings.Split(s, ",") {
+		name, limit, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return c, fmt.Errorf("invalid lane %q, expected method=limit", part)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("invalid limit for lane %s: %q", name, limit)
+		}
+		c.names = append(c.names, name)
+		c.limits = append(c.limits, n)
+	}
+	return c, nil
+}
+
+// newScheduler creates one lane per entry in cfg. Status, if listed, is
+// never counted against pool. With priorities false all RPCs, Status
+// included, share a single FIFO lane of size pool, as they did before
+// lanes existed; this is kept for comparing the two with the load
+// generator.
+func newScheduler(cfg laneConfig, pool, maxQueue int, priorities bool, m *metrics) *scheduler {
+	s := &scheduler{lanes: map[string]*lane{}, pool: pool, maxQueue: maxQueue, metrics: m}
+	if !priorities {
+		s.fallback = &lane{name: "all", limit: pool, shared: true}
+		s.ordered = []*lane{s.fallback}
+		m.setLane(s.fallback.name, 0, 0)
+		return s
+	}
+	for i, name := range cfg.names {
+		l := &lane{
+			name:     name,
+			priority: len(cfg.names) - i,
+			limit:    cfg.limits[i],
+			shared:   name != "Status",
+		}
+		s.lanes[name] = l
+		s.ordered = append(s.ordered, l)
+		m.setLane(name, 0, 0)
+	}
+	sort.SliceStable(s.ordered, func(i, j int) bool { return s.ordered[i].priority > s.ordered[j].priority })
+	s.fallback = s.ordered[len(s.ordered)-1]
+	return s
+}
+
+func (s *scheduler) laneFor(method string) *lane {
+	if l, ok := s.lanes[method]; ok {
+		return l
+	}
+	return s.fallback
+}
+
+// canRun reports whether l has room. Callers hold s.mu.
+func (s *scheduler) canRun(l *lane) bool {
+	return l.active < l.limit && (!l.shared || s.used < s.pool)
+}
+
+func (s *scheduler) start(l *lane) {
+	l.active++
+	if l.shared {
+		s.used++
+	}
+}
+
+// acquire waits for a slot in method's lane. The returned function
+// releases it. A full queue fails with ResourceExhausted so that the
+// caller retries rather than piling up; a caller that gives up while
+// queued gets its context's error.
+func (s *scheduler) acquire(ctx context.Context, method string) (func(), time.Duration, error) {
+	l := s.laneFor(method)
+	s.mu.Lock()
+	// finish hands out free slots as soon as they appear, so if l has
+	// room nothing in a higher lane is waiting for it.
+	if s.canRun(l) && len(l.waiting) == 0 {
+		s.start(l)
+		s.updateMetrics(l)
+		s.mu.Unlock()
+		return func() { s.release(l) }, 0, nil
+	}
+	if len(l.waiting) >= s.maxQueue {
+		s.mu.Unlock()
+		s.metrics.addRejected(l.name, "queue_full")
+		return nil, 0, status.Errorf(codes.ResourceExhausted, "%s queue is full (%d waiting)", l.name, s.maxQueue)
+	}
+	w := &waiter{lane: l, granted: make(chan struct{}), start: time.Now()}
+	l.waiting = append(l.waiting, w)
+	s.updateMetrics(l)
+	s.mu.Unlock()
+
+	select {
+	case <-w.granted:
+		wait := time.Since(w.start)
+		s.metrics.observeQueueWait(l.name, wait)
+		return func() { s.release(l) }, wait, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.granted:
+			// Granted while we were giving up; hand the slot on.
+			s.finish(l)
+		default:
+			s.remove(w)
+		}
+		s.updateMetrics(l)
+		s.mu.Unlock()
+		s.metrics.addRejected(l.name, "cancelled")
+		return nil, time.Since(w.start), status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (s *scheduler) remove(w *waiter) {
+	q := w.lane.waiting
+	for i := range q {
+		if q[i] == w {
+			w.lane.waiting = append(q[:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *scheduler) release(l *lane) {
+	s.mu.Lock()
+	s.finish(l)
+	s.mu.Unlock()
+}
+
+// finish frees l's slot and hands free slots to waiters, highest
+// priority first. Callers hold s.mu.
+func (s *scheduler) finish(l *lane) {
+	l.active--
+	if l.shared {
+		s.used--
+	}
+	for _, o := range s.ordered {
+		for len(o.waiting) > 0 && s.canRun(o) {
+			w := o.waiting[0]
+			o.waiting = o.waiting[1:]
+			s.start(o)
+			close(w.granted)
+		}
+		s.updateMetrics(o)
+	}
+}
+
+func (s *scheduler) updateMetrics(l *lane) {
+	s.metrics.setLane(l.name, len(l.waiting), l.active)
+}
+
+// describe is printed at startup.
+func (s *scheduler) describe() string {
+	parts := make([]string, 0, len(s.ordered))
+	for _, l := range s.ordered {
+		p := fmt.Sprintf("%s=%d", l.name, l.limit)
+		if !l.shared {
+			p += " (reserved)"
+		}
+		parts = append(parts, p)
+	}
+	return fmt.Sprintf("%s; shared pool %d, queue %d per lane", strings.Join(parts, " > "), s.pool, s.maxQueue)
+}
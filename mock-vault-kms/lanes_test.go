@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type acquired struct {
+	method  string
+	release func()
+	err     error
+}
+
+// acquireAsync starts acquire for method and reports the result on out.
+func acquireAsync(ctx context.Context, s *scheduler, method string, out chan<- acquired) {
+	go func() {
+		release, _, err := s.acquire(ctx, method)
+		out <- acquired{method, release, err}
+	}()
+}
+
+// waitQueued waits until n RPCs are queued in lane.
+func waitQueued(t *testing.T, s *scheduler, lane string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		got := len(s.laneFor(lane).waiting)
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d RPC(s) queued in %s, want %d", got, lane, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func mustAcquire(t *testing.T, s *scheduler, method string) func() {
+	t.Helper()
+	release, wait, err := s.acquire(context.Background(), method)
+	if err != nil || wait != 0 {
+		t.Fatalf("acquire(%s) = wait %s, error %v; want an immediate slot", method, wait, err)
+	}
+	return release
+}
+
+func newTestScheduler(t *testing.T, lanes string, pool, maxQueue int, priorities bool) (*scheduler, *metrics) {
+	t.Helper()
+	cfg, err := parseLaneConfig(lanes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics()
+	return newScheduler(cfg, pool, maxQueue, priorities, m), m
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s, _ := newTestScheduler(t, "Status=1,Encrypt=4,Decrypt=4", 1, 10, true)
+	hold := mustAcquire(t, s, "Decrypt")
+
+	// Status has a reserved slot, so a full pool does not hold it up.
+	mustAcquire(t, s, "Status")()
+
+	out := make(chan acquired, 2)
+	acquireAsync(context.Background(), s, "Decrypt", out)
+	waitQueued(t, s, "Decrypt", 1)
+	acquireAsync(context.Background(), s, "Encrypt", out)
+	waitQueued(t, s, "Encrypt", 1)
+
+	// The freed pool slot goes to the later but higher priority Encrypt.
+	hold()
+	first := <-out
+	if first.err != nil || first.method != "Encrypt" {
+		t.Fatalf("first granted = %s (%v), want Encrypt", first.method, first.err)
+	}
+	waitQueued(t, s, "Decrypt", 1)
+	first.release()
+	second := <-out
+	if second.err != nil || second.method != "Decrypt" {
+		t.Fatalf("second granted = %s (%v), want Decrypt", second.method, second.err)
+	}
+	second.release()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used != 0 {
+		t.Errorf("%d pool slot(s) still used after every release", s.used)
+	}
+}
+
+func TestSchedulerWithoutPriorities(t *testing.T) {
+	s, _ := newTestScheduler(t, "Status=1,Encrypt=4,Decrypt=4", 1, 10, false)
+	hold := mustAcquire(t, s, "Decrypt")
+
+	// With one shared FIFO lane, Status waits behind the Decrypt.
+	out := make(chan acquired, 1)
+	acquireAsync(context.Background(), s, "Status", out)
+	waitQueued(t, s, "Status", 1)
+	hold()
+	if got := <-out; got.err != nil || got.method != "Status" {
+		t.Fatalf("granted = %s (%v), want Status", got.method, got.err)
+	}
+}
+
+func TestSchedulerQueueFull(t *testing.T) {
+	s, m := newTestScheduler(t, "Status=1,Decrypt=1", 1, 1, true)
+	hold := mustAcquire(t, s, "Decrypt")
+	out := make(chan acquired, 1)
+	acquireAsync(context.Background(), s, "Decrypt", out)
+	waitQueued(t, s, "Decrypt", 1)
+
+	_, _, err := s.acquire(context.Background(), "Decrypt")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("acquire with a full queue = %v, want ResourceExhausted", err)
+	}
+	if got := m.rejected[[2]string{"Decrypt", "queue_full"}]; got != 1 {
+		t.Errorf("queue_full rejections = %d, want 1", got)
+	}
+
+	// The queued RPC still gets the slot once it frees up.
+	hold()
+	got := <-out
+	if got.err != nil {
+		t.Fatalf("queued Decrypt: %v", got.err)
+	}
+	got.release()
+}
+
+func TestSchedulerCancelWhileQueued(t *testing.T) {
+	s, m := newTestScheduler(t, "Status=1,Decrypt=1", 1, 10, true)
+	hold := mustAcquire(t, s, "Decrypt")
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan acquired, 1)
+	acquireAsync(ctx, s, "Decrypt", out)
+	waitQueued(t, s, "Decrypt", 1)
+
+	cancel()
+	if got := <-out; status.Code(got.err) != codes.Canceled {
+		t.Fatalf("cancelled acquire = %v, want Canceled", got.err)
+	}
+	waitQueued(t, s, "Decrypt", 0)
+	if got := m.rejected[[2]string{"Decrypt", "cancelled"}]; got != 1 {
+		t.Errorf("cancelled rejections = %d, want 1", got)
+	}
+
+	// The abandoned waiter must not keep the freed slot.
+	hold()
+	mustAcquire(t, s, "Decrypt")()
+}
+
+func TestParseLaneConfig(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "Status=1,Encrypt=8,Decrypt=32", want: []string{"Status", "Encrypt", "Decrypt"}},
+		{in: " Status=1 , Decrypt=2", want: []string{"Status", "Decrypt"}},
+		{in: "Status", wantErr: true},
+		{in: "=3", wantErr: true},
+		{in: "Decrypt=0", wantErr: true},
+		{in: "Decrypt=many", wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg, err := parseLaneConfig(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLaneConfig(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(cfg.names, tt.want) {
+			t.Errorf("parseLaneConfig(%q) = %v, want %v", tt.in, cfg.names, tt.want)
+		}
+	}
+}
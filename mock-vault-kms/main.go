@@ -2,7 +2,22 @@
 // implementation (k8s.io/kms/internal/plugins/_mock). Accepts all vault-kube-kms
 // command-line flags but ignores them, providing a simple AES-GCM encryption
 // service so the KMS plugin lifecycle controller can be tested without a
-// real Vault Enterprise instance.
+// real Vault Enterprise instance. With --vault-backend it uses the flags to
+// encrypt with a real Vault transit key instead.
+//
+// On SIGTERM the plugin drains instead of stopping at once: Status and
+// /readyz report unhealthy first, then new RPCs are refused and in-flight
+// ones get up to --shutdown-grace-period to finish. The audit log and
+// metrics are flushed before the socket is removed.
+//
+// RPCs are admitted through per-method lanes (--lanes) so that a Decrypt
+// burst cannot delay Status past the apiserver's health check timeout.
+// --backend-latency makes the mock slow enough to reproduce that burst;
+// see kms-loadgen.
+//
+// Every RPC's uid is its correlation ID: it is written to the audit log
+// and, with --vault-backend, sent to Vault in the X-KMS-Correlation-ID
+// header. kms-trace joins the logs on it.
 //
 // Reference: https://github.com/kubernetes/kms/tree/main/internal/plugins/_mock
 package main
@@ -31,9 +46,13 @@ const mockKeyID = "mock-vault-kms-key-v1"
 // framework. It performs local AES-256-GCM encryption with a static key.
 type mockVaultKMSService struct {
 	aead cipher.AEAD
+	// ready is false once shutdown has started.
+	ready func() bool
+	// latency stands in for the Vault round trip of every RPC.
+	latency time.Duration
 }
 
-func newMockVaultKMSService() (*mockVaultKMSService, error) {
+func newMockVaultKMSService(ready func() bool, latency time.Duration) (*mockVaultKMSService, error) {
 	key := sha256.Sum256([]byte("mock-vault-kms-static-key-for-testing-only"))
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
@@ -43,18 +62,42 @@ func newMockVaultKMSService() (*mockVaultKMSService, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create GCM: %w", err)
 	}
-	return &mockVaultKMSService{aead: aead}, nil
+	return &mockVaultKMSService{aead: aead, ready: ready, latency: latency}, nil
+}
+
+func (m *mockVaultKMSService) callBackend(ctx context.Context) error {
+	if m.latency == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(m.latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (m *mockVaultKMSService) Status(_ context.Context) (*service.StatusResponse, error) {
+func (m *mockVaultKMSService) Status(ctx context.Context) (*service.StatusResponse, error) {
+	// vault-kube-kms checks Vault on every Status call.
+	if err := m.callBackend(ctx); err != nil {
+		return nil, err
+	}
+	healthz := "ok"
+	if !m.ready() {
+		// Anything other than "ok" marks the plugin unhealthy in the apiserver.
+		healthz = "shutting down"
+	}
 	return &service.StatusResponse{
 		Version: "v2",
-		Healthz: "ok",
+		Healthz: healthz,
 		KeyID:   mockKeyID,
 	}, nil
 }
 
-func (m *mockVaultKMSService) Encrypt(_ context.Context, _ string, data []byte) (*service.EncryptResponse, error) {
+func (m *mockVaultKMSService) Encrypt(ctx context.Context, _ string, data []byte) (*service.EncryptResponse, error) {
+	if err := m.callBackend(ctx); err != nil {
+		return nil, err
+	}
 	nonce := make([]byte, m.aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %w", err)
@@ -66,7 +109,10 @@ func (m *mockVaultKMSService) Encrypt(_ context.Context, _ string, data []byte)
 	}, nil
 }
 
-func (m *mockVaultKMSService) Decrypt(_ context.Context, _ string, req *service.DecryptRequest) ([]byte, error) {
+func (m *mockVaultKMSService) Decrypt(ctx context.Context, _ string, req *service.DecryptRequest) ([]byte, error) {
+	if err := m.callBackend(ctx); err != nil {
+		return nil, err
+	}
 	if len(req.Ciphertext) < m.aead.NonceSize() {
 		return nil, fmt.Errorf("ciphertext too short")
 	}
@@ -80,28 +126,40 @@ func (m *mockVaultKMSService) Decrypt(_ context.Context, _ string, req *service.
 }
 
 var (
-	listenAddr = flag.String("listen-address", "unix:///var/run/kmsplugin/kms.sock", "gRPC listen address")
-	timeout    = flag.Duration("timeout", 5*time.Second, "gRPC timeout")
+	listenAddr    = flag.String("listen-address", "unix:///var/run/kmsplugin/kms.sock", "gRPC listen address")
+	timeout       = flag.Duration("timeout", 5*time.Second, "gRPC timeout")
+	metricsPort   = flag.String("metrics-port", "", "Port for /healthz, /readyz and /metrics (default: disabled)")
+	shutdownDelay = flag.Duration("shutdown-delay", 5*time.Second, "How long to report unhealthy before refusing new RPCs on SIGTERM")
+	shutdownGrace = flag.Duration("shutdown-grace-period", 15*time.Second, "How long in-flight RPCs may run after new ones are refused")
+	auditLogPath  = flag.String("audit-log", "", "Append a JSON audit record per RPC to this file (- for stdout)")
+
+	lanes          = flag.String("lanes", "Status=4,Encrypt=8,Decrypt=32", "Per-method concurrency limits, highest priority first; Status does not use the shared pool")
+	maxConcurrent  = flag.Int("max-concurrent-rpcs", 32, "Slots shared by the Encrypt and Decrypt lanes")
+	maxQueued      = flag.Int("max-queued-rpcs", 1000, "RPCs that may wait in each lane before new ones fail with ResourceExhausted")
+	priorityLanes  = flag.Bool("priority-lanes", true, "Use --lanes; false queues every RPC, Status included, in one FIFO lane")
+	backendLatency = flag.Duration("backend-latency", 0, "Simulated Vault round trip added to every RPC")
+	vaultBackend   = flag.Bool("vault-backend", false, "Encrypt with the Vault transit key named by the vault flags instead of the static key")
 )
 
 func main() {
 	// All flags below match the HashiCorp vault-kube-kms binary exactly.
 	// The plugin lifecycle controller passes these from the APIServer CRD;
-	// this mock accepts them but ignores their values.
-	_ = flag.String("vault-address", "", "(ignored) Vault server address")
-	_ = flag.String("vault-namespace", "", "(ignored) Vault namespace")
-	_ = flag.String("vault-connection-timeout", "10s", "(ignored) Vault connection timeout")
-	_ = flag.String("transit-mount", "transit", "(ignored) Vault transit mount path")
-	_ = flag.String("transit-key", "kms-key", "(ignored) Vault transit key name")
-	_ = flag.String("auth-method", "approle", "(ignored) Vault auth method")
-	_ = flag.String("auth-mount", "approle", "(ignored) Vault auth mount path")
-	_ = flag.String("approle-role-id", "", "(ignored) Vault AppRole role ID")
-	_ = flag.String("approle-secret-id-path", "", "(ignored) Path to Vault AppRole secret ID file")
-	_ = flag.String("tls-ca-file", "", "(ignored) Path to Vault CA certificate")
-	_ = flag.String("tls-sni", "", "(ignored) Vault TLS server name indicator")
-	_ = flag.Bool("tls-skip-verify", false, "(ignored) Skip TLS verification")
+	// this mock accepts them but ignores their values unless
+	// --vault-backend is set.
+	var vc vaultConfig
+	flag.StringVar(&vc.address, "vault-address", "", "Vault server address (used with --vault-backend)")
+	flag.StringVar(&vc.namespace, "vault-namespace", "", "Vault namespace (used with --vault-backend)")
+	flag.DurationVar(&vc.timeout, "vault-connection-timeout", 10*time.Second, "Vault connection timeout (used with --vault-backend)")
+	flag.StringVar(&vc.transitMount, "transit-mount", "transit", "Vault transit mount path (used with --vault-backend)")
+	flag.StringVar(&vc.transitKey, "transit-key", "kms-key", "Vault transit key name (used with --vault-backend)")
+	flag.StringVar(&vc.authMethod, "auth-method", "approle", "Vault auth method (used with --vault-backend)")
+	flag.StringVar(&vc.authMount, "auth-mount", "approle", "Vault auth mount path (used with --vault-backend)")
+	flag.StringVar(&vc.roleID, "approle-role-id", "", "Vault AppRole role ID (used with --vault-backend)")
+	flag.StringVar(&vc.secretIDPath, "approle-secret-id-path", "", "Path to Vault AppRole secret ID file (used with --vault-backend)")
+	flag.StringVar(&vc.caFile, "tls-ca-file", "", "Path to Vault CA certificate (used with --vault-backend)")
+	flag.StringVar(&vc.serverName, "tls-sni", "", "Vault TLS server name indicator (used with --vault-backend)")
+	flag.BoolVar(&vc.skipTLSVerify, "tls-skip-verify", false, "Skip TLS verification (used with --vault-backend)")
 	_ = flag.String("log-level", "info", "(ignored) Log level")
-	_ = flag.String("metrics-port", "8080", "(ignored) Metrics/health port")
 	_ = flag.Bool("disable-runtime-metrics", false, "(ignored) Disable Go runtime metrics")
 	flag.Parse()
 
@@ -111,29 +169,65 @@ func main() {
 		os.Exit(1)
 	}
 
-	mockService, err := newMockVaultKMSService()
+	audit, err := openAuditLog(*auditLogPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	laneCfg, err := parseLaneConfig(*lanes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --lanes: %v\n", err)
+		os.Exit(1)
+	}
+	m := newMetrics()
+	sched := newScheduler(laneCfg, *maxConcurrent, *maxQueued, *priorityLanes, m)
+
+	var server *pluginServer
+	ready := func() bool { return server.Ready() }
+	var kms service.Service
+	keyID := mockKeyID
+	if *vaultBackend {
+		kms, err = newVaultTransitService(vc, ready)
+		keyID = vc.transitKey + " (Vault transit at " + vc.address + ")"
+	} else {
+		kms, err = newMockVaultKMSService(ready, *backendLatency)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to create mock KMS service: %v\n", err)
 		os.Exit(1)
 	}
 
 	ctx := withShutdownSignal(context.Background())
-	grpcService := service.NewGRPCService(addr, *timeout, mockService)
+	server = newPluginServer(addr, *timeout, kms, m, audit, sched)
+	errCh, err := server.serve(*metricsPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start: %v\n", err)
+		os.Exit(1)
+	}
 
 	fmt.Printf("mock-vault-kms: KMS v2 plugin listening on %s\n", addr)
-	fmt.Printf("mock-vault-kms: key ID = %s\n", mockKeyID)
+	fmt.Printf("mock-vault-kms: key ID = %s\n", keyID)
+	fmt.Printf("mock-vault-kms: lanes: %s\n", sched.describe())
+	if *backendLatency > 0 {
+		fmt.Printf("mock-vault-kms: simulating %s backend latency\n", *backendLatency)
+	}
+	if *metricsPort != "" {
+		fmt.Printf("mock-vault-kms: /healthz, /readyz and /metrics on :%s\n", *metricsPort)
+	}
 	fmt.Println("mock-vault-kms: using k8s.io/kms/pkg/service framework (Kubernetes mock reference)")
-	fmt.Println("mock-vault-kms: all vault flags accepted and ignored (mock mode)")
-
-	go func() {
-		if err := grpcService.ListenAndServe(); err != nil {
-			fmt.Fprintf(os.Stderr, "gRPC server error: %v\n", err)
-			os.Exit(1)
-		}
-	}()
+	if !*vaultBackend {
+		fmt.Println("mock-vault-kms: all vault flags accepted and ignored (mock mode)")
+	}
 
-	<-ctx.Done()
-	grpcService.Shutdown()
+	select {
+	case <-ctx.Done():
+		server.shutdown(*shutdownDelay, *shutdownGrace)
+	case err := <-errCh:
+		fmt.Fprintf(os.Stderr, "server error: %v\n", err)
+		server.shutdown(0, 0)
+		os.Exit(1)
+	}
 }
 
 // withShutdownSignal returns a context that is cancelled on SIGTERM/SIGINT.
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the request latency histogram bounds in seconds.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	counts []uint64 // per bucket, cumulative on output
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	for i, b := range durationBuckets {
+		if s <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// histogramFor returns the histogram for key in hs, creating it.
+func histogramFor(hs map[string]*histogram, key string) *histogram {
+	h := hs[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		hs[key] = h
+	}
+	return h
+}
+
+// metrics is a small Prometheus text-format registry. The mock has no
+// other dependencies worth pulling client_golang in for.
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[[2]string]uint64 // {method, code}
+	inflight  map[string]int64
+	durations map[string]*histogram
+	ready     bool
+	cancelled uint64
+
+	// Per scheduler lane.
+	queued    map[string]int
+	active    map[string]int
+	queueWait map[string]*histogram
+	rejected  map[[2]string]uint64 // {lane, reason}
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  map[[2]string]uint64{},
+		inflight:  map[string]int64{},
+		durations: map[string]*histogram{},
+		queued:    map[string]int{},
+		active:    map[string]int{},
+		queueWait: map[string]*histogram{},
+		rejected:  map[[2]string]uint64{},
+	}
+}
+
+func (m *metrics) begin(method string) {
+	m.mu.Lock()
+	m.inflight[method]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) end(method, code string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight[method]--
+	m.requests[[2]string{method, code}]++
+	histogramFor(m.durations, method).observe(d)
+}
+
+func (m *metrics) setReady(ready bool) {
+	m.mu.Lock()
+	m.ready = ready
+	m.mu.Unlock()
+}
+
+// inflightTotal is the number of RPCs currently being served.
+func (m *metrics) inflightTotal() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for _, v := range m.inflight {
+		n += v
+	}
+	return n
+}
+
+func (m *metrics) addCancelled(n int64) {
+	m.mu.Lock()
+	m.cancelled += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *metrics) setLane(lane string, queued, active int) {
+	m.mu.Lock()
+	m.queued[lane] = queued
+	m.active[lane] = active
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeQueueWait(lane string, d time.Duration) {
+	m.mu.Lock()
+	histogramFor(m.queueWait, lane).observe(d)
+	m.mu.Unlock()
+}
+
+func (m *metrics) addRejected(lane, reason string) {
+	m.mu.Lock()
+	m.rejected[[2]string{lane, reason}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_ready Whether the plugin is accepting traffic (0 while shutting down).")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_ready gauge")
+	ready := 0
+	if m.ready {
+		ready = 1
+	}
+	fmt.Fprintf(w, "mock_vault_kms_ready %d\n", ready)
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_requests_total KMS RPCs served, by method and gRPC code.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_requests_total counter")
+	for _, k := range sortedPairs(m.requests) {
+		fmt.Fprintf(w, "mock_vault_kms_requests_total{method=%q,code=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_inflight_requests KMS RPCs currently being served.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_inflight_requests gauge")
+	for _, method := range sortedKeys(m.inflight) {
+		fmt.Fprintf(w, "mock_vault_kms_inflight_requests{method=%q} %d\n", method, m.inflight[method])
+	}
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_request_duration_seconds KMS RPC latency.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_request_duration_seconds histogram")
+	writeHistograms(w, "mock_vault_kms_request_duration_seconds", "method", m.durations)
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_queue_depth RPCs waiting for a slot, by scheduler lane.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_queue_depth gauge")
+	for _, lane := range sortedKeys(m.queued) {
+		fmt.Fprintf(w, "mock_vault_kms_queue_depth{lane=%q} %d\n", lane, m.queued[lane])
+	}
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_lane_active_requests RPCs holding a slot, by scheduler lane.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_lane_active_requests gauge")
+	for _, lane := range sortedKeys(m.active) {
+		fmt.Fprintf(w, "mock_vault_kms_lane_active_requests{lane=%q} %d\n", lane, m.active[lane])
+	}
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_queue_wait_seconds Time RPCs spent queued before getting a slot.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_queue_wait_seconds histogram")
+	writeHistograms(w, "mock_vault_kms_queue_wait_seconds", "lane", m.queueWait)
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_queue_rejected_total RPCs that never got a slot: queue_full or cancelled while queued.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_queue_rejected_total counter")
+	for _, k := range sortedPairs(m.rejected) {
+		fmt.Fprintf(w, "mock_vault_kms_queue_rejected_total{lane=%q,reason=%q} %d\n", k[0], k[1], m.rejected[k])
+	}
+
+	fmt.Fprintln(w, "# HELP mock_vault_kms_shutdown_cancelled_requests_total RPCs cut off because the shutdown grace period ran out.")
+	fmt.Fprintln(w, "# TYPE mock_vault_kms_shutdown_cancelled_requests_total counter")
+	fmt.Fprintf(w, "mock_vault_kms_shutdown_cancelled_requests_total %d\n", m.cancelled)
+}
+
+func writeHistograms(w io.Writer, name, label string, hs map[string]*histogram) {
+	for _, key := range sortedKeys(hs) {
+		h := hs[key]
+		var cum uint64
+		for i, b := range durationBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", name, label, key, b, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, key, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, key, h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, key, h.count)
+	}
+}
+
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
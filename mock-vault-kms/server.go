@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	kmsapi "k8s.io/kms/apis/v2"
+	"k8s.io/kms/pkg/service"
+)
+
+// pluginServer runs the KMS gRPC service on a socket it owns, so that on
+// shutdown the socket is removed only after in-flight calls have drained
+// and the audit log and metrics have been flushed. service.GRPCService's
+// own ListenAndServe removes the socket as soon as the server stops.
+type pluginServer struct {
+	socket  string
+	grpc    *grpc.Server
+	http    *http.Server
+	ready   atomic.Bool
+	metrics *metrics
+	audit   *auditLog
+	lanes   *scheduler
+
+	// handlers counts running interceptors. grpc.Server.Stop returns once
+	// connections are closed, before the interceptors that write the audit
+	// records and metrics have.
+	handlers sync.WaitGroup
+}
+
+// handlerWait bounds how long shutdown waits, after the gRPC server has
+// stopped, for cancelled RPCs to record themselves.
+var handlerWait = 5 * time.Second
+
+func newPluginServer(socket string, timeout time.Duration, kms service.Service, m *metrics, audit *auditLog, lanes *scheduler) *pluginServer {
+	s := &pluginServer{socket: socket, metrics: m, audit: audit, lanes: lanes}
+	s.grpc = grpc.NewServer(
+		grpc.ConnectionTimeout(timeout),
+		grpc.UnaryInterceptor(s.intercept),
+	)
+	// GRPCService only adapts the kms/apis/v2 messages to service.Service;
+	// registering it on our server keeps that conversion.
+	kmsapi.RegisterKeyManagementServiceServer(s.grpc, service.NewGRPCService(socket, timeout, kms))
+	return s
+}
+
+// intercept queues every RPC in its scheduler lane, tracks in-flight
+// calls and writes the audit record and metrics.
+func (s *pluginServer) intercept(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+	method := path.Base(info.FullMethod)
+	start := time.Now()
+	s.metrics.begin(method)
+	// The request uid, which the apiserver logs at -v=6, identifies the
+	// operation in every log. Status has none, so it gets one here.
+	var uid string
+	if r, ok := req.(interface{ GetUid() string }); ok {
+		uid = r.GetUid()
+	}
+	correlation := uid
+	if correlation == "" {
+		correlation = newCorrelationID(method)
+	}
+	ctx = context.WithValue(ctx, correlationKey{}, correlation)
+	var resp any
+	release, wait, err := s.lanes.acquire(ctx, method)
+	if err == nil {
+		resp, err = handler(ctx, req)
+		release()
+	}
+	d := time.Since(start)
+	code := status.Code(err).String()
+	s.metrics.end(method, code, d)
+
+	rec := auditRecord{
+		Time:          start.UTC(),
+		Method:        method,
+		UID:           uid,
+		CorrelationID: correlation,
+		Code:          code,
+		DurationMS:    milliseconds(d),
+		QueueMS:       milliseconds(wait),
+	}
+	// Encrypt and Status return the key ID; Decrypt is asked for one.
+	if r, ok := resp.(interface{ GetKeyId() string }); ok {
+		rec.KeyID = r.GetKeyId()
+	}
+	if r, ok := req.(interface{ GetKeyId() string }); ok && rec.KeyID == "" {
+		rec.KeyID = r.GetKeyId()
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	s.audit.record(rec)
+	return resp, err
+}
+
+type correlationKey struct{}
+
+// correlationID is the ID intercept assigned to the RPC in ctx, falling
+// back to uid.
+func correlationID(ctx context.Context, uid string) string {
+	if id, ok := ctx.Value(correlationKey{}).(string); ok {
+		return id
+	}
+	return uid
+}
+
+func newCorrelationID(method string) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return strings.ToLower(method) + "-" + hex.EncodeToString(b)
+}
+
+// Ready reports whether the plugin should receive traffic. Status returns
+// an unhealthy response once it is false.
+func (s *pluginServer) Ready() bool { return s.ready.Load() }
+
+func (s *pluginServer) setReady(ready bool) {
+	s.ready.Store(ready)
+	s.metrics.setReady(ready)
+}
+
+// serve listens on the socket and, if port is set, serves /healthz,
+// /readyz and /metrics. It returns once both are listening.
+func (s *pluginServer) serve(port string) (<-chan error, error) {
+	// A socket left behind by a killed process would make Listen fail.
+	if err := os.Remove(s.socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	ln, err := net.Listen("unix", s.socket)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.grpc.Serve(ln) }()
+
+	if port != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+			if !s.Ready() {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			s.metrics.writeTo(w)
+		})
+		hl, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			s.grpc.Stop()
+			return nil, fmt.Errorf("failed to listen on metrics port %s: %w", port, err)
+		}
+		s.http = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := s.http.Serve(hl); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+	s.setReady(true)
+	return errCh, nil
+}
+
+// shutdown drains the plugin in order:
+//
+//  1. report unhealthy through Status and /readyz, then wait delay so the
+//     apiserver and kubelet see it while everything still works
+//  2. stop accepting RPCs and wait up to grace for in-flight ones
+//  3. cut off whatever is still running, and wait up to handlerWait for
+//     the cancelled RPCs to write their audit records and metrics
+//  4. flush the audit log and print the final metrics
+//  5. remove the socket
+func (s *pluginServer) shutdown(delay, grace time.Duration) {
+	s.setReady(false)
+	fmt.Printf("mock-vault-kms: reporting unhealthy, %d RPC(s) in flight; draining in %s\n", s.metrics.inflightTotal(), delay)
+	time.Sleep(delay)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		fmt.Println("mock-vault-kms: all in-flight RPCs completed")
+	case <-time.After(grace):
+		n := s.metrics.inflightTotal()
+		s.metrics.addCancelled(n)
+		fmt.Printf("mock-vault-kms: grace period %s expired, cancelling %d RPC(s)\n", grace, n)
+		// Stop cancels the RPCs by closing their connections, but is not
+		// waited for: while GracefulStop waits for handlers, Stop does too.
+		go s.grpc.Stop()
+	}
+	handlersDone := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-time.After(handlerWait):
+		fmt.Fprintf(os.Stderr, "mock-vault-kms: %d RPC handler(s) still running after %s; their audit records are lost\n",
+			s.metrics.inflightTotal(), handlerWait)
+	}
+
+	if err := s.audit.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "mock-vault-kms: failed to flush audit log: %v\n", err)
+	}
+	fmt.Println("mock-vault-kms: final metrics:")
+	s.metrics.writeTo(os.Stdout)
+	if s.http != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_ = s.http.Shutdown(ctx)
+		cancel()
+	}
+
+	if err := os.Remove(s.socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "mock-vault-kms: failed to remove socket: %v\n", err)
+	}
+	fmt.Println("mock-vault-kms: shutdown complete")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	kmsapi "k8s.io/kms/apis/v2"
+	"k8s.io/kms/pkg/service"
+)
+
+// slowService blocks Encrypt until the RPC is cancelled and then takes
+// unwind longer to return, like a backend call unwinding. With hang set it
+// never returns, like a backend ignoring cancellation.
+type slowService struct {
+	entered chan struct{}
+	unwind  time.Duration
+	hang    bool
+}
+
+func (s *slowService) Status(context.Context) (*service.StatusResponse, error) {
+	return &service.StatusResponse{Version: "v2", Healthz: "ok", KeyID: "test"}, nil
+}
+
+func (s *slowService) Encrypt(ctx context.Context, _ string, _ []byte) (*service.EncryptResponse, error) {
+	close(s.entered)
+	if s.hang {
+		select {}
+	}
+	<-ctx.Done()
+	time.Sleep(s.unwind)
+	return nil, ctx.Err()
+}
+
+func (s *slowService) Decrypt(context.Context, string, *service.DecryptRequest) ([]byte, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestShutdownDrainOrder(t *testing.T) {
+	defer func(d time.Duration) { handlerWait = d }(handlerWait)
+	handlerWait = time.Second
+
+	tests := []struct {
+		name       string
+		kms        *slowService
+		wantRecord bool
+	}{
+		{
+			name:       "cancelled RPC is recorded before the audit log closes",
+			kms:        &slowService{unwind: 300 * time.Millisecond},
+			wantRecord: true,
+		},
+		{
+			name: "a handler that never returns does not block shutdown",
+			kms:  &slowService{hang: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			socket := filepath.Join(dir, "kms.sock")
+			auditPath := filepath.Join(dir, "audit.log")
+			audit, err := openAuditLog(auditPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := parseLaneConfig("Status=1,Encrypt=1,Decrypt=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := newMetrics()
+			tt.kms.entered = make(chan struct{})
+			s := newPluginServer(socket, 5*time.Second, tt.kms, m, audit, newScheduler(cfg, 2, 10, true, m))
+			if _, err := s.serve(""); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := grpc.NewClient("unix:"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			done := make(chan error, 1)
+			go func() {
+				_, err := kmsapi.NewKeyManagementServiceClient(conn).Encrypt(context.Background(),
+					&kmsapi.EncryptRequest{Plaintext: []byte("secret"), Uid: "drain-test"})
+				done <- err
+			}()
+			select {
+			case <-tt.kms.entered:
+			case err := <-done:
+				t.Fatalf("Encrypt returned before reaching the service: %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Encrypt never reached the service")
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				s.shutdown(0, 100*time.Millisecond)
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(handlerWait + 5*time.Second):
+				t.Fatal("shutdown did not return")
+			}
+
+			data, err := os.ReadFile(auditPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rec auditRecord
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if err := json.Unmarshal([]byte(line), &rec); err == nil && rec.UID == "drain-test" {
+					break
+				}
+				rec = auditRecord{}
+			}
+			switch {
+			case tt.wantRecord && rec.UID == "":
+				t.Fatalf("audit log has no record of the cancelled Encrypt:\n%s", data)
+			case tt.wantRecord && rec.Code == "OK":
+				t.Errorf("cancelled Encrypt recorded with code %s", rec.Code)
+			case !tt.wantRecord && rec.UID != "":
+				t.Errorf("hung Encrypt recorded: %+v", rec)
+			}
+			if _, err := os.Stat(socket); !os.IsNotExist(err) {
+				t.Errorf("socket not removed: %v", err)
+			}
+		})
+	}
+}
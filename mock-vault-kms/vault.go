@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/kms/pkg/service"
+)
+
+// correlationHeader carries the KMS request uid to Vault. Vault only writes
+// it to its audit log once it is allowed with
+//
+//	vault write sys/config/auditing/request-headers/x-kms-correlation-id hmac=false
+//
+// and then records it under request.headers["x-kms-correlation-id"].
+const correlationHeader = "X-KMS-Correlation-ID"
+
+// vaultConfig is the subset of the vault-kube-kms flags the Vault backend
+// uses.
+type vaultConfig struct {
+	address       string
+	namespace     string
+	timeout       time.Duration
+	transitMount  string
+	transitKey    string
+	authMethod    string
+	authMount     string
+	roleID        string
+	secretIDPath  string
+	caFile        string
+	serverName    string
+	skipTLSVerify bool
+}
+
+// vaultTransitService implements service.Service against a real Vault
+// transit key, like vault-kube-kms. It exists so that the correlation of
+// plugin and Vault audit records can be tested without the real plugin.
+type vaultTransitService struct {
+	cfg   vaultConfig
+	http  *http.Client
+	ready func() bool
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newVaultTransitService(cfg vaultConfig, ready func() bool) (*vaultTransitService, error) {
+	if cfg.address == "" {
+		return nil, fmt.Errorf("--vault-address is required with --vault-backend")
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.serverName, InsecureSkipVerify: cfg.skipTLSVerify}
+	if cfg.caFile != "" {
+		pem, err := os.ReadFile(cfg.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --tls-ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	switch cfg.authMethod {
+	case "approle":
+		if cfg.roleID == "" || cfg.secretIDPath == "" {
+			return nil, fmt.Errorf("--approle-role-id and --approle-secret-id-path are required for approle auth")
+		}
+	case "token":
+		// For local testing only; the real plugin has no token auth.
+		if os.Getenv("VAULT_TOKEN") == "" {
+			return nil, fmt.Errorf("VAULT_TOKEN must be set for token auth")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported --auth-method %q (approle or token)", cfg.authMethod)
+	}
+	return &vaultTransitService{
+		cfg:   cfg,
+		ready: ready,
+		http: &http.Client{
+			Timeout:   cfg.timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+func (v *vaultTransitService) Status(ctx context.Context) (*service.StatusResponse, error) {
+	// Like vault-kube-kms, prove the key works with a round trip.
+	resp, err := v.Encrypt(ctx, "", []byte("status"))
+	if err != nil {
+		return nil, err
+	}
+	healthz := "ok"
+	if !v.ready() {
+		healthz = "shutting down"
+	}
+	return &service.StatusResponse{Version: "v2", Healthz: healthz, KeyID: resp.KeyID}, nil
+}
+
+func (v *vaultTransitService) Encrypt(ctx context.Context, uid string, data []byte) (*service.EncryptResponse, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(data)}
+	if err := v.transit(ctx, uid, "encrypt", body, &out); err != nil {
+		return nil, err
+	}
+	return &service.EncryptResponse{Ciphertext: []byte(out.Ciphertext), KeyID: v.keyID(out.Ciphertext)}, nil
+}
+
+func (v *vaultTransitService) Decrypt(ctx context.Context, uid string, req *service.DecryptRequest) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	body := map[string]string{"ciphertext": string(req.Ciphertext)}
+	if err := v.transit(ctx, uid, "decrypt", body, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// keyID is the transit key name and the version from a vault:v<N>:...
+// ciphertext, so that the apiserver sees a new key ID after a rotation.
+func (v *vaultTransitService) keyID(ciphertext string) string {
+	parts := strings.SplitN(ciphertext, ":", 3)
+	if len(parts) == 3 {
+		return v.cfg.transitKey + ":" + parts[1]
+	}
+	return v.cfg.transitKey
+}
+
+func (v *vaultTransitService) transit(ctx context.Context, uid, op string, body, into any) error {
+	token, err := v.login(ctx)
+	if err != nil {
+		return err
+	}
+	path := strings.Trim(v.cfg.transitMount, "/") + "/" + op + "/" + v.cfg.transitKey
+	err = v.do(ctx, token, correlationID(ctx, uid), path, body, into)
+	if ve, ok := err.(*vaultError); ok && ve.status == http.StatusForbidden && v.cfg.authMethod == "approle" {
+		// The token may have been revoked before it expired.
+		v.mu.Lock()
+		v.token = ""
+		v.mu.Unlock()
+		if token, err = v.login(ctx); err != nil {
+			return err
+		}
+		err = v.do(ctx, token, correlationID(ctx, uid), path, body, into)
+	}
+	return err
+}
+
+// login returns a token, logging in again with AppRole shortly before the
+// current one expires.
+func (v *vaultTransitService) login(ctx context.Context) (string, error) {
+	if v.cfg.authMethod == "token" {
+		return os.Getenv("VAULT_TOKEN"), nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != "" && time.Until(v.tokenExpiry) > 30*time.Second {
+		return v.token, nil
+	}
+	secretID, err := os.ReadFile(v.cfg.secretIDPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read AppRole secret ID: %w", err)
+	}
+	var auth struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	path := "auth/" + strings.Trim(v.cfg.authMount, "/") + "/login"
+	body := map[string]string{"role_id": v.cfg.roleID, "secret_id": strings.TrimSpace(string(secretID))}
+	if err := v.do(ctx, "", correlationID(ctx, ""), path, body, &auth); err != nil {
+		return "", fmt.Errorf("AppRole login failed: %w", err)
+	}
+	v.token = auth.Auth.ClientToken
+	v.tokenExpiry = time.Now().Add(time.Duration(auth.Auth.LeaseDuration) * time.Second)
+	return v.token, nil
+}
+
+type vaultError struct {
+	path   string
+	status int
+	errors []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("vault %s: HTTP %d: %s", e.path, e.status, strings.Join(e.errors, "; "))
+}
+
+// do posts body to path. into receives the "data" object, or the whole
+// response for auth paths.
+func (v *vaultTransitService) do(ctx context.Context, token, correlation, path string, body, into any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimRight(v.cfg.address, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.namespace)
+	}
+	if correlation != "" {
+		req.Header.Set(correlationHeader, correlation)
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errBody struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(raw, &errBody)
+		return &vaultError{path: path, status: resp.StatusCode, errors: errBody.Errors}
+	}
+	if strings.HasPrefix(path, "auth/") {
+		return json.Unmarshal(raw, into)
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return fmt.Errorf("vault %s: invalid response: %w", path, err)
+	}
+	return json.Unmarshal(envelope.Data, into)
+}
@@ -0,0 +1,3 @@
+module github.com/gangwgr/report
+
+go 1.25.0
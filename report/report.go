@@ -0,0 +1,90 @@
+// Package report prints results in the same format as the shell scripts'
+// log_info, log_pass, ... helpers and counts them for a final summary.
+// The Go tools in this repository share it so that their output matches.
+package report
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	Red    = "\033[0;31m"
+	Green  = "\033[0;32m"
+	Yellow = "\033[1;33m"
+	Blue   = "\033[0;34m"
+	Cyan   = "\033[0;36m"
+	Bold   = "\033[1m"
+	Reset  = "\033[0m"
+)
+
+// Level is the severity of a result line.
+type Level int
+
+const (
+	LevelInfo Level = iota
+	LevelPass
+	LevelFail
+	LevelSkip
+	LevelWarn
+)
+
+// Reporter prints result lines and counts passes, failures and skips. It
+// is safe for concurrent use.
+type Reporter struct {
+	Pass, Fail, Skip int
+
+	mu sync.Mutex
+}
+
+// Log prints one line at level and counts it.
+func (r *Reporter) Log(level Level, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch level {
+	case LevelPass:
+		r.Pass++
+		fmt.Printf("%s[PASS]%s  %s\n", Green, Reset, msg)
+	case LevelFail:
+		r.Fail++
+		fmt.Printf("%s[FAIL]%s  %s\n", Red, Reset, msg)
+	case LevelSkip:
+		r.Skip++
+		fmt.Printf("%s[SKIP]%s  %s\n", Yellow, Reset, msg)
+	case LevelWarn:
+		fmt.Printf("%s[WARN]%s  %s\n", Yellow, Reset, msg)
+	default:
+		fmt.Printf("%s[INFO]%s  %s\n", Blue, Reset, msg)
+	}
+}
+
+func (r *Reporter) Info(format string, args ...any)  { r.Log(LevelInfo, format, args...) }
+func (r *Reporter) Warn(format string, args ...any)  { r.Log(LevelWarn, format, args...) }
+func (r *Reporter) Passf(format string, args ...any) { r.Log(LevelPass, format, args...) }
+func (r *Reporter) Failf(format string, args ...any) { r.Log(LevelFail, format, args...) }
+func (r *Reporter) Skipf(format string, args ...any) { r.Log(LevelSkip, format, args...) }
+
+// Step prints a heading for one step within a section.
+func (r *Reporter) Step(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Printf("\n%s%s▶ %s%s\n", Cyan, Bold, fmt.Sprintf(format, args...), Reset)
+}
+
+func (r *Reporter) Section(title string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	line := strings.Repeat("═", 60)
+	fmt.Printf("\n%s%s\n  %s\n%s%s\n", Bold, line, title, line, Reset)
+}
+
+func (r *Reporter) Summary() {
+	r.Section("Summary")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Printf("  %sPASSED:  %d%s\n", Green, r.Pass, Reset)
+	fmt.Printf("  %sFAILED:  %d%s\n", Red, r.Fail, Reset)
+	fmt.Printf("  %sSKIPPED: %d%s\n", Yellow, r.Skip, Reset)
+}
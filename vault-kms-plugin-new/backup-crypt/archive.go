@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// An archive is
+//
+//	"KMSBAK01"                 magic
+//	uint32, big endian         header length
+//	header                     JSON, see header
+//	chunks                     AES-256-GCM, chunkSize bytes of plaintext
+//	                           each (the last may be shorter) plus a tag
+//
+// Chunk i is sealed with nonce noncePrefix || uint64(i) and, as additional
+// data, the SHA-256 of the header bytes, i and whether it is the last
+// chunk. A changed header, reordered or dropped chunks and a truncated
+// file all fail authentication.
+const (
+	archiveMagic     = "KMSBAK01"
+	archiveSuffix    = ".kmsenc"
+	archiveVersion   = 1
+	archiveCipher    = "AES-256-GCM"
+	defaultChunkSize = 1 << 20
+	maxChunkSize     = 64 << 20
+	maxHeaderSize    = 1 << 20
+	noncePrefixSize  = 4
+)
+
+// header is stored unencrypted at the start of the archive. It holds the
+// archive key only as wrapped by the KMS.
+type header struct {
+	Version         int        `json:"version"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	OriginalName    string     `json:"originalName"`
+	PlaintextSize   int64      `json:"plaintextSize"`
+	PlaintextSHA256 string     `json:"plaintextSHA256"`
+	Cipher          string     `json:"cipher"`
+	ChunkSize       int        `json:"chunkSize"`
+	NoncePrefix     []byte     `json:"noncePrefix"`
+	Key             wrappedKey `json:"key"`
+}
+
+func (h *header) chunks() int64 {
+	if h.PlaintextSize == 0 {
+		return 1 // an empty file is one empty chunk, so it is authenticated too
+	}
+	return (h.PlaintextSize + int64(h.ChunkSize) - 1) / int64(h.ChunkSize)
+}
+
+func (h *header) chunkLen(i int64) int {
+	if rest := h.PlaintextSize - i*int64(h.ChunkSize); rest < int64(h.ChunkSize) {
+		return int(rest)
+	}
+	return h.ChunkSize
+}
+
+func (h *header) validate() error {
+	switch {
+	case h.Version != archiveVersion:
+		return fmt.Errorf("unsupported archive version %d", h.Version)
+	case h.Cipher != archiveCipher:
+		return fmt.Errorf("unsupported cipher %q", h.Cipher)
+	case h.ChunkSize <= 0 || h.ChunkSize > maxChunkSize:
+		return fmt.Errorf("invalid chunk size %d", h.ChunkSize)
+	case len(h.NoncePrefix) != noncePrefixSize:
+		return fmt.Errorf("invalid nonce prefix")
+	case h.PlaintextSize < 0:
+		return fmt.Errorf("invalid plaintext size %d", h.PlaintextSize)
+	case len(h.Key.Ciphertext) == 0:
+		return fmt.Errorf("no wrapped archive key")
+	}
+	return nil
+}
+
+// encryptArchive encrypts in to out with a new archive key wrapped by w.
+// The file is read twice, once for its digest, and the second pass fails if
+// it changed in between. out is written to out.partial and renamed when
+// complete.
+func encryptArchive(ctx context.Context, w keyWrapper, in, out string, chunkSize int) (*header, error) {
+	size, digest, err := hashFile(in)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate archive key: %w", err)
+	}
+	defer clear(key)
+	wk, err := w.wrap(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap archive key: %w", err)
+	}
+	h := &header{
+		Version:         archiveVersion,
+		CreatedAt:       time.Now().UTC().Truncate(time.Second),
+		OriginalName:    filepath.Base(in),
+		PlaintextSize:   size,
+		PlaintextSHA256: digest,
+		Cipher:          archiveCipher,
+		ChunkSize:       chunkSize,
+		NoncePrefix:     make([]byte, noncePrefixSize),
+		Key:             wk,
+	}
+	if _, err := rand.Read(h.NoncePrefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce prefix: %w", err)
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	err = writeAtomically(out, func(dst io.Writer) error {
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(hb)))
+		for _, b := range [][]byte{[]byte(archiveMagic), prefix[:], hb} {
+			if _, err := dst.Write(b); err != nil {
+				return err
+			}
+		}
+		hh := sha256.Sum256(hb)
+		sum := sha256.New()
+		buf := make([]byte, chunkSize)
+		var sealed []byte
+		for i, n := int64(0), h.chunks(); i < n; i++ {
+			chunk := buf[:h.chunkLen(i)]
+			if _, err := io.ReadFull(src, chunk); err != nil {
+				return fmt.Errorf("%s changed while it was encrypted: %w", in, err)
+			}
+			sum.Write(chunk)
+			sealed = aead.Seal(sealed[:0], chunkNonce(h.NoncePrefix, i), chunk, chunkAAD(hh, i, i == n-1))
+			if _, err := dst.Write(sealed); err != nil {
+				return err
+			}
+		}
+		if m, _ := src.Read(buf[:1]); m > 0 || hex.EncodeToString(sum.Sum(nil)) != digest {
+			return fmt.Errorf("%s changed while it was encrypted", in)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// openArchive reads the header of the archive at path and leaves the
+// reader at the first chunk.
+func openArchive(path string) (*os.File, *bufio.Reader, *header, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	r := bufio.NewReaderSize(f, 256*1024)
+	h, hb, err := readHeader(r)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, r, h, hb, nil
+}
+
+func readHeader(r io.Reader) (*header, []byte, error) {
+	var prefix [len(archiveMagic) + 4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	if string(prefix[:len(archiveMagic)]) != archiveMagic {
+		return nil, nil, fmt.Errorf("not a backup archive (bad magic)")
+	}
+	size := binary.BigEndian.Uint32(prefix[len(archiveMagic):])
+	if size == 0 || size > maxHeaderSize {
+		return nil, nil, fmt.Errorf("invalid header length %d", size)
+	}
+	hb := make([]byte, size)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return nil, nil, fmt.Errorf("truncated header: %w", err)
+	}
+	h := &header{}
+	if err := json.Unmarshal(hb, h); err != nil {
+		return nil, nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if err := h.validate(); err != nil {
+		return nil, nil, err
+	}
+	return h, hb, nil
+}
+
+// decryptArchive unwraps the archive key of the archive at path with w and
+// writes the plaintext to dst. The digest and size in the header are
+// checked after the last chunk; dst has then received unverified data, so
+// callers write to a temporary file or discard it.
+func decryptArchive(ctx context.Context, w keyWrapper, path string, dst io.Writer) (*header, error) {
+	f, r, h, hb, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, err := w.unwrap(ctx, h.Key)
+	if err != nil {
+		return h, fmt.Errorf("failed to unwrap archive key (key ID %s): %w", h.Key.KeyID, err)
+	}
+	defer clear(key)
+	aead, err := newGCM(key)
+	if err != nil {
+		return h, fmt.Errorf("unwrapped archive key is invalid: %w", err)
+	}
+
+	hh := sha256.Sum256(hb)
+	sum := sha256.New()
+	buf := make([]byte, h.ChunkSize+aead.Overhead())
+	var plain []byte
+	for i, n := int64(0), h.chunks(); i < n; i++ {
+		sealed := buf[:h.chunkLen(i)+aead.Overhead()]
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return h, fmt.Errorf("archive is truncated at chunk %d of %d", i+1, n)
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(h.NoncePrefix, i), sealed, chunkAAD(hh, i, i == n-1))
+		if err != nil {
+			return h, fmt.Errorf("chunk %d of %d failed authentication: the archive or its header was modified", i+1, n)
+		}
+		sum.Write(plain)
+		if _, err := dst.Write(plain); err != nil {
+			return h, err
+		}
+	}
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		return h, fmt.Errorf("archive has data after the last chunk")
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != h.PlaintextSHA256 {
+		return h, fmt.Errorf("plaintext SHA-256 %s does not match the header (%s)", got, h.PlaintextSHA256)
+	}
+	return h, nil
+}
+
+func chunkNonce(prefix []byte, i int64) []byte {
+	nonce := make([]byte, noncePrefixSize+8)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[noncePrefixSize:], uint64(i))
+	return nonce
+}
+
+func chunkAAD(headerHash [32]byte, i int64, last bool) []byte {
+	aad := make([]byte, 0, len(headerHash)+9)
+	aad = append(aad, headerHash[:]...)
+	aad = binary.BigEndian.AppendUint64(aad, uint64(i))
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return n, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// writeAtomically writes path through write into path.partial (mode 0600),
+// syncs it and renames it over path. On error the partial file is removed.
+func writeAtomically(path string, write func(io.Writer) error) (err error) {
+	tmp := path + ".partial"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+	bw := bufio.NewWriterSize(f, 256*1024)
+	if err = write(bw); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeWrapper "wraps" a key by XORing it with a fixed byte.
+type fakeWrapper struct {
+	mask      byte
+	unwrapErr error
+}
+
+func (f *fakeWrapper) provider() string { return "fake" }
+func (f *fakeWrapper) describe() string { return "fake KMS" }
+
+func (f *fakeWrapper) wrap(_ context.Context, key []byte) (wrappedKey, error) {
+	ct := make([]byte, len(key))
+	for i, b := range key {
+		ct[i] = b ^ f.mask
+	}
+	return wrappedKey{Provider: "fake", KeyID: "fake-1", Ciphertext: ct, UID: "test"}, nil
+}
+
+func (f *fakeWrapper) unwrap(_ context.Context, wk wrappedKey) ([]byte, error) {
+	if f.unwrapErr != nil {
+		return nil, f.unwrapErr
+	}
+	key := make([]byte, len(wk.Ciphertext))
+	for i, b := range wk.Ciphertext {
+		key[i] = b ^ f.mask
+	}
+	return key, nil
+}
+
+const testChunkSize = 16
+
+// writeArchive encrypts plaintext with a chunk size of testChunkSize and
+// returns the archive bytes.
+func writeArchive(t *testing.T, w keyWrapper, plaintext []byte) []byte {
+	t.Helper()
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "snapshot.db"), filepath.Join(dir, "snapshot.db"+archiveSuffix)
+	if err := os.WriteFile(in, plaintext, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encryptArchive(context.Background(), w, in, out, testChunkSize); err != nil {
+		t.Fatalf("encryptArchive: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// decryptBytes decrypts archive bytes written to a temporary file.
+func decryptBytes(t *testing.T, w keyWrapper, archive []byte) ([]byte, *header, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "snapshot.db"+archiveSuffix)
+	if err := os.WriteFile(path, archive, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	h, err := decryptArchive(context.Background(), w, path, &out)
+	return out.Bytes(), h, err
+}
+
+// chunksOffset is where the first sealed chunk of archive starts.
+func chunksOffset(archive []byte) int {
+	return len(archiveMagic) + 4 + int(binary.BigEndian.Uint32(archive[len(archiveMagic):]))
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3*testChunkSize + 5} {
+		plaintext := bytes.Repeat([]byte("etcd"), size)[:size]
+		w := &fakeWrapper{mask: 0x5a}
+		archive := writeArchive(t, w, plaintext)
+
+		got, h, err := decryptBytes(t, w, archive)
+		if err != nil {
+			t.Errorf("size %d: decryptArchive: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: decrypted %q, want %q", size, got, plaintext)
+		}
+		if h.OriginalName != "snapshot.db" || h.PlaintextSize != int64(size) || h.ChunkSize != testChunkSize {
+			t.Errorf("size %d: header = %+v", size, h)
+		}
+		// Every chunk, even of an empty file, carries a tag.
+		if want := chunksOffset(archive) + int(h.chunks())*16 + size; len(archive) != want {
+			t.Errorf("size %d: archive is %d bytes, want %d", size, len(archive), want)
+		}
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "snapshot.db"), filepath.Join(dir, "snapshot.db"+archiveSuffix)
+	if err := os.WriteFile(in, []byte("snapshot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encryptArchive(context.Background(), &fakeWrapper{}, in, out, testChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("archive mode = %s, want 0600", fi.Mode().Perm())
+	}
+	if _, err := os.Stat(out + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
+
+func TestArchiveTamper(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("0123456789abcdef"), 3) // three full chunks
+	chunk := testChunkSize + 16
+
+	// rewriteHeader re-encodes the header after fn changes it.
+	rewriteHeader := func(a []byte, fn func(*header)) []byte {
+		off := chunksOffset(a)
+		h := &header{}
+		if err := json.Unmarshal(a[len(archiveMagic)+4:off], h); err != nil {
+			t.Fatal(err)
+		}
+		fn(h)
+		hb, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := append([]byte(archiveMagic), binary.BigEndian.AppendUint32(nil, uint32(len(hb)))...)
+		out = append(out, hb...)
+		return append(out, a[off:]...)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(a []byte) []byte
+		wrapper *fakeWrapper
+		wantErr string
+	}{
+		{
+			name:    "flipped ciphertext bit",
+			modify:  func(a []byte) []byte { a[chunksOffset(a)+chunk+3] ^= 1; return a },
+			wantErr: "chunk 2 of 3 failed authentication",
+		},
+		{
+			name:    "flipped tag bit",
+			modify:  func(a []byte) []byte { a[len(a)-1] ^= 1; return a },
+			wantErr: "chunk 3 of 3 failed authentication",
+		},
+		{
+			name:    "changed header field",
+			modify:  func(a []byte) []byte { return rewriteHeader(a, func(h *header) { h.OriginalName = "other.db" }) },
+			wantErr: "chunk 1 of 3 failed authentication",
+		},
+		{
+			name: "reordered chunks",
+			modify: func(a []byte) []byte {
+				off := chunksOffset(a)
+				first := append([]byte(nil), a[off:off+chunk]...)
+				copy(a[off:], a[off+chunk:off+2*chunk])
+				copy(a[off+chunk:], first)
+				return a
+			},
+			wantErr: "chunk 1 of 3 failed authentication",
+		},
+		{
+			name:    "last chunk dropped",
+			modify:  func(a []byte) []byte { return a[:len(a)-chunk] },
+			wantErr: "truncated at chunk 3 of 3",
+		},
+		{
+			name:    "truncated inside a chunk",
+			modify:  func(a []byte) []byte { return a[:len(a)-5] },
+			wantErr: "truncated at chunk 3 of 3",
+		},
+		{
+			name: "last chunk dropped and size shortened",
+			modify: func(a []byte) []byte {
+				a = rewriteHeader(a, func(h *header) { h.PlaintextSize -= testChunkSize })
+				return a[:len(a)-chunk]
+			},
+			wantErr: "chunk 1 of 2 failed authentication",
+		},
+		{
+			name:    "trailing data",
+			modify:  func(a []byte) []byte { return append(a, 0) },
+			wantErr: "data after the last chunk",
+		},
+		{
+			name:    "truncated header",
+			modify:  func(a []byte) []byte { return a[:chunksOffset(a)-1] },
+			wantErr: "truncated header",
+		},
+		{
+			name:    "bad magic",
+			modify:  func(a []byte) []byte { a[0] = 'X'; return a },
+			wantErr: "bad magic",
+		},
+		{
+			name:    "unsupported version",
+			modify:  func(a []byte) []byte { return rewriteHeader(a, func(h *header) { h.Version = 2 }) },
+			wantErr: "unsupported archive version 2",
+		},
+		{
+			name:    "wrong archive key",
+			modify:  func(a []byte) []byte { return a },
+			wrapper: &fakeWrapper{mask: 0x5b},
+			wantErr: "chunk 1 of 3 failed authentication",
+		},
+		{
+			name:    "KMS refuses to unwrap",
+			modify:  func(a []byte) []byte { return a },
+			wrapper: &fakeWrapper{unwrapErr: errors.New("permission denied")},
+			wantErr: "failed to unwrap archive key (key ID fake-1): permission denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &fakeWrapper{mask: 0x5a}
+			archive := tt.modify(writeArchive(t, w, plaintext))
+			if tt.wrapper != nil {
+				w = tt.wrapper
+			}
+			_, _, err := decryptBytes(t, w, archive)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("decryptArchive error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
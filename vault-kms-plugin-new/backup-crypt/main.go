@@ -0,0 +1,321 @@
+// backup-crypt: envelope encryption of etcd backup archives under the
+// cluster's KMS key.
+//
+// cluster-backup.sh writes the etcd snapshot and the static pod resources
+// unencrypted. Only the values the apiserver encrypts with KMS are
+// protected; every other resource, and the certificates and keys in the
+// static pod resources, are in plaintext on the node. This tool encrypts
+// each file with a new random AES-256 archive key and stores that key only
+// wrapped by the KMS, in the archive header with the key ID:
+//
+//	encrypt  FILE -> FILE.kmsenc, then decrypts it again to verify it
+//	decrypt  FILE.kmsenc -> FILE, written only once the whole file has
+//	         been authenticated and its SHA-256 matches the header
+//	verify   decrypts to nowhere and checks the same
+//	inspect  prints the header; needs no key
+//
+// The archive key is wrapped by the KMS v2 plugin the apiserver uses
+// (--kms-endpoint, the default) or by the Vault transit key directly
+// (--vault-address), so restoring a backup needs the same key as reading
+// etcd. Off the cluster, "restore-drill plugin" can serve an escrowed
+// transit key on a socket for --kms-endpoint.
+//
+// Usage:
+//
+//	backup-crypt encrypt --remove-plaintext /home/core/assets/backup/snapshot_<ts>.db /home/core/assets/backup/static_kuberesources_<ts>.tar.gz
+//	backup-crypt decrypt /home/core/assets/backup/snapshot_<ts>.db.kmsenc
+//	backup-crypt verify --vault-address https://vault:8200 --vault-token-file - snapshot_<ts>.db.kmsenc
+//	backup-crypt inspect snapshot_<ts>.db.kmsenc
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch os.Args[1] {
+	case "encrypt":
+		err = runEncrypt(ctx, os.Args[2:])
+	case "decrypt":
+		err = runDecrypt(ctx, os.Args[2:], false)
+	case "verify":
+		err = runDecrypt(ctx, os.Args[2:], true)
+	case "inspect":
+		err = runInspect(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sError:%s %v\n", report.Red, report.Reset, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s encrypt|decrypt|verify|inspect [flags] FILE...\n", os.Args[0])
+	os.Exit(2)
+}
+
+// keyFlags select the KMS that wraps the archive key.
+type keyFlags struct {
+	endpoint       *string
+	vaultAddress   *string
+	vaultTokenFile *string
+	vaultNamespace *string
+	transitMount   *string
+	transitKey     *string
+	caFile         *string
+	skipTLSVerify  *bool
+	timeout        *time.Duration
+}
+
+func addKeyFlags(fs *flag.FlagSet) keyFlags {
+	return keyFlags{
+		endpoint:       fs.String("kms-endpoint", "unix:///var/run/kmsplugin/kms.sock", "KMS v2 plugin socket"),
+		vaultAddress:   fs.String("vault-address", "", "Wrap with this Vault's transit key instead of the plugin"),
+		vaultTokenFile: fs.String("vault-token-file", "", "Read the Vault token from this file, - for stdin (default: VAULT_TOKEN)"),
+		vaultNamespace: fs.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault namespace"),
+		transitMount:   fs.String("transit-mount", "transit", "Transit secrets engine mount"),
+		transitKey:     fs.String("transit-key", "kms-key", "Transit key name"),
+		caFile:         fs.String("tls-ca-file", "", "CA bundle for Vault"),
+		skipTLSVerify:  fs.Bool("tls-skip-verify", false, "Skip Vault TLS verification"),
+		timeout:        fs.Duration("timeout", 30*time.Second, "KMS call timeout"),
+	}
+}
+
+func (f keyFlags) wrapper(ctx context.Context) (keyWrapper, func(), error) {
+	if *f.vaultAddress == "" {
+		p, err := newKMSPlugin(ctx, *f.endpoint, *f.timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p, p.close, nil
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if *f.vaultTokenFile != "" {
+		var err error
+		if token, err = readToken(*f.vaultTokenFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	v, err := newVaultTransit(*f.vaultAddress, token, *f.vaultNamespace, *f.transitMount, *f.transitKey, *f.caFile, *f.skipTLSVerify, *f.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, func() {}, nil
+}
+
+func runEncrypt(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	kf := addKeyFlags(fs)
+	removePlaintext := fs.Bool("remove-plaintext", false, "Delete each file once its archive has been verified")
+	chunkSize := fs.Int("chunk-size", defaultChunkSize, "Plaintext bytes per authenticated chunk")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no files to encrypt")
+	}
+	if *chunkSize <= 0 || *chunkSize > maxChunkSize {
+		return fmt.Errorf("--chunk-size must be between 1 and %d", maxChunkSize)
+	}
+
+	w, closeWrapper, err := kf.wrapper(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeWrapper()
+	r := &report.Reporter{}
+	r.Section("Encrypting Backup Files")
+	r.Info("Key custody: %s", w.describe())
+	for _, in := range fs.Args() {
+		out := in + archiveSuffix
+		switch {
+		case strings.HasSuffix(in, archiveSuffix):
+			r.Skipf("%s: already encrypted", in)
+			continue
+		case exists(out):
+			r.Failf("%s: %s already exists", in, out)
+			continue
+		}
+		start := time.Now()
+		h, err := encryptArchive(ctx, w, in, out, *chunkSize)
+		if err != nil {
+			r.Failf("%s: %v", in, err)
+			continue
+		}
+		// Unwrap through the KMS again before the plaintext can go: an
+		// archive nobody can decrypt is worse than no encryption.
+		if _, err := decryptArchive(ctx, w, out, io.Discard); err != nil {
+			os.Remove(out)
+			r.Failf("%s: the new archive did not verify, removed it: %v", in, err)
+			continue
+		}
+		r.Passf("%s -> %s (%s, key ID %s, %s)", in, out, humanSize(h.PlaintextSize), h.Key.KeyID, time.Since(start).Round(time.Millisecond))
+		if *removePlaintext {
+			if err := os.Remove(in); err != nil {
+				r.Failf("%s: failed to remove plaintext: %v", in, err)
+				continue
+			}
+			r.Info("Removed plaintext %s", in)
+		}
+	}
+	r.Summary()
+	if r.Fail > 0 {
+		return fmt.Errorf("%d file(s) not encrypted", r.Fail)
+	}
+	return nil
+}
+
+// runDecrypt decrypts archives to their original names, or only checks
+// them with verifyOnly. The output is written to a .partial file and only
+// renamed into place once every chunk authenticated and the SHA-256
+// matched.
+func runDecrypt(ctx context.Context, args []string, verifyOnly bool) error {
+	name := "decrypt"
+	if verifyOnly {
+		name = "verify"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	kf := addKeyFlags(fs)
+	var outPath *string
+	var removeArchive, force *bool
+	if !verifyOnly {
+		outPath = fs.String("out", "", "Output file (one archive only; default: the archive name without "+archiveSuffix+")")
+		removeArchive = fs.Bool("remove-archive", false, "Delete each archive once it has been decrypted")
+		force = fs.Bool("force", false, "Overwrite existing output files")
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no archives to %s", name)
+	}
+	if outPath != nil && *outPath != "" && fs.NArg() > 1 {
+		return fmt.Errorf("--out needs exactly one archive")
+	}
+
+	w, closeWrapper, err := kf.wrapper(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeWrapper()
+	r := &report.Reporter{}
+	if verifyOnly {
+		r.Section("Verifying Backup Archives")
+	} else {
+		r.Section("Decrypting Backup Archives")
+	}
+	r.Info("Key custody: %s", w.describe())
+	for _, in := range fs.Args() {
+		start := time.Now()
+		if verifyOnly {
+			h, err := decryptArchive(ctx, w, in, io.Discard)
+			if err != nil {
+				r.Failf("%s: %v", in, err)
+				continue
+			}
+			r.Passf("%s: %s, SHA-256 %s, key ID %s", in, humanSize(h.PlaintextSize), h.PlaintextSHA256, h.Key.KeyID)
+			continue
+		}
+
+		out := *outPath
+		if out == "" {
+			var ok bool
+			if out, ok = strings.CutSuffix(in, archiveSuffix); !ok {
+				r.Failf("%s: no %s suffix; use --out", in, archiveSuffix)
+				continue
+			}
+		}
+		if exists(out) && !*force {
+			r.Failf("%s: %s already exists (--force to overwrite)", in, out)
+			continue
+		}
+		var h *header
+		err := writeAtomically(out, func(dst io.Writer) error {
+			var err error
+			h, err = decryptArchive(ctx, w, in, dst)
+			return err
+		})
+		if err != nil {
+			r.Failf("%s: %v", in, err)
+			continue
+		}
+		if h.Key.Provider != w.provider() {
+			r.Info("%s: archive key was wrapped by %s, unwrapped through %s", in, h.Key.Provider, w.provider())
+		}
+		r.Passf("%s -> %s (%s, SHA-256 verified, key ID %s, %s)", in, out, humanSize(h.PlaintextSize), h.Key.KeyID, time.Since(start).Round(time.Millisecond))
+		if *removeArchive {
+			if err := os.Remove(in); err != nil {
+				r.Failf("%s: failed to remove archive: %v", in, err)
+			}
+		}
+	}
+	r.Summary()
+	if r.Fail > 0 {
+		return fmt.Errorf("%d archive(s) failed", r.Fail)
+	}
+	return nil
+}
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no archives to inspect")
+	}
+	for _, in := range fs.Args() {
+		f, _, h, _, err := openArchive(in)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		fmt.Printf("%s%s%s\n", report.Bold, in, report.Reset)
+		fmt.Printf("  original:    %s, %s (%d bytes)\n", h.OriginalName, humanSize(h.PlaintextSize), h.PlaintextSize)
+		fmt.Printf("  sha256:      %s\n", h.PlaintextSHA256)
+		fmt.Printf("  created:     %s\n", h.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("  cipher:      %s, %d chunk(s) of %d bytes\n", h.Cipher, h.chunks(), h.ChunkSize)
+		fmt.Printf("  wrapped by:  %s\n", h.Key.Provider)
+		fmt.Printf("  key ID:      %s\n", h.Key.KeyID)
+		if h.Key.Provider == providerVaultTransit {
+			key := h.Key.Mount + "/" + h.Key.Name
+			if h.Key.Namespace != "" {
+				key += " (namespace " + h.Key.Namespace + ")"
+			}
+			fmt.Printf("  transit key: %s\n", key)
+		}
+		fmt.Printf("  wrap uid:    %s\n", h.Key.UID)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	kmsapi "k8s.io/kms/apis/v2"
+	"k8s.io/kms/pkg/util"
+)
+
+const (
+	providerKMSPlugin    = "kms-plugin"
+	providerVaultTransit = "vault-transit"
+)
+
+// wrappedKey is the archive key as the KMS returned it, with what is needed
+// to ask the KMS to unwrap it again.
+type wrappedKey struct {
+	Provider    string            `json:"provider"`
+	KeyID       string            `json:"keyID"`
+	Ciphertext  []byte            `json:"ciphertext"`
+	Annotations map[string][]byte `json:"annotations,omitempty"`
+	// UID is the uid or correlation ID the key was wrapped with, as the
+	// plugin and Vault audit logs record it.
+	UID string `json:"uid"`
+	// Transit key the archive key was wrapped with (vault-transit only).
+	Mount     string `json:"mount,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// keyWrapper is the KMS that holds the key encryption key: the cluster's
+// KMS v2 plugin, or the Vault transit key behind it.
+type keyWrapper interface {
+	provider() string
+	describe() string
+	wrap(ctx context.Context, key []byte) (wrappedKey, error)
+	unwrap(ctx context.Context, wk wrappedKey) ([]byte, error)
+}
+
+func newUID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "backup-crypt-" + hex.EncodeToString(b)
+}
+
+// kmsPlugin wraps archive keys with the KMS v2 plugin the apiserver uses,
+// so backups are encrypted under the same key as etcd.
+type kmsPlugin struct {
+	endpoint string
+	timeout  time.Duration
+	conn     *grpc.ClientConn
+	client   kmsapi.KeyManagementServiceClient
+	keyID    string
+}
+
+func newKMSPlugin(ctx context.Context, endpoint string, timeout time.Duration) (*kmsPlugin, error) {
+	addr, err := util.ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --kms-endpoint: %w", err)
+	}
+	conn, err := grpc.NewClient("unix:"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	p := &kmsPlugin{endpoint: addr, timeout: timeout, conn: conn, client: kmsapi.NewKeyManagementServiceClient(conn)}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status, err := p.client.Status(cctx, &kmsapi.StatusRequest{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("KMS plugin at %s is not reachable: %w", addr, err)
+	}
+	if status.Healthz != "ok" {
+		conn.Close()
+		return nil, fmt.Errorf("KMS plugin at %s is not healthy: %s", addr, status.Healthz)
+	}
+	p.keyID = status.KeyId
+	return p, nil
+}
+
+func (p *kmsPlugin) provider() string { return providerKMSPlugin }
+
+func (p *kmsPlugin) describe() string {
+	return fmt.Sprintf("KMS plugin %s (current key ID %s)", p.endpoint, p.keyID)
+}
+
+func (p *kmsPlugin) wrap(ctx context.Context, key []byte) (wrappedKey, error) {
+	uid := newUID()
+	cctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	resp, err := p.client.Encrypt(cctx, &kmsapi.EncryptRequest{Plaintext: key, Uid: uid})
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	if resp.KeyId == "" {
+		return wrappedKey{}, fmt.Errorf("KMS plugin returned no key ID")
+	}
+	return wrappedKey{
+		Provider:    providerKMSPlugin,
+		KeyID:       resp.KeyId,
+		Ciphertext:  resp.Ciphertext,
+		Annotations: resp.Annotations,
+		UID:         uid,
+	}, nil
+}
+
+func (p *kmsPlugin) unwrap(ctx context.Context, wk wrappedKey) ([]byte, error) {
+	cctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	resp, err := p.client.Decrypt(cctx, &kmsapi.DecryptRequest{
+		Ciphertext:  wk.Ciphertext,
+		Uid:         newUID(),
+		KeyId:       wk.KeyID,
+		Annotations: wk.Annotations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func (p *kmsPlugin) close() { p.conn.Close() }
+
+// vaultTransit wraps archive keys directly with a Vault transit key, for
+// use where the plugin socket is not reachable, such as off the node.
+type vaultTransit struct {
+	address   string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	http      *http.Client
+}
+
+func newVaultTransit(address, token, namespace, mount, key, caFile string, skipTLSVerify bool, timeout time.Duration) (*vaultTransit, error) {
+	if token == "" {
+		return nil, fmt.Errorf("a Vault token is required: set VAULT_TOKEN or --vault-token-file")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipTLSVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --tls-ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &vaultTransit{
+		address:   strings.TrimRight(address, "/"),
+		token:     token,
+		namespace: namespace,
+		mount:     strings.Trim(mount, "/"),
+		key:       key,
+		http: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+// readToken reads a Vault token from path, or stdin for "-", so that it
+// does not appear in a command line.
+func readToken(path string) (string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	b, err := io.ReadAll(io.LimitReader(r, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Vault token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (v *vaultTransit) provider() string { return providerVaultTransit }
+
+func (v *vaultTransit) describe() string {
+	d := fmt.Sprintf("Vault transit key %s/%s at %s", v.mount, v.key, v.address)
+	if v.namespace != "" {
+		d += " (namespace " + v.namespace + ")"
+	}
+	return d
+}
+
+func (v *vaultTransit) wrap(ctx context.Context, key []byte) (wrappedKey, error) {
+	uid := newUID()
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := v.do(ctx, uid, v.namespace, v.mount+"/encrypt/"+v.key, body, &out); err != nil {
+		return wrappedKey{}, err
+	}
+	// Same key ID as mock-vault-kms --vault-backend: name and version.
+	keyID := v.key
+	if parts := strings.SplitN(out.Ciphertext, ":", 3); len(parts) == 3 {
+		keyID += ":" + parts[1]
+	}
+	return wrappedKey{
+		Provider:   providerVaultTransit,
+		KeyID:      keyID,
+		Ciphertext: []byte(out.Ciphertext),
+		UID:        uid,
+		Mount:      v.mount,
+		Name:       v.key,
+		Namespace:  v.namespace,
+	}, nil
+}
+
+// unwrap decrypts with the transit key named in the archive header, which
+// is the one it was wrapped with, falling back to the configured key for
+// archives wrapped through a plugin.
+func (v *vaultTransit) unwrap(ctx context.Context, wk wrappedKey) ([]byte, error) {
+	mount, key, namespace := v.mount, v.key, v.namespace
+	if wk.Provider == providerVaultTransit {
+		mount, key, namespace = wk.Mount, wk.Name, wk.Namespace
+	}
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	body := map[string]string{"ciphertext": string(wk.Ciphertext)}
+	if err := v.do(ctx, newUID(), namespace, mount+"/decrypt/"+key, body, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// do posts body to path and decodes the "data" object of the response into
+// into. correlation is sent as X-KMS-Correlation-ID, like the plugin does,
+// so kms-trace can find the request in the Vault audit log.
+func (v *vaultTransit) do(ctx context.Context, correlation, namespace, path string, body, into any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.address+"/v1/"+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("X-KMS-Correlation-ID", correlation)
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errBody struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(raw, &errBody)
+		return fmt.Errorf("vault %s: HTTP %d: %s", path, resp.StatusCode, strings.Join(errBody.Errors, "; "))
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return fmt.Errorf("vault %s: invalid response: %w", path, err)
+	}
+	return json.Unmarshal(envelope.Data, into)
+}
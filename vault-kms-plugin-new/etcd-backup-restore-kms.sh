@@ -13,6 +13,11 @@
 #   4. Simulating data loss (deleting test secrets)
 #   5. Restoring etcd from backup
 #   6. Post-restore verification (secrets are intact, KMS decryption works)
+#   7. Restore drill: restore a backup into a scratch etcd on this machine
+#      with escrowed key material and read back every object (restore-drill/)
+#   8. Backup encryption: the snapshot and static resources are encrypted on
+#      the node with an archive key wrapped by the KMS plugin or Vault
+#      (backup-crypt/), so the backup needs the same key as etcd
 #
 # Usage:
 #   # Full backup and restore test
@@ -21,12 +26,25 @@
 #   # Backup only
 #   ./etcd-backup-restore-kms.sh --backup
 #
+#   # Backup, encrypted under the KMS plugin's key
+#   ./etcd-backup-restore-kms.sh --backup --encrypt-backup
+#
+#   # Decrypt and verify an encrypted backup on the node
+#   ./etcd-backup-restore-kms.sh --decrypt-backup --backup-dir /home/core/backup --backup-node <node>
+#
 #   # Restore from existing backup
 #   ./etcd-backup-restore-kms.sh --restore --backup-dir /home/core/backup
 #
 #   # Verify KMS encryption status only
 #   ./etcd-backup-restore-kms.sh --verify
 #
+#   # Restore drill: new backup + transit key export from Vault, restored locally
+#   VAULT_ADDR=... VAULT_TOKEN=... ./etcd-backup-restore-kms.sh --restore-drill
+#
+#   # Restore drill of an existing backup with an escrowed key
+#   ./etcd-backup-restore-kms.sh --restore-drill --backup-dir /home/core/backup \
+#       --backup-node <node> --escrow key-escrow.json
+#
 #   # Cleanup test resources
 #   ./etcd-backup-restore-kms.sh --cleanup
 #
@@ -35,6 +53,11 @@
 #   - KMS encryption enabled on the cluster
 #   - KMS plugin pods running on control plane nodes
 #   - Vault accessible and Transit engine working
+#   - For --restore-drill: go, and either an escrowed key (--escrow), the
+#     mock plugin key (--mock-key), a running plugin (--kms-endpoint), or
+#     VAULT_ADDR/VAULT_TOKEN with an exportable transit key
+#   - For --encrypt-backup and encrypted backups: go, to build backup-crypt
+#     for the node
 #
 # ============================================================================
 
@@ -57,6 +80,27 @@ BACKUP_NODE=""          # Will be auto-detected
 BACKUP_DIR=""           # Will be set based on action
 ACTION=""
 SKIP_RESTORE_PROMPT="false"
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+
+# Restore drill
+DRILL_DIR=""            # Local working copy of the backup, default /tmp/restore-drill-<ts>
+ESCROW_FILE=""          # Transit key export (--escrow)
+DRILL_MOCK_KEY="false"  # Use the mock-vault-kms key (--mock-key)
+DRILL_KMS_ENDPOINT=""   # Use an already-running plugin (--kms-endpoint)
+VAULT_ADDR="${VAULT_ADDR:-}"
+VAULT_TOKEN="${VAULT_TOKEN:-}"
+VAULT_NAMESPACE="${VAULT_NAMESPACE:-}"
+VAULT_KEY_NAME="${VAULT_KEY_NAME:-kms-key}"
+TRANSIT_MOUNT="${TRANSIT_MOUNT:-transit}"
+SKIP_TLS_VERIFY="${SKIP_TLS_VERIFY:-false}"
+
+# Backup encryption
+ENCRYPT_BACKUP="${ENCRYPT_BACKUP:-false}"  # Encrypt new backups (--encrypt-backup)
+BACKUP_KEY="plugin"                         # Wrap archive keys with: plugin or vault (--backup-key)
+BACKUP_KMS_ENDPOINT="unix:///var/run/kmsplugin/kms.sock"
+BACKUP_CRYPT_BIN="/usr/local/bin/backup-crypt"
+BACKUP_CRYPT_INSTALLED=""                   # Node backup-crypt was copied to
+MANUAL_RESOURCES_TAR="manual_resources.tar.gz"  # Manual backup directories, archived to encrypt
 
 # Logging helpers
 log_info()    { printf "${BLUE}[INFO]${NC} %s\n" "$*"; }
@@ -88,6 +132,38 @@ while [[ $# -gt 0 ]]; do
             ACTION="cleanup"
             shift
             ;;
+        --restore-drill)
+            ACTION="restore-drill"
+            shift
+            ;;
+        --decrypt-backup)
+            ACTION="decrypt-backup"
+            shift
+            ;;
+        --encrypt-backup)
+            ENCRYPT_BACKUP="true"
+            shift
+            ;;
+        --backup-key)
+            BACKUP_KEY="$2"
+            shift 2
+            ;;
+        --escrow)
+            ESCROW_FILE="$2"
+            shift 2
+            ;;
+        --mock-key)
+            DRILL_MOCK_KEY="true"
+            shift
+            ;;
+        --kms-endpoint)
+            DRILL_KMS_ENDPOINT="$2"
+            shift 2
+            ;;
+        --drill-dir)
+            DRILL_DIR="$2"
+            shift 2
+            ;;
         --backup-dir)
             BACKUP_DIR="$2"
             shift 2
@@ -109,18 +185,31 @@ while [[ $# -gt 0 ]]; do
             echo "  --restore             Restore etcd from backup"
             echo "  --verify              Verify KMS encryption status only"
             echo "  --cleanup             Remove test resources"
+            echo "  --restore-drill       Restore a backup into a local scratch etcd and read back every object"
+            echo "                        (takes a new backup unless --backup-dir is given)"
+            echo "  --decrypt-backup      Decrypt and verify an encrypted backup on the node (needs --backup-dir)"
             echo ""
             echo "Options:"
-            echo "  --backup-dir PATH     Path to backup directory on the node (for --restore)"
+            echo "  --backup-dir PATH     Path to backup directory on the node (for --restore, --restore-drill)"
             echo "  --backup-node NODE    Specific control plane node to use for backup/restore"
             echo "  --yes, -y             Skip confirmation prompts"
+            echo "  --encrypt-backup      Encrypt the snapshot and static resources on the node after the backup"
+            echo "  --backup-key KEY      Wrap archive keys with the KMS plugin (plugin, default) or Vault transit"
+            echo "                        directly (vault: VAULT_ADDR, VAULT_TOKEN, VAULT_KEY_NAME, TRANSIT_MOUNT)"
+            echo "  --escrow FILE         Drill: Vault transit key export (default: export via VAULT_ADDR/VAULT_TOKEN)"
+            echo "  --mock-key            Drill: cluster uses mock-vault-kms"
+            echo "  --kms-endpoint EP     Drill: use a running KMS plugin, e.g. against a restored Vault"
+            echo "  --drill-dir DIR       Drill: local directory for the backup copy and report"
             echo "  --help, -h            Show this help"
             echo ""
             echo "Examples:"
             echo "  $0 --backup-and-restore"
             echo "  $0 --backup"
+            echo "  $0 --backup --encrypt-backup"
             echo "  $0 --restore --backup-dir /home/core/assets/backup"
             echo "  $0 --verify"
+            echo "  $0 --restore-drill --backup-dir /home/core/backup --backup-node <node> --escrow key-escrow.json"
+            echo "  $0 --decrypt-backup --backup-dir /home/core/backup --backup-node <node>"
             exit 0
             ;;
         *)
@@ -130,6 +219,11 @@ while [[ $# -gt 0 ]]; do
     esac
 done
 
+if [ "$BACKUP_KEY" != "plugin" ] && [ "$BACKUP_KEY" != "vault" ]; then
+    echo "Invalid --backup-key: $BACKUP_KEY (plugin or vault)"
+    exit 1
+fi
+
 # ============================================================================
 # Prerequisite Checks
 # ============================================================================
@@ -555,6 +649,183 @@ take_etcd_backup_manual() {
     fi
 }
 
+# ============================================================================
+# Step 4c: Backup Encryption (backup-crypt)
+# ============================================================================
+install_backup_crypt() {
+    if [ "$BACKUP_CRYPT_INSTALLED" = "$BACKUP_NODE" ]; then
+        return
+    fi
+    if ! command -v go &>/dev/null; then
+        log_error "go not found; it is needed to build backup-crypt for the node"
+        exit 1
+    fi
+
+    local arch
+    arch=$(oc get node "$BACKUP_NODE" -o jsonpath='{.status.nodeInfo.architecture}' 2>/dev/null || echo "")
+    [ -z "$arch" ] && arch="amd64"
+    local bin
+    bin=$(mktemp /tmp/backup-crypt.XXXXXX)
+    log_info "Building backup-crypt for linux/$arch..."
+    if ! (cd "$SCRIPT_DIR/backup-crypt" && CGO_ENABLED=0 GOOS=linux GOARCH="$arch" go build -o "$bin" .); then
+        log_error "Failed to build backup-crypt"
+        rm -f "$bin"
+        exit 1
+    fi
+
+    # The binary goes through the debug pod's stdin; compare checksums so a
+    # truncated copy is never run.
+    local want got
+    want=$(sha256sum "$bin" | awk '{print $1}')
+    log_info "Copying backup-crypt to $BACKUP_NODE:$BACKUP_CRYPT_BIN..."
+    got=$(oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+        cat > $BACKUP_CRYPT_BIN.tmp && chmod 755 $BACKUP_CRYPT_BIN.tmp && mv $BACKUP_CRYPT_BIN.tmp $BACKUP_CRYPT_BIN && sha256sum $BACKUP_CRYPT_BIN
+    " < "$bin" 2>/dev/null | awk '{print $1}' || echo "")
+    rm -f "$bin"
+    if [ "$got" != "$want" ]; then
+        log_error "backup-crypt did not arrive intact on $BACKUP_NODE"
+        exit 1
+    fi
+    log_success "backup-crypt installed on $BACKUP_NODE"
+    BACKUP_CRYPT_INSTALLED="$BACKUP_NODE"
+}
+
+# run_backup_crypt_on_node SUBCOMMAND ARGS... runs backup-crypt on the backup
+# node. ARGS are expanded by the node's shell, so they may be globs. With
+# --backup-key vault the token goes in on stdin, not on the command line.
+run_backup_crypt_on_node() {
+    local subcommand="$1"
+    shift
+    if [ "$BACKUP_KEY" = "vault" ]; then
+        local tls_flag=""
+        [ "$SKIP_TLS_VERIFY" = "true" ] && tls_flag="--tls-skip-verify"
+        printf '%s\n' "$VAULT_TOKEN" | oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+            shopt -s nullglob
+            $BACKUP_CRYPT_BIN $subcommand --vault-address '$VAULT_ADDR' --vault-token-file - \
+                --vault-namespace '$VAULT_NAMESPACE' --transit-mount '$TRANSIT_MOUNT' --transit-key '$VAULT_KEY_NAME' \
+                $tls_flag $* 2>&1
+        "
+    else
+        oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+            shopt -s nullglob
+            $BACKUP_CRYPT_BIN $subcommand --kms-endpoint $BACKUP_KMS_ENDPOINT $* 2>&1
+        " < /dev/null
+    fi
+}
+
+check_backup_key() {
+    if [ "$BACKUP_KEY" = "vault" ]; then
+        if [ -z "$VAULT_ADDR" ] || [ -z "$VAULT_TOKEN" ]; then
+            log_error "--backup-key vault needs VAULT_ADDR and VAULT_TOKEN"
+            exit 1
+        fi
+        log_info "Archive keys are wrapped by Vault transit key $TRANSIT_MOUNT/$VAULT_KEY_NAME at $VAULT_ADDR"
+    else
+        log_info "Archive keys are wrapped by the KMS plugin at $BACKUP_KMS_ENDPOINT on $BACKUP_NODE"
+    fi
+}
+
+encrypt_backup() {
+    if [ "$ENCRYPT_BACKUP" != "true" ]; then
+        return
+    fi
+    log_header "Encrypting Backup"
+
+    check_backup_key
+    install_backup_crypt
+
+    # The manual fallback backup copies manifests/ and static-pod-resources/
+    # as directories. backup-crypt encrypts files, so they are archived
+    # first and only removed once that archive has been encrypted.
+    local files=("$BACKUP_DIR/snapshot_*.db" "$BACKUP_DIR/static_kuberesources_*.tar.gz")
+    local manual_dirs
+    manual_dirs=$(oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+        cd $BACKUP_DIR && ls -1d manifests static-pod-resources 2>/dev/null
+    " 2>/dev/null || echo "")
+    manual_dirs=$(echo $manual_dirs)
+    if [ -n "$manual_dirs" ]; then
+        log_info "Archiving $manual_dirs into $MANUAL_RESOURCES_TAR..."
+        local tar_output
+        tar_output=$(oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+            tar -C $BACKUP_DIR -czf $BACKUP_DIR/$MANUAL_RESOURCES_TAR $manual_dirs && echo MANUAL_ARCHIVE_OK
+        " 2>&1 || echo "")
+        if ! echo "$tar_output" | grep -q "MANUAL_ARCHIVE_OK"; then
+            echo "$tar_output" | tail -5 | while read -r line; do
+                echo "    $line"
+            done
+            log_error "Failed to archive the manual backup directories; nothing was encrypted"
+            exit 1
+        fi
+        files+=("$BACKUP_DIR/$MANUAL_RESOURCES_TAR")
+    fi
+
+    # Each file gets its own archive key. backup-crypt decrypts every new
+    # archive through the KMS before it removes the plaintext.
+    local output
+    output=$(run_backup_crypt_on_node encrypt --remove-plaintext "${files[@]}" 2>&1 || echo "BACKUP_CRYPT_FAILED")
+    echo "$output" | while read -r line; do
+        echo "    $line"
+    done
+    if echo "$output" | grep -q "BACKUP_CRYPT_FAILED\|\[FAIL\]\|Error:"; then
+        log_error "Backup encryption failed; files that did not verify are still in plaintext in $BACKUP_DIR"
+        exit 1
+    fi
+
+    if [ -n "$manual_dirs" ]; then
+        local leftovers
+        leftovers=$(oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+            cd $BACKUP_DIR && rm -rf $manual_dirs; ls -1d $manual_dirs 2>/dev/null
+        " 2>/dev/null || echo "")
+        if [ -n "$leftovers" ]; then
+            log_error "Failed to remove the plaintext manual backup directories:"
+            echo "$leftovers" | while read -r line; do
+                echo "    $BACKUP_DIR/$line"
+            done
+            exit 1
+        fi
+        log_info "Removed the plaintext $manual_dirs; they are in $MANUAL_RESOURCES_TAR.kmsenc"
+    fi
+
+    oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+        echo 'Archive Encryption: backup-crypt, archive keys wrapped by $BACKUP_KEY' >> $BACKUP_DIR/kms-backup-info.txt
+    " 2>/dev/null || true
+
+    log_success "Backup archives encrypted"
+    echo "  To decrypt them: $0 --decrypt-backup --backup-dir $BACKUP_DIR --backup-node $BACKUP_NODE"
+}
+
+# decrypt_backup_on_node decrypts every archive in BACKUP_DIR next to it.
+# backup-crypt only writes a file once all of it authenticated and its
+# SHA-256 matches the archive header.
+decrypt_backup_on_node() {
+    log_info "Decrypting backup archives on $BACKUP_NODE..."
+    check_backup_key
+    install_backup_crypt
+
+    local output
+    output=$(run_backup_crypt_on_node decrypt --force \
+        "$BACKUP_DIR/snapshot_*.db.kmsenc" "$BACKUP_DIR/static_kuberesources_*.tar.gz.kmsenc" \
+        "$BACKUP_DIR/${MANUAL_RESOURCES_TAR}*.kmsenc" 2>&1 || echo "BACKUP_CRYPT_FAILED")
+    echo "$output" | while read -r line; do
+        echo "    $line"
+    done
+    if echo "$output" | grep -q "BACKUP_CRYPT_FAILED\|\[FAIL\]\|Error:"; then
+        log_error "Backup decryption failed; nothing unverified was written"
+        exit 1
+    fi
+    log_success "Backup archives decrypted and verified"
+}
+
+# remove_decrypted_backup removes the plaintext decrypt_backup_on_node
+# wrote, leaving the archives.
+remove_decrypted_backup() {
+    oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+        shopt -s nullglob
+        for f in $BACKUP_DIR/*.kmsenc; do rm -f \"\${f%.kmsenc}\"; done
+    " 2>/dev/null || true
+    log_info "Removed the decrypted copies; the encrypted archives remain in $BACKUP_DIR"
+}
+
 # ============================================================================
 # Step 5: Simulate Data Loss (Delete Test Secrets)
 # ============================================================================
@@ -637,6 +908,18 @@ restore_etcd() {
     log_info "Starting etcd restore on node: $BACKUP_NODE"
     log_info "Backup directory: $BACKUP_DIR"
 
+    # Encrypted backups are decrypted while the KMS plugin is still up;
+    # cluster-restore.sh needs the plaintext snapshot.
+    local encrypted decrypted="false"
+    encrypted=$(oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+        ls -1 $BACKUP_DIR/*.kmsenc 2>/dev/null
+    " 2>/dev/null || echo "")
+    if [ -n "$encrypted" ]; then
+        log_info "Backup is encrypted"
+        decrypt_backup_on_node
+        decrypted="true"
+    fi
+
     # Verify backup exists on the node
     log_info "Verifying backup files on $BACKUP_NODE..."
     local backup_check
@@ -686,6 +969,10 @@ restore_etcd() {
 
     # Wait for cluster to come back
     wait_for_cluster_recovery
+
+    if [ "$decrypted" = "true" ]; then
+        remove_decrypted_backup
+    fi
 }
 
 # ============================================================================
@@ -937,6 +1224,193 @@ cleanup_test_resources() {
     log_info "To remove them, SSH to the node and delete the backup directory."
 }
 
+# ============================================================================
+# Restore Drill: copy the backup to this machine
+# ============================================================================
+fetch_backup_locally() {
+    log_header "Copying Backup for Restore Drill"
+
+    [ -z "$DRILL_DIR" ] && DRILL_DIR="/tmp/restore-drill-$(date +%Y%m%d_%H%M%S)"
+    mkdir -p "$DRILL_DIR"
+    chmod 700 "$DRILL_DIR"
+    log_info "Source: $BACKUP_NODE:$BACKUP_DIR"
+    log_info "Local:  $DRILL_DIR"
+
+    local files
+    files=$(oc debug node/"$BACKUP_NODE" -q -- chroot /host bash -c "
+        ls -1t $BACKUP_DIR/snapshot_*.db $BACKUP_DIR/snapshot_*.db.kmsenc 2>/dev/null | head -1
+        ls -1t $BACKUP_DIR/static_kuberesources_*.tar.gz $BACKUP_DIR/static_kuberesources_*.tar.gz.kmsenc 2>/dev/null | head -1
+        ls -1t $BACKUP_DIR/$MANUAL_RESOURCES_TAR $BACKUP_DIR/$MANUAL_RESOURCES_TAR.kmsenc 2>/dev/null | head -1
+        ls -1d $BACKUP_DIR/static-pod-resources/kube-apiserver-pod-*/secrets/encryption-config/encryption-config 2>/dev/null | sort -V | tail -1
+    " 2>/dev/null || echo "")
+
+    DRILL_SNAPSHOT=""
+    DRILL_STATIC=""
+    DRILL_CONFIG=""
+    local remote
+    for remote in $files; do
+        case "$remote" in
+            *.db|*.db.kmsenc)      DRILL_SNAPSHOT="$DRILL_DIR/$(basename "$remote")" ;;
+            # An encrypted manual backup: its static-pod-resources/ hold the
+            # encryption-config; cluster-backup.sh output is preferred.
+            */"$MANUAL_RESOURCES_TAR"|*/"$MANUAL_RESOURCES_TAR".kmsenc)
+                [ -n "$DRILL_STATIC" ] && continue
+                DRILL_STATIC="$DRILL_DIR/$(basename "$remote")" ;;
+            *.tar.gz|*.tar.gz.kmsenc) DRILL_STATIC="$DRILL_DIR/$(basename "$remote")" ;;
+            */encryption-config)   DRILL_CONFIG="$DRILL_DIR/encryption-config" ;;
+            *)                     continue ;;
+        esac
+        local local_path="$DRILL_DIR/$(basename "$remote")"
+        [[ "$remote" == */encryption-config ]] && local_path="$DRILL_CONFIG"
+        log_info "Copying $(basename "$remote")..."
+        if ! oc debug node/"$BACKUP_NODE" -q -- chroot /host cat "$remote" > "$local_path" 2>/dev/null || [ ! -s "$local_path" ]; then
+            log_error "Failed to copy $remote"
+            exit 1
+        fi
+        log_success "$(basename "$remote"): $(du -h "$local_path" | awk '{print $1}')"
+    done
+
+    if [ -z "$DRILL_SNAPSHOT" ]; then
+        log_error "No snapshot_*.db or snapshot_*.db.kmsenc found in $BACKUP_DIR on $BACKUP_NODE"
+        exit 1
+    fi
+    if [ -z "$DRILL_STATIC" ] && [ -z "$DRILL_CONFIG" ]; then
+        log_error "Backup has no static_kuberesources_*.tar.gz, $MANUAL_RESOURCES_TAR or encryption-config — cannot decrypt it"
+        exit 1
+    fi
+}
+
+# ============================================================================
+# Restore Drill: escrow the Vault transit key
+# ============================================================================
+export_key_escrow() {
+    if [ -n "$ESCROW_FILE" ] || [ "$DRILL_MOCK_KEY" = "true" ] || [ -n "$DRILL_KMS_ENDPOINT" ]; then
+        return
+    fi
+
+    log_header "Exporting Transit Key for Escrow"
+
+    if [ -z "$VAULT_ADDR" ] || [ -z "$VAULT_TOKEN" ]; then
+        log_error "No key material: pass --escrow FILE, --mock-key or --kms-endpoint, or set VAULT_ADDR and VAULT_TOKEN"
+        exit 1
+    fi
+
+    local curl_opts=("-s" "--noproxy" "*" "--max-time" "15" "--header" "X-Vault-Token: $VAULT_TOKEN")
+    [ "$SKIP_TLS_VERIFY" = "true" ] && curl_opts+=("-k")
+    [ -n "$VAULT_NAMESPACE" ] && curl_opts+=("--header" "X-Vault-Namespace: $VAULT_NAMESPACE")
+
+    log_info "Reading $TRANSIT_MOUNT/export/encryption-key/$VAULT_KEY_NAME from $VAULT_ADDR"
+    ESCROW_FILE="$DRILL_DIR/key-escrow.json"
+    (umask 077; curl "${curl_opts[@]}" "$VAULT_ADDR/v1/$TRANSIT_MOUNT/export/encryption-key/$VAULT_KEY_NAME" > "$ESCROW_FILE") || true
+
+    local versions
+    versions=$(jq -r '.data.keys | keys | join(",")' "$ESCROW_FILE" 2>/dev/null || echo "")
+    if [ -z "$versions" ]; then
+        log_error "Transit key export failed: $(jq -r '.errors[]?' "$ESCROW_FILE" 2>/dev/null)"
+        log_info "The key must be exportable. This cannot be undone on the Vault side:"
+        echo "    vault write $TRANSIT_MOUNT/keys/$VAULT_KEY_NAME/config exportable=true"
+        rm -f "$ESCROW_FILE"
+        exit 1
+    fi
+    log_success "Escrowed key versions $versions to $ESCROW_FILE (mode 0600)"
+    log_warn "This file decrypts every KMS-encrypted object in the backup. Store it apart from the backup."
+}
+
+# ============================================================================
+# Restore Drill: decrypt encrypted backup archives
+# ============================================================================
+decrypt_backup_locally() {
+    local archives=()
+    local f
+    for f in "$DRILL_SNAPSHOT" "$DRILL_STATIC"; do
+        [[ "$f" == *.kmsenc ]] && archives+=("$f")
+    done
+    if [ ${#archives[@]} -eq 0 ]; then
+        return
+    fi
+
+    log_header "Decrypting Backup Archives"
+
+    if ! command -v go &>/dev/null; then
+        log_error "go not found; it is needed to build backup-crypt"
+        exit 1
+    fi
+
+    # The archive keys are wrapped by the cluster's KMS, so they are
+    # unwrapped with the drill's key material: the given plugin, or
+    # restore-drill serving the escrowed (or mock) key on a local socket.
+    local endpoint="$DRILL_KMS_ENDPOINT"
+    local plugin_pid=""
+    if [ -z "$endpoint" ]; then
+        local key_args=("--escrow" "$ESCROW_FILE")
+        [ "$DRILL_MOCK_KEY" = "true" ] && key_args=("--mock-key")
+        endpoint="unix://$DRILL_DIR/backup-kms.sock"
+        if ! (cd "$SCRIPT_DIR/restore-drill" && go build -o "$DRILL_DIR/restore-drill" .); then
+            log_error "Failed to build restore-drill"
+            exit 1
+        fi
+        "$DRILL_DIR/restore-drill" plugin "${key_args[@]}" --listen "$endpoint" > "$DRILL_DIR/backup-kms.log" 2>&1 &
+        plugin_pid=$!
+        local i
+        for i in $(seq 1 50); do
+            [ -S "$DRILL_DIR/backup-kms.sock" ] && break
+            sleep 0.2
+        done
+    fi
+
+    local rc=0
+    log_info "backup-crypt decrypt --kms-endpoint $endpoint ${archives[*]}"
+    (cd "$SCRIPT_DIR/backup-crypt" && go run . decrypt --kms-endpoint "$endpoint" --force "${archives[@]}") || rc=$?
+    if [ -n "$plugin_pid" ]; then
+        kill "$plugin_pid" 2>/dev/null || true
+        wait "$plugin_pid" 2>/dev/null || true
+    fi
+    if [ "$rc" -ne 0 ]; then
+        log_error "Backup archives could not be decrypted with this key material"
+        exit 1
+    fi
+
+    DRILL_SNAPSHOT="${DRILL_SNAPSHOT%.kmsenc}"
+    [ -n "$DRILL_STATIC" ] && DRILL_STATIC="${DRILL_STATIC%.kmsenc}"
+    log_success "Backup archives decrypted and verified"
+}
+
+# ============================================================================
+# Restore Drill: restore into a scratch etcd and read back every object
+# ============================================================================
+run_restore_drill() {
+    log_header "Restore Drill"
+
+    if ! command -v go &>/dev/null; then
+        log_error "go not found; it is needed to build restore-drill"
+        exit 1
+    fi
+
+    local args=("run" "--snapshot" "$DRILL_SNAPSHOT" "--report" "$DRILL_DIR/restorability-report.json")
+    if [ -n "$DRILL_STATIC" ]; then
+        args+=("--static-resources" "$DRILL_STATIC")
+    else
+        args+=("--encryption-config" "$DRILL_CONFIG")
+    fi
+    if [ -n "$DRILL_KMS_ENDPOINT" ]; then
+        args+=("--kms-endpoint" "$DRILL_KMS_ENDPOINT")
+    elif [ "$DRILL_MOCK_KEY" = "true" ]; then
+        args+=("--mock-key")
+    else
+        args+=("--escrow" "$ESCROW_FILE")
+    fi
+
+    log_info "restore-drill ${args[*]}"
+    echo ""
+    if ! (cd "$SCRIPT_DIR/restore-drill" && go run . "${args[@]}"); then
+        log_error "Backup $BACKUP_NODE:$BACKUP_DIR is NOT restorable — see the report"
+        echo "  Report: $DRILL_DIR/restorability-report.json"
+        exit 1
+    fi
+    log_success "Backup $BACKUP_NODE:$BACKUP_DIR is restorable"
+    echo "  Report: $DRILL_DIR/restorability-report.json"
+}
+
 # ============================================================================
 # Action: Backup Only
 # ============================================================================
@@ -946,12 +1420,22 @@ action_backup() {
     create_test_data
     verify_secrets_encrypted
     take_etcd_backup
+    encrypt_backup
 
     echo ""
     log_header "Backup Complete"
     echo ""
     echo "  Backup saved on node: $BACKUP_NODE"
     echo "  Backup directory:     $BACKUP_DIR"
+    if [ "$ENCRYPT_BACKUP" = "true" ]; then
+        echo "  Backup encryption:    backup-crypt, archive keys wrapped by $BACKUP_KEY"
+    else
+        echo "  Backup encryption:    none"
+        echo ""
+        log_warn "The backup is UNENCRYPTED: the snapshot and the static pod resources,"
+        log_warn "including their certificates and keys, are plaintext on the node."
+        log_warn "Use --encrypt-backup to encrypt them under the KMS key."
+    fi
     echo ""
     echo "  To restore later:"
     echo "    $0 --restore --backup-dir $BACKUP_DIR --backup-node $BACKUP_NODE"
@@ -1014,6 +1498,7 @@ action_backup_and_restore() {
 
     # Step 4: Take backup
     take_etcd_backup
+    encrypt_backup
 
     # Step 5: Simulate data loss
     simulate_data_loss
@@ -1036,6 +1521,46 @@ action_backup_and_restore() {
     verify_post_restore
 }
 
+# ============================================================================
+# Action: Restore Drill
+# ============================================================================
+action_restore_drill() {
+    check_prerequisites
+
+    if [ -z "$BACKUP_DIR" ]; then
+        verify_kms_status
+        take_etcd_backup
+        encrypt_backup
+    else
+        get_control_plane_node
+    fi
+
+    fetch_backup_locally
+    export_key_escrow
+    decrypt_backup_locally
+    run_restore_drill
+}
+
+# ============================================================================
+# Action: Decrypt Backup
+# ============================================================================
+action_decrypt_backup() {
+    check_prerequisites
+
+    if [ -z "$BACKUP_DIR" ]; then
+        log_error "Please specify --backup-dir with the path to the encrypted backup on the control plane node."
+        exit 1
+    fi
+
+    log_header "Decrypting Backup"
+    get_control_plane_node
+    decrypt_backup_on_node
+
+    echo ""
+    echo "  Decrypted files are in $BACKUP_NODE:$BACKUP_DIR next to the archives."
+    echo "  They are plaintext again; remove them once they are no longer needed."
+}
+
 # ============================================================================
 # Main
 # ============================================================================
@@ -1053,13 +1578,17 @@ main() {
         echo "  3) Restore from existing backup"
         echo "  4) Verify KMS encryption status"
         echo "  5) Cleanup test resources"
-        read -p "Enter choice [1-5]: " choice
+        echo "  6) Restore drill (scratch etcd, escrowed key)"
+        echo "  7) Decrypt an encrypted backup on the node"
+        read -p "Enter choice [1-7]: " choice
         case $choice in
             1) ACTION="backup-and-restore" ;;
             2) ACTION="backup" ;;
             3) ACTION="restore" ;;
             4) ACTION="verify" ;;
             5) ACTION="cleanup" ;;
+            6) ACTION="restore-drill" ;;
+            7) ACTION="decrypt-backup" ;;
             *) echo "Invalid choice"; exit 1 ;;
         esac
     fi
@@ -1082,6 +1611,12 @@ main() {
         cleanup)
             cleanup_test_resources
             ;;
+        restore-drill)
+            action_restore_drill
+            ;;
+        decrypt-backup)
+            action_decrypt_backup
+            ;;
         *)
             log_error "Unknown action: $ACTION"
             exit 1
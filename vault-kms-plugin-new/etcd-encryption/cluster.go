@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// oc runs the oc CLI, the same way the shell scripts talk to the cluster.
+type oc struct {
+	kubeconfig string
+}
+
+func (c oc) run(ctx context.Context, args ...string) ([]byte, error) {
+	if c.kubeconfig != "" {
+		args = append([]string{"--kubeconfig", c.kubeconfig}, args...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "oc", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("oc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (c oc) getJSON(ctx context.Context, into any, args ...string) error {
+	out, err := c.run(ctx, append(args, "-o", "json")...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(out, into)
+}
+
+// Discovery is what the cluster says about where resources are served.
+type Discovery struct {
+	// CRDs are stored by the kube-apiserver under /kubernetes.io/<group>/<plural>/.
+	CRDs map[GroupResource]bool
+	// Aggregated maps API groups served through an APIService to the
+	// apiserver behind it.
+	Aggregated map[string]APIServer
+	// Served is every resource the API advertises, used to warn about
+	// typos in resource lists.
+	Served map[GroupResource]bool
+}
+
+func discover(ctx context.Context, c oc) (*Discovery, error) {
+	d := &Discovery{
+		CRDs:       map[GroupResource]bool{},
+		Aggregated: map[string]APIServer{},
+		Served:     map[GroupResource]bool{},
+	}
+
+	var crds struct {
+		Items []struct {
+			Spec struct {
+				Group string `json:"group"`
+				Names struct {
+					Plural string `json:"plural"`
+				} `json:"names"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := c.getJSON(ctx, &crds, "get", "customresourcedefinitions"); err != nil {
+		return nil, err
+	}
+	for _, crd := range crds.Items {
+		d.CRDs[GroupResource{Group: crd.Spec.Group, Resource: crd.Spec.Names.Plural}] = true
+	}
+
+	var services struct {
+		Items []struct {
+			Spec struct {
+				Group   string `json:"group"`
+				Service *struct {
+					Namespace string `json:"namespace"`
+				} `json:"service"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := c.getJSON(ctx, &services, "get", "apiservices"); err != nil {
+		return nil, err
+	}
+	for _, svc := range services.Items {
+		if svc.Spec.Service == nil {
+			continue
+		}
+		switch svc.Spec.Service.Namespace {
+		case "openshift-apiserver":
+			d.Aggregated[svc.Spec.Group] = OpenShiftAPIServer
+		case "openshift-oauth-apiserver":
+			d.Aggregated[svc.Spec.Group] = OAuthAPIServer
+		}
+	}
+
+	out, err := c.run(ctx, "api-resources", "-o", "name")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(out)) {
+		if gr, err := ParseGroupResource(line); err == nil {
+			d.Served[gr] = true
+		}
+	}
+	return d, nil
+}
+
+// EncryptionConfiguration is the subset of
+// apiserver.config.k8s.io/v1 EncryptionConfiguration used here.
+type EncryptionConfiguration struct {
+	Kind       string                  `json:"kind"`
+	APIVersion string                  `json:"apiVersion"`
+	Resources  []ResourceConfiguration `json:"resources"`
+}
+
+type ResourceConfiguration struct {
+	Resources []string         `json:"resources"`
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// ProviderConfig holds exactly one provider.
+type ProviderConfig struct {
+	KMS       *KMSConfig `json:"kms,omitempty"`
+	AESCBC    *KeyConfig `json:"aescbc,omitempty"`
+	AESGCM    *KeyConfig `json:"aesgcm,omitempty"`
+	Secretbox *KeyConfig `json:"secretbox,omitempty"`
+	Identity  *struct{}  `json:"identity,omitempty"`
+}
+
+type KMSConfig struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Name       string `json:"name"`
+	Endpoint   string `json:"endpoint"`
+	Timeout    string `json:"timeout,omitempty"`
+}
+
+type KeyConfig struct {
+	Keys []struct {
+		Name string `json:"name"`
+	} `json:"keys"`
+}
+
+// Type is the provider type as it appears in the etcd value prefix
+// (k8s:enc:<type>:...).
+func (p ProviderConfig) Type() string {
+	switch {
+	case p.KMS != nil:
+		return "kms"
+	case p.AESCBC != nil:
+		return "aescbc"
+	case p.AESGCM != nil:
+		return "aesgcm"
+	case p.Secretbox != nil:
+		return "secretbox"
+	default:
+		return "identity"
+	}
+}
+
+// Configured is a resource the apiserver is configured to encrypt and the
+// provider new writes use.
+type Configured struct {
+	GroupResource
+	APIServer APIServer
+	Provider  string
+}
+
+// configuredResources reads the EncryptionConfigurations the OpenShift
+// encryption controllers rendered for each apiserver and returns every
+// resource whose write provider is not identity.
+func configuredResources(ctx context.Context, c oc) ([]Configured, error) {
+	var out []Configured
+	for _, server := range sortedServers(encryptionConfigSecrets) {
+		var secret struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := c.getJSON(ctx, &secret, "get", "secret", encryptionConfigSecrets[server], "-n", "openshift-config-managed"); err != nil {
+			if strings.Contains(err.Error(), "NotFound") {
+				continue
+			}
+			return nil, err
+		}
+		raw, err := base64.StdEncoding.DecodeString(secret.Data["encryption-config"])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", encryptionConfigSecrets[server], err)
+		}
+		var cfg EncryptionConfiguration
+		if err := yaml.Unmarshal(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", encryptionConfigSecrets[server], err)
+		}
+		for _, rc := range cfg.Resources {
+			if len(rc.Providers) == 0 || rc.Providers[0].Type() == "identity" {
+				continue
+			}
+			for _, r := range rc.Resources {
+				// Wildcards ("*.*", "*.apps") have no single etcd prefix;
+				// such resources have to be listed explicitly.
+				if strings.Contains(r, "*") {
+					continue
+				}
+				gr, err := ParseGroupResource(r)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", encryptionConfigSecrets[server], err)
+				}
+				out = append(out, Configured{GroupResource: gr, APIServer: server, Provider: rc.Providers[0].Type()})
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gangwgr/report"
+)
+
+// Target is one resource to check and the provider its objects should be
+// stored with.
+type Target struct {
+	Mapping
+	Expected string
+	// Configured is false for resources listed on the command line that
+	// the apiserver's EncryptionConfiguration does not cover. Only set
+	// when the cluster configuration was read.
+	Configured *bool
+}
+
+// Coverage is the scan result for one resource.
+type Coverage struct {
+	Resource   string         `json:"resource"`
+	APIServer  APIServer      `json:"apiserver"`
+	Prefix     string         `json:"etcdPrefix"`
+	Source     string         `json:"prefixSource"`
+	Expected   string         `json:"expectedProvider"`
+	Configured *bool          `json:"configured,omitempty"`
+	Objects    int            `json:"objects"`
+	States     map[string]int `json:"states"`
+	// Offending are keys not stored with the expected provider, capped at
+	// maxOffending.
+	Offending []string `json:"offending,omitempty"`
+	Result    string   `json:"result"`
+	Error     string   `json:"error,omitempty"`
+}
+
+const maxOffending = 20
+
+func scanCoverage(ctx context.Context, db *etcd, targets []Target, r *report.Reporter) []Coverage {
+	var out []Coverage
+	for _, t := range targets {
+		cov := Coverage{
+			Resource:   t.String(),
+			APIServer:  t.APIServer,
+			Prefix:     t.Prefix,
+			Source:     t.Source,
+			Expected:   t.Expected,
+			Configured: t.Configured,
+			States:     map[string]int{},
+		}
+		r.Info("scanning %s under %s (%s)", cov.Resource, cov.Prefix, cov.Source)
+		kvs, err := db.List(ctx, t.Prefix)
+		if err != nil {
+			cov.Result, cov.Error = "FAIL", err.Error()
+			r.Failf("[%s] %v", cov.Resource, err)
+			out = append(out, cov)
+			continue
+		}
+		cov.Objects = len(kvs)
+		offending := 0
+		for _, kv := range kvs {
+			state := Classify(kv.Head)
+			cov.States[state.String()]++
+			if state.Type != t.Expected {
+				offending++
+				if len(cov.Offending) < maxOffending {
+					cov.Offending = append(cov.Offending, kv.Key)
+				}
+			}
+		}
+
+		switch {
+		case t.Configured != nil && !*t.Configured:
+			cov.Result = "FAIL"
+			r.Failf("[%s] not in the %s EncryptionConfiguration", cov.Resource, t.APIServer)
+		case cov.Objects == 0:
+			cov.Result = "SKIP"
+			r.Skipf("[%s] no objects under %s (check the prefix or --mapping)", cov.Resource, cov.Prefix)
+		case offending > 0:
+			cov.Result = "FAIL"
+			r.Failf("[%s] %d/%d object(s) not stored with %s: %s", cov.Resource, offending, cov.Objects, t.Expected, formatStates(cov.States))
+			for _, key := range cov.Offending {
+				fmt.Printf("          %s\n", key)
+			}
+			if offending > len(cov.Offending) {
+				fmt.Printf("          ... and %d more\n", offending-len(cov.Offending))
+			}
+		default:
+			cov.Result = "PASS"
+			r.Passf("[%s] %d object(s), all %s: %s", cov.Resource, cov.Objects, t.Expected, formatStates(cov.States))
+		}
+		out = append(out, cov)
+	}
+	return out
+}
+
+func formatStates(states map[string]int) string {
+	keys := make([]string, 0, len(states))
+	for k := range states {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", k, states[k]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func printCoverageTable(results []Coverage) {
+	fmt.Printf("\n  %-45s %-20s %8s  %-6s  %s\n", "RESOURCE", "APISERVER", "OBJECTS", "RESULT", "STATES")
+	fmt.Printf("  %-45s %-20s %8s  %-6s  %s\n", "────────", "─────────", "───────", "──────", "──────")
+	for _, c := range results {
+		color := report.Green
+		switch c.Result {
+		case "FAIL":
+			color = report.Red
+		case "SKIP":
+			color = report.Yellow
+		}
+		fmt.Printf("  %-45s %-20s %8d  %s%-6s%s  %s\n", c.Resource, c.APIServer, c.Objects, color, c.Result, report.Reset, formatStates(c.States))
+	}
+}
+
+func writeCoverage(path string, results []Coverage) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
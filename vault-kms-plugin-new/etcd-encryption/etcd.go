@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const etcdNamespace = "openshift-etcd"
+
+// etcdEnvs are tried in order when the etcdctl container is not usable,
+// mirroring get_etcd_pod_and_env in kms-key-loss-test.sh.
+var etcdEnvs = [][]string{
+	{"ETCDCTL_API=3", "ETCDCTL_CACERT=/etc/kubernetes/pki/etcd-peer/ca-bundle.crt", "ETCDCTL_CERT=/etc/kubernetes/pki/etcd-peer/peer.crt", "ETCDCTL_KEY=/etc/kubernetes/pki/etcd-peer/peer.key", "ETCDCTL_ENDPOINTS=https://localhost:2379"},
+	{"ETCDCTL_API=3", "ETCDCTL_CACERT=/etc/kubernetes/pki/etcd/ca.crt", "ETCDCTL_CERT=/etc/kubernetes/pki/etcd/peer.crt", "ETCDCTL_KEY=/etc/kubernetes/pki/etcd/peer.key", "ETCDCTL_ENDPOINTS=https://localhost:2379"},
+}
+
+// etcd runs etcdctl inside an etcd pod.
+type etcd struct {
+	client    oc
+	pod       string
+	container string
+	env       []string
+}
+
+// connectEtcd finds an etcd pod and a container/cert combination that can
+// reach etcd.
+func connectEtcd(ctx context.Context, c oc, pod string) (*etcd, error) {
+	if pod == "" {
+		out, err := c.run(ctx, "get", "pods", "-n", etcdNamespace, "-l", "app=etcd", "-o", "jsonpath={.items[0].metadata.name}")
+		if err != nil {
+			return nil, err
+		}
+		pod = strings.TrimSpace(string(out))
+		if pod == "" {
+			return nil, fmt.Errorf("no etcd pod found in %s", etcdNamespace)
+		}
+	}
+	candidates := []*etcd{{client: c, pod: pod, container: "etcdctl"}}
+	for _, env := range etcdEnvs {
+		candidates = append(candidates, &etcd{client: c, pod: pod, container: "etcd", env: env})
+	}
+	var lastErr error
+	for _, e := range candidates {
+		out, err := e.etcdctl(ctx, "get", "/", "--prefix", "--keys-only", "--limit", "1")
+		if err == nil && bytes.Contains(out, []byte("/")) {
+			return e, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("cannot run etcdctl in pod %s: %v", pod, lastErr)
+}
+
+func (e *etcd) etcdctl(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := []string{"exec", "-n", etcdNamespace, e.pod, "-c", e.container, "--"}
+	if len(e.env) > 0 {
+		cmd = append(append(cmd, "env"), e.env...)
+	}
+	cmd = append(append(cmd, "etcdctl"), args...)
+	return e.client.run(ctx, cmd...)
+}
+
+// KV is one etcd entry. Only the head of the value is kept; that is all
+// classification needs.
+type KV struct {
+	Key  string
+	Head []byte
+}
+
+const (
+	pageSize = 500
+	headSize = 64
+)
+
+// List returns every key under prefix, paging with --limit so large
+// prefixes do not have to come back in one response.
+func (e *etcd) List(ctx context.Context, prefix string) ([]KV, error) {
+	end := prefixEnd(prefix)
+	start := prefix
+	var out []KV
+	for {
+		raw, err := e.etcdctl(ctx, "get", start, end, "--limit", strconv.Itoa(pageSize), "-w", "json")
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Kvs []struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"kvs"`
+			More bool `json:"more"`
+		}
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return nil, fmt.Errorf("etcdctl get %s: %w", prefix, err)
+		}
+		for _, kv := range resp.Kvs {
+			// Each page after the first starts at the last key already seen.
+			if len(out) > 0 && string(kv.Key) == out[len(out)-1].Key {
+				continue
+			}
+			head := kv.Value
+			if len(head) > headSize {
+				head = head[:headSize]
+			}
+			out = append(out, KV{Key: string(kv.Key), Head: head})
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return out, nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key)
+	}
+}
+
+// prefixEnd is the etcd range end covering every key with the prefix.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// State is how a value is stored in etcd.
+type State struct {
+	// Type is kms, aescbc, aesgcm, secretbox, identity or unknown.
+	Type string
+	// Name is the provider (kms) or key name from the value prefix.
+	Name string
+}
+
+func (s State) String() string {
+	if s.Name == "" {
+		return s.Type
+	}
+	return s.Type + ":" + s.Name
+}
+
+// Classify reads the storage transformer prefix of an etcd value:
+// k8s:enc:kms:v2:<name>:, k8s:enc:aescbc:v1:<key>:, ... Unencrypted values
+// are protobuf ("k8s\x00") for built-in types and JSON for CRDs.
+func Classify(head []byte) State {
+	if rest, ok := bytes.CutPrefix(head, []byte("k8s:enc:")); ok {
+		parts := strings.SplitN(string(rest), ":", 4)
+		s := State{Type: parts[0]}
+		if len(parts) >= 3 {
+			s.Name = parts[2]
+		}
+		return s
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte("k8s\x00")), bytes.HasPrefix(bytes.TrimLeft(head, " \n"), []byte("{")):
+		return State{Type: "identity"}
+	default:
+		return State{Type: "unknown"}
+	}
+}
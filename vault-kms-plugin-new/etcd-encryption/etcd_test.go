@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want State
+	}{
+		{name: "kms v2", head: "k8s:enc:kms:v2:vault-kms:\x0a\x8b\x02", want: State{Type: "kms", Name: "vault-kms"}},
+		{name: "kms v1", head: "k8s:enc:kms:v1:vault-kms:\x00\x8b", want: State{Type: "kms", Name: "vault-kms"}},
+		{name: "aescbc", head: "k8s:enc:aescbc:v1:1:\x9f\x02", want: State{Type: "aescbc", Name: "1"}},
+		{name: "aesgcm", head: "k8s:enc:aesgcm:v1:key-2:\x01", want: State{Type: "aesgcm", Name: "key-2"}},
+		{name: "truncated prefix", head: "k8s:enc:secretbox", want: State{Type: "secretbox"}},
+		{name: "protobuf", head: "k8s\x00\x0a\x0c\x0a\x02v1\x12\x06Secret", want: State{Type: "identity"}},
+		{name: "CRD JSON", head: `{"apiVersion":"example.com/v1","kind":"Widget"}`, want: State{Type: "identity"}},
+		{name: "JSON after whitespace", head: "\n  {\"kind\":\"Widget\"}", want: State{Type: "identity"}},
+		{name: "garbage", head: "\xde\xad\xbe\xef", want: State{Type: "unknown"}},
+		{name: "empty", head: "", want: State{Type: "unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify([]byte(tt.head)); got != tt.want {
+				t.Errorf("Classify(%q) = %+v, want %+v", tt.head, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "/kubernetes.io/secrets/", want: "/kubernetes.io/secrets0"},
+		{prefix: "a\xff", want: "b"},
+		{prefix: "\xff\xff", want: "\x00"},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); got != tt.want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
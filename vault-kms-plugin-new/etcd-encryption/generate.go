@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// generateConfig renders an EncryptionConfiguration that writes the given
+// resources with a KMS v2 provider and still reads identity (plaintext)
+// data, so it can be applied before the existing data is migrated.
+func generateConfig(mappings []Mapping, server APIServer, kms KMSConfig, identityFallback bool) ([]byte, []string, error) {
+	var resources, skipped []string
+	for _, m := range mappings {
+		if m.APIServer != server {
+			skipped = append(skipped, fmt.Sprintf("%s (stored by %s)", m, m.APIServer))
+			continue
+		}
+		resources = append(resources, m.String())
+	}
+	if len(resources) == 0 {
+		return nil, skipped, fmt.Errorf("none of the resources are stored by %s", server)
+	}
+
+	kms.APIVersion = "v2"
+	providers := []ProviderConfig{{KMS: &kms}}
+	if identityFallback {
+		providers = append(providers, ProviderConfig{Identity: &struct{}{}})
+	}
+	cfg := EncryptionConfiguration{
+		Kind:       "EncryptionConfiguration",
+		APIVersion: "apiserver.config.k8s.io/v1",
+		Resources:  []ResourceConfiguration{{Resources: resources, Providers: providers}},
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, skipped, err
+	}
+	header := fmt.Sprintf("# EncryptionConfiguration for %s covering: %s\n", server, strings.Join(resources, ", "))
+	return append([]byte(header), data...), skipped, nil
+}
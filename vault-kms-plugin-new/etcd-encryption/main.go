@@ -0,0 +1,298 @@
+// etcd-encryption: etcd encryption tooling for arbitrary resource types.
+//
+// kms-key-loss-test.sh and etcd-backup-restore-kms.sh only look at secrets
+// and configmaps under /kubernetes.io/<resource>/. Customers also encrypt
+// routes, OAuth tokens and their own CRDs, and those live under other etcd
+// prefixes (/openshift.io/routes/, /kubernetes.io/<group>/<plural>/ for
+// CRDs, ...). This tool takes any list of group/resources, maps each to
+// its etcd prefix and the apiserver that stores it, and:
+//
+//	prefixes  prints the mapping
+//	coverage  scans etcd and reports, per resource, how many objects are
+//	          stored with the expected provider (kms by default)
+//	generate  renders an EncryptionConfiguration with a KMS v2 provider
+//
+// Prefixes come from, in order: a mapping file (--mapping), CRDs and
+// APIServices discovered from the cluster, a builtin table of resources
+// with non-standard keys, and finally the group naming rules.
+//
+// Usage:
+//
+//	etcd-encryption coverage                               # what the apiserver is configured to encrypt
+//	etcd-encryption coverage --resources secrets,widgets.example.com --json coverage.json
+//	etcd-encryption prefixes --resources-file resources.txt --mapping resource-prefixes.map
+//	etcd-encryption generate --resources secrets,configmaps,widgets.example.com --kms-name vault
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch os.Args[1] {
+	case "prefixes":
+		err = runPrefixes(ctx, os.Args[2:])
+	case "coverage":
+		err = runCoverage(ctx, os.Args[2:])
+	case "generate":
+		err = runGenerate(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sError:%s %v\n", report.Red, report.Reset, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s prefixes|coverage|generate [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+// resourceFlags select resources and how they map to etcd.
+type resourceFlags struct {
+	resources     *string
+	resourcesFile *string
+	mapping       *string
+	kubeconfig    *string
+	offline       *bool
+}
+
+func addResourceFlags(fs *flag.FlagSet, allowOffline bool) resourceFlags {
+	f := resourceFlags{
+		resources:     fs.String("resources", "", "Comma-separated resources, e.g. secrets,routes.route.openshift.io,widgets.example.com"),
+		resourcesFile: fs.String("resources-file", "", "File with one resource per line (# comments allowed)"),
+		mapping:       fs.String("mapping", "", "Resource to etcd prefix mapping file (see resource-prefixes.map)"),
+		kubeconfig:    fs.String("kubeconfig", "", "Cluster kubeconfig (default: current oc login)"),
+	}
+	offline := false
+	f.offline = &offline
+	if allowOffline {
+		f.offline = fs.Bool("offline", false, "Do not query the cluster for CRDs and APIServices")
+	}
+	return f
+}
+
+// list returns the resources given with --resources/--resources-file.
+func (f resourceFlags) list() ([]GroupResource, error) {
+	items := []string{*f.resources}
+	if *f.resourcesFile != "" {
+		lines, err := readResourcesFile(*f.resourcesFile)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, lines...)
+	}
+	return ParseResourceList(items)
+}
+
+func (f resourceFlags) resolver(ctx context.Context, c oc) (*Resolver, error) {
+	r := &Resolver{}
+	if *f.mapping != "" {
+		overrides, err := LoadMappingFile(*f.mapping)
+		if err != nil {
+			return nil, err
+		}
+		r.Overrides = overrides
+	}
+	if !*f.offline {
+		d, err := discover(ctx, c)
+		if err != nil {
+			return nil, fmt.Errorf("discovery failed (use --offline to skip): %w", err)
+		}
+		r.Discovery = d
+	}
+	return r, nil
+}
+
+// warnUnserved flags resources the cluster does not serve, usually a typo
+// or a CRD that is not installed.
+func warnUnserved(r *Resolver, grs []GroupResource, rep *report.Reporter) {
+	if r.Discovery == nil {
+		return
+	}
+	for _, gr := range grs {
+		if !r.Discovery.Served[gr] {
+			rep.Warn("%s is not served by this cluster", gr)
+		}
+	}
+}
+
+func runPrefixes(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("prefixes", flag.ExitOnError)
+	rf := addResourceFlags(fs, true)
+	_ = fs.Parse(args)
+
+	grs, err := rf.list()
+	if err != nil {
+		return err
+	}
+	if len(grs) == 0 {
+		grs, _ = ParseResourceList(defaultResources)
+	}
+	c := oc{kubeconfig: *rf.kubeconfig}
+	res, err := rf.resolver(ctx, c)
+	if err != nil {
+		return err
+	}
+	warnUnserved(res, grs, &report.Reporter{})
+
+	fmt.Printf("%-45s %-20s %-50s %s\n", "RESOURCE", "APISERVER", "ETCD PREFIX", "SOURCE")
+	for _, gr := range grs {
+		m := res.Resolve(gr)
+		fmt.Printf("%-45s %-20s %-50s %s\n", m, m.APIServer, m.Prefix, m.Source)
+	}
+	return nil
+}
+
+func runCoverage(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	rf := addResourceFlags(fs, false)
+	fromCluster := fs.Bool("from-cluster", false, "Also check every resource in the apiservers' EncryptionConfigurations (default when --resources is not given)")
+	expect := fs.String("expect", "kms", "Provider type objects of listed resources must be stored with (kms, aescbc, aesgcm, identity)")
+	etcdPod := fs.String("etcd-pod", "", "etcd pod to exec into (default: first pod with app=etcd)")
+	jsonOut := fs.String("json", "", "Write the coverage report as JSON to this file")
+	_ = fs.Parse(args)
+
+	listed, err := rf.list()
+	if err != nil {
+		return err
+	}
+	if len(listed) == 0 {
+		*fromCluster = true
+	}
+
+	c := oc{kubeconfig: *rf.kubeconfig}
+	res, err := rf.resolver(ctx, c)
+	if err != nil {
+		return err
+	}
+	r := &report.Reporter{}
+	warnUnserved(res, listed, r)
+
+	var targets []Target
+	seen := map[GroupResource]bool{}
+	if *fromCluster {
+		configured, err := configuredResources(ctx, c)
+		if err != nil {
+			return err
+		}
+		if len(configured) == 0 {
+			r.Warn("no apiserver EncryptionConfiguration encrypts any resource")
+		}
+		inConfig := map[GroupResource]bool{}
+		for _, cr := range configured {
+			inConfig[cr.GroupResource] = true
+			if seen[cr.GroupResource] {
+				continue
+			}
+			seen[cr.GroupResource] = true
+			m := res.Resolve(cr.GroupResource)
+			// The config secret says which apiserver stores it.
+			m.APIServer = cr.APIServer
+			yes := true
+			targets = append(targets, Target{Mapping: m, Expected: cr.Provider, Configured: &yes})
+		}
+		for _, gr := range listed {
+			if seen[gr] {
+				continue
+			}
+			seen[gr] = true
+			covered := inConfig[gr]
+			targets = append(targets, Target{Mapping: res.Resolve(gr), Expected: *expect, Configured: &covered})
+		}
+	} else {
+		for _, gr := range listed {
+			targets = append(targets, Target{Mapping: res.Resolve(gr), Expected: *expect})
+		}
+	}
+
+	db, err := connectEtcd(ctx, c, *etcdPod)
+	if err != nil {
+		return err
+	}
+	r.Info("using etcd pod %s (container %s)", db.pod, db.container)
+
+	r.Section("etcd Encryption Coverage")
+	results := scanCoverage(ctx, db, targets, r)
+	printCoverageTable(results)
+	if *jsonOut != "" {
+		if err := writeCoverage(*jsonOut, results); err != nil {
+			return err
+		}
+		r.Info("coverage report written to %s", *jsonOut)
+	}
+	r.Summary()
+	if r.Fail > 0 {
+		return fmt.Errorf("%d resource(s) not fully encrypted", r.Fail)
+	}
+	return nil
+}
+
+func runGenerate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	rf := addResourceFlags(fs, true)
+	server := fs.String("apiserver", string(KubeAPIServer), "Render the config for this apiserver: kube-apiserver, openshift-apiserver or oauth-apiserver")
+	kmsName := fs.String("kms-name", "vault-kms", "KMS provider name")
+	endpoint := fs.String("endpoint", "unix:///var/run/kmsplugin/kms.sock", "KMS plugin socket")
+	timeout := fs.Duration("timeout", 10*time.Second, "KMS call timeout")
+	identity := fs.Bool("identity-fallback", true, "Keep identity as a read provider so existing plaintext data stays readable")
+	out := fs.String("out", "", "Write to this file instead of stdout")
+	_ = fs.Parse(args)
+
+	if _, ok := encryptionConfigSecrets[APIServer(*server)]; !ok {
+		return fmt.Errorf("unknown --apiserver %q", *server)
+	}
+	grs, err := rf.list()
+	if err != nil {
+		return err
+	}
+	if len(grs) == 0 {
+		return fmt.Errorf("--resources or --resources-file is required")
+	}
+	res, err := rf.resolver(ctx, oc{kubeconfig: *rf.kubeconfig})
+	if err != nil {
+		return err
+	}
+	mappings := make([]Mapping, 0, len(grs))
+	for _, gr := range grs {
+		mappings = append(mappings, res.Resolve(gr))
+	}
+
+	data, skipped, err := generateConfig(mappings, APIServer(*server), KMSConfig{
+		Name:     *kmsName,
+		Endpoint: *endpoint,
+		Timeout:  timeout.String(),
+	}, *identity)
+	for _, s := range skipped {
+		fmt.Fprintf(os.Stderr, "%s[WARN]%s  skipping %s\n", report.Yellow, report.Reset, s)
+	}
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s[INFO]%s  wrote %s for %s\n", report.Blue, report.Reset, *out, *server)
+	return nil
+}
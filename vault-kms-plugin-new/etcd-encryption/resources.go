@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GroupResource is a resource as written in an EncryptionConfiguration:
+// "secrets" for the core group, "<resource>.<group>" otherwise.
+type GroupResource struct {
+	Group    string
+	Resource string
+}
+
+// ParseGroupResource parses "secrets" or "routes.route.openshift.io".
+func ParseGroupResource(s string) (GroupResource, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" || strings.ContainsAny(s, " /*") {
+		return GroupResource{}, fmt.Errorf("invalid resource %q (want <resource> or <resource>.<group>)", s)
+	}
+	resource, group, _ := strings.Cut(s, ".")
+	return GroupResource{Group: group, Resource: resource}, nil
+}
+
+func (gr GroupResource) String() string {
+	if gr.Group == "" {
+		return gr.Resource
+	}
+	return gr.Resource + "." + gr.Group
+}
+
+// APIServer is the server that stores a resource and therefore reads the
+// EncryptionConfiguration that covers it.
+type APIServer string
+
+const (
+	KubeAPIServer      APIServer = "kube-apiserver"
+	OpenShiftAPIServer APIServer = "openshift-apiserver"
+	OAuthAPIServer     APIServer = "oauth-apiserver"
+)
+
+// encryptionConfigSecrets are the rendered EncryptionConfigurations in
+// openshift-config-managed, one per apiserver.
+var encryptionConfigSecrets = map[APIServer]string{
+	KubeAPIServer:      "encryption-config-openshift-kube-apiserver",
+	OpenShiftAPIServer: "encryption-config-openshift-apiserver",
+	OAuthAPIServer:     "encryption-config-openshift-oauth-apiserver",
+}
+
+// defaultResources is what OpenShift encrypts when spec.encryption is set
+// on the APIServer resource.
+var defaultResources = []string{
+	"secrets",
+	"configmaps",
+	"routes.route.openshift.io",
+	"oauthaccesstokens.oauth.openshift.io",
+	"oauthauthorizetokens.oauth.openshift.io",
+}
+
+// Mapping is where a resource lives in etcd and who stores it.
+type Mapping struct {
+	GroupResource
+	Prefix    string
+	APIServer APIServer
+	// Source says how the prefix was found: mapping-file, crd, builtin,
+	// apiservice or default.
+	Source string
+}
+
+// builtinPrefixesFile is shared with kms-key-loss-test.sh.
+//
+//go:embed builtin-prefixes.map
+var builtinPrefixesFile string
+
+// builtinPrefixes are resources whose etcd key does not follow the group
+// rules, and the group rules themselves (Resource "*").
+var builtinPrefixes = func() map[GroupResource]Mapping {
+	m, err := parseMappings(strings.NewReader(builtinPrefixesFile), "builtin-prefixes.map", "builtin")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}()
+
+// Resolver maps resources to etcd prefixes. Lookups go, in order: the
+// mapping file, CRDs from discovery, the builtin table, aggregated
+// APIServices from discovery, then the builtin group rules.
+type Resolver struct {
+	// Overrides come from --mapping.
+	Overrides map[GroupResource]Mapping
+	// Discovery is nil when running offline.
+	Discovery *Discovery
+}
+
+func (r *Resolver) Resolve(gr GroupResource) Mapping {
+	if m, ok := r.Overrides[gr]; ok {
+		return m
+	}
+	if m, ok := groupRule(r.Overrides, gr); ok {
+		return m
+	}
+	if r.Discovery != nil && r.Discovery.CRDs[gr] {
+		return Mapping{GroupResource: gr, Prefix: "/kubernetes.io/" + gr.Group + "/" + gr.Resource + "/", APIServer: KubeAPIServer, Source: "crd"}
+	}
+	if m, ok := builtinPrefixes[gr]; ok {
+		return m
+	}
+	if r.Discovery != nil {
+		if server, ok := r.Discovery.Aggregated[gr.Group]; ok {
+			return Mapping{GroupResource: gr, Prefix: "/openshift.io/" + gr.Resource + "/", APIServer: server, Source: "apiservice"}
+		}
+	}
+	if m, ok := groupRule(builtinPrefixes, gr); ok {
+		m.Source = "default"
+		return m
+	}
+	// Anything else is assumed to be a CRD.
+	return Mapping{GroupResource: gr, Prefix: "/kubernetes.io/" + gr.Group + "/" + gr.Resource + "/", APIServer: KubeAPIServer, Source: "default"}
+}
+
+// groupRule applies the "*.<group>" entry of table to gr.
+func groupRule(table map[GroupResource]Mapping, gr GroupResource) (Mapping, bool) {
+	m, ok := table[GroupResource{Group: gr.Group, Resource: "*"}]
+	if !ok {
+		return Mapping{}, false
+	}
+	m.GroupResource = gr
+	m.Prefix = strings.Replace(m.Prefix, "*", gr.Resource, 1)
+	return m, true
+}
+
+// LoadMappingFile reads "<resource>[.<group>] <etcd-prefix> [apiserver]"
+// lines. Blank lines and lines starting with # are ignored. The apiserver
+// defaults to kube-apiserver. A resource of "*.<group>" (or "*" for the
+// core group) is a rule for the whole group, with * in the prefix standing
+// for the resource. kms-key-loss-test.sh reads the same format.
+func LoadMappingFile(path string) (map[GroupResource]Mapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mapping file: %w", err)
+	}
+	defer f.Close()
+	return parseMappings(f, path, "mapping-file")
+}
+
+func parseMappings(r io.Reader, name, source string) (map[GroupResource]Mapping, error) {
+	out := map[GroupResource]Mapping{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want \"<resource> <etcd-prefix> [apiserver]\"", name, n)
+		}
+		var gr GroupResource
+		if group, ok := strings.CutPrefix(fields[0], "*"); ok {
+			if group != "" && !strings.HasPrefix(group, ".") {
+				return nil, fmt.Errorf("%s:%d: invalid group rule %q (want * or *.<group>)", name, n, fields[0])
+			}
+			gr = GroupResource{Group: strings.ToLower(strings.TrimPrefix(group, ".")), Resource: "*"}
+		} else {
+			var err error
+			if gr, err = ParseGroupResource(fields[0]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+		}
+		prefix := fields[1]
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%s:%d: etcd prefix %q must start with /", name, n, prefix)
+		}
+		if (gr.Resource == "*") != (strings.Count(prefix, "*") == 1) {
+			return nil, fmt.Errorf("%s:%d: only a group rule has a prefix with one * for the resource", name, n)
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		server := KubeAPIServer
+		if len(fields) == 3 {
+			server = APIServer(fields[2])
+			if _, ok := encryptionConfigSecrets[server]; !ok {
+				return nil, fmt.Errorf("%s:%d: unknown apiserver %q", name, n, fields[2])
+			}
+		}
+		out[gr] = Mapping{GroupResource: gr, Prefix: prefix, APIServer: server, Source: source}
+	}
+	return out, scanner.Err()
+}
+
+// ParseResourceList parses a comma-separated list, de-duplicating and
+// keeping the order.
+func ParseResourceList(list []string) ([]GroupResource, error) {
+	var out []GroupResource
+	seen := map[GroupResource]bool{}
+	for _, item := range list {
+		for _, s := range strings.Split(item, ",") {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			gr, err := ParseGroupResource(s)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[gr] {
+				seen[gr] = true
+				out = append(out, gr)
+			}
+		}
+	}
+	return out, nil
+}
+
+// readResourcesFile reads one resource per line, # comments allowed.
+func readResourcesFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resources file: %w", err)
+	}
+	var out []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+func sortedServers[V any](m map[APIServer]V) []APIServer {
+	out := make([]APIServer, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
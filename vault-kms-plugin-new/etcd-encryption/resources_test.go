@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolverResolve(t *testing.T) {
+	overrides, err := parseMappings(strings.NewReader(`
+gadgets.example.com   /exact/gadgets/
+*.example.com         /rule/*/
+secrets               /override/secrets/
+`), "overrides", "mapping-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovery := &Discovery{
+		CRDs: map[GroupResource]bool{
+			{Group: "example.com", Resource: "widgets"}:                              true,
+			{Group: "security.openshift.io", Resource: "securitycontextconstraints"}: true,
+			{Group: "route.openshift.io", Resource: "routes"}:                        true,
+		},
+		Aggregated: map[string]APIServer{
+			"apps.openshift.io":  OpenShiftAPIServer,
+			"metrics.k8s.io":     OpenShiftAPIServer,
+			"oauth.openshift.io": OAuthAPIServer,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		resolver   Resolver
+		resource   string
+		wantPrefix string
+		wantServer APIServer
+		wantSource string
+	}{
+		{
+			name:       "override exact entry",
+			resolver:   Resolver{Overrides: overrides, Discovery: discovery},
+			resource:   "gadgets.example.com",
+			wantPrefix: "/exact/gadgets/", wantServer: KubeAPIServer, wantSource: "mapping-file",
+		},
+		{
+			name:       "override group rule beats a CRD",
+			resolver:   Resolver{Overrides: overrides, Discovery: discovery},
+			resource:   "widgets.example.com",
+			wantPrefix: "/rule/widgets/", wantServer: KubeAPIServer, wantSource: "mapping-file",
+		},
+		{
+			name:       "override beats the builtin table",
+			resolver:   Resolver{Overrides: overrides},
+			resource:   "secrets",
+			wantPrefix: "/override/secrets/", wantServer: KubeAPIServer, wantSource: "mapping-file",
+		},
+		{
+			name:       "CRD beats the builtin table",
+			resolver:   Resolver{Discovery: discovery},
+			resource:   "routes.route.openshift.io",
+			wantPrefix: "/kubernetes.io/route.openshift.io/routes/", wantServer: KubeAPIServer, wantSource: "crd",
+		},
+		{
+			name:       "builtin exact entry",
+			resolver:   Resolver{},
+			resource:   "routes.route.openshift.io",
+			wantPrefix: "/openshift.io/routes/", wantServer: OpenShiftAPIServer, wantSource: "builtin",
+		},
+		{
+			name:       "builtin exact entry beats an aggregated group",
+			resolver:   Resolver{Discovery: discovery},
+			resource:   "oauthaccesstokens.oauth.openshift.io",
+			wantPrefix: "/openshift.io/oauth/accesstokens/", wantServer: OAuthAPIServer, wantSource: "builtin",
+		},
+		{
+			name:       "aggregated APIService",
+			resolver:   Resolver{Discovery: discovery},
+			resource:   "nodemetrics.metrics.k8s.io",
+			wantPrefix: "/openshift.io/nodemetrics/", wantServer: OpenShiftAPIServer, wantSource: "apiservice",
+		},
+		{
+			name:       "aggregated APIService beats a builtin group rule",
+			resolver:   Resolver{Discovery: discovery},
+			resource:   "deploymentconfigs.apps.openshift.io",
+			wantPrefix: "/openshift.io/deploymentconfigs/", wantServer: OpenShiftAPIServer, wantSource: "apiservice",
+		},
+		{
+			name:       "builtin group rule offline",
+			resolver:   Resolver{},
+			resource:   "deploymentconfigs.apps.openshift.io",
+			wantPrefix: "/openshift.io/deploymentconfigs/", wantServer: OpenShiftAPIServer, wantSource: "default",
+		},
+		{
+			name:       "builtin core group rule",
+			resolver:   Resolver{},
+			resource:   "configmaps",
+			wantPrefix: "/kubernetes.io/configmaps/", wantServer: KubeAPIServer, wantSource: "default",
+		},
+		{
+			name:       "builtin non-standard key",
+			resolver:   Resolver{},
+			resource:   "services",
+			wantPrefix: "/kubernetes.io/services/specs/", wantServer: KubeAPIServer, wantSource: "builtin",
+		},
+		{
+			name:       "SCCs are CRDs even offline",
+			resolver:   Resolver{},
+			resource:   "securitycontextconstraints.security.openshift.io",
+			wantPrefix: "/kubernetes.io/security.openshift.io/securitycontextconstraints/", wantServer: KubeAPIServer, wantSource: "default",
+		},
+		{
+			name:       "ClusterResourceQuotas are CRDs even offline",
+			resolver:   Resolver{},
+			resource:   "clusterresourcequotas.quota.openshift.io",
+			wantPrefix: "/kubernetes.io/quota.openshift.io/clusterresourcequotas/", wantServer: KubeAPIServer, wantSource: "default",
+		},
+		{
+			name:       "unknown group defaults to a CRD",
+			resolver:   Resolver{Discovery: discovery},
+			resource:   "things.example.org",
+			wantPrefix: "/kubernetes.io/example.org/things/", wantServer: KubeAPIServer, wantSource: "default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gr, err := ParseGroupResource(tt.resource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tt.resolver.Resolve(gr)
+			if got.GroupResource != gr || got.Prefix != tt.wantPrefix || got.APIServer != tt.wantServer || got.Source != tt.wantSource {
+				t.Errorf("Resolve(%s) = %s %s (%s), want %s %s (%s)",
+					gr, got.Prefix, got.APIServer, got.Source, tt.wantPrefix, tt.wantServer, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestParseMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr string
+	}{
+		{name: "exact entry", line: "widgets.example.com /kubernetes.io/example.com/widgets"},
+		{name: "group rule", line: "*.example.com /custom/*/ openshift-apiserver"},
+		{name: "core group rule", line: "* /kubernetes.io/*/"},
+		{name: "relative prefix", line: "widgets.example.com kubernetes.io/widgets/", wantErr: "must start with /"},
+		{name: "rule without *", line: "*.example.com /custom/", wantErr: "only a group rule"},
+		{name: "* in an exact entry", line: "widgets.example.com /custom/*/", wantErr: "only a group rule"},
+		{name: "malformed rule", line: "*example.com /custom/*/", wantErr: "invalid group rule"},
+		{name: "unknown apiserver", line: "widgets.example.com /w/ kube-scheduler", wantErr: "unknown apiserver"},
+		{name: "missing prefix", line: "widgets.example.com", wantErr: "want"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMappings(strings.NewReader("# comment\n\n"+tt.line+"\n"), "test.map", "mapping-file")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("parseMappings(%q) error = %v", tt.line, err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("parseMappings(%q) error = %v, want %q", tt.line, err, tt.wantErr)
+			case err != nil && !strings.HasPrefix(err.Error(), "test.map:3:"):
+				t.Errorf("parseMappings(%q) error = %v, want the line number", tt.line, err)
+			}
+		})
+	}
+}
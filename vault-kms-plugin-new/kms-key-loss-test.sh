@@ -60,6 +60,19 @@
 #   ./kms-key-loss-test.sh --delete-etcd-secrets --dry-run
 #   ./kms-key-loss-test.sh --delete-etcd-secrets --all-namespaces --dry-run
 #
+#   # Count etcd keys for any resource types, including CRDs
+#   ./kms-key-loss-test.sh --scan-etcd --all-namespaces \
+#       --resources secrets,routes.route.openshift.io,widgets.example.com
+#
+# Resources are given as <resource>[.<group>], as in an EncryptionConfiguration.
+# They are mapped to etcd key prefixes by etcd_prefix_for, in the same order
+# as etcd-encryption: a --prefix-map file (see
+# etcd-encryption/resource-prefixes.map), installed CRDs, the table
+# etcd-encryption uses (etcd-encryption/builtin-prefixes.map), aggregated
+# APIServices, then the table's group rules. A resource
+# given with --resources that has no keys fails the scan. To check how each
+# object is encrypted, use etcd-encryption/ (coverage subcommand).
+#
 # Environment variables (for cloud Vault):
 #   VAULT_ADDR        - Vault server address
 #   VAULT_TOKEN       - Vault token with admin permissions
@@ -97,6 +110,9 @@ SKIP_CONFIRM="false"
 INVENTORY_DIR="/tmp/kms-key-loss-test-$(date +%Y%m%d_%H%M%S)"
 DRY_RUN="false"
 ALL_NAMESPACES="false"
+SCAN_RESOURCES=""
+PREFIX_MAP_FILE="${PREFIX_MAP_FILE:-}"
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
 
 # OpenShift namespaces with critical operator-managed resources
 # These are namespaces where operators will recreate secrets/configmaps
@@ -152,10 +168,13 @@ OPERATOR_NAMESPACES=(
     "openshift-service-ca-operator"
 )
 
-# Resource types that are encrypted by default in OpenShift etcd
+# Resource types scanned by --scan-etcd unless --resources is given
 ENCRYPTED_RESOURCE_TYPES=(
     "secrets"
     "configmaps"
+    "routes.route.openshift.io"
+    "oauthaccesstokens.oauth.openshift.io"
+    "oauthauthorizetokens.oauth.openshift.io"
 )
 
 # Logging helpers
@@ -214,6 +233,18 @@ while [[ $# -gt 0 ]]; do
             ACTION="delete-etcd-configmaps"
             shift
             ;;
+        --scan-etcd)
+            ACTION="scan-etcd"
+            shift
+            ;;
+        --resources)
+            SCAN_RESOURCES="$2"
+            shift 2
+            ;;
+        --prefix-map)
+            PREFIX_MAP_FILE="$2"
+            shift 2
+            ;;
         --vault-addr)
             VAULT_ADDR="$2"
             shift 2
@@ -273,6 +304,7 @@ while [[ $# -gt 0 ]]; do
             echo "  --delete-etcd-secrets    Delete secrets directly from etcd via etcdctl"
             echo "  --delete-etcd-configmaps Delete configmaps directly from etcd via etcdctl"
             echo "    (add --all-namespaces to delete from ALL namespaces, not just operator ones)"
+            echo "  --scan-etcd              Count etcd keys per resource type (see --resources)"
             echo ""
             echo "Options:"
             echo "  --vault-addr ADDR      Vault server address (or set VAULT_ADDR)"
@@ -282,7 +314,10 @@ while [[ $# -gt 0 ]]; do
             echo "  --vault-namespace NS   Vault namespace (or set VAULT_NAMESPACE)"
             echo "  --key-name NAME        Transit key name (default: kms-key)"
             echo "  --skip-tls-verify      Skip TLS verification for Vault"
-            echo "  --all-namespaces       Delete from ALL namespaces (with --delete-etcd-*)"
+            echo "  --all-namespaces       Delete/scan ALL namespaces (with --delete-etcd-*, --scan-etcd)"
+            echo "  --resources LIST       Comma-separated resources for --scan-etcd, e.g."
+            echo "                         secrets,routes.route.openshift.io,widgets.example.com"
+            echo "  --prefix-map FILE      Resource to etcd prefix mapping file (or set PREFIX_MAP_FILE)"
             echo "  --dry-run              Show what would be deleted without deleting"
             echo "  --yes, -y              Skip confirmation prompts"
             echo ""
@@ -1621,6 +1656,7 @@ get_etcd_pod_and_env() {
 # Global variables used by scan/delete helpers (bash 3.2 compatible, no namerefs)
 SCANNED_KEYS=()
 SCANNED_TOTAL=0
+SCANNED_PREFIX=""
 
 # Helper: run etcdctl command in the detected container
 run_etcdctl() {
@@ -1637,36 +1673,125 @@ run_etcdctl() {
     fi
 }
 
+# ============================================================================
+# Helper: Map a resource (<resource>[.<group>]) to its etcd key prefix
+# Same lookup order as the etcd-encryption Resolver: mapping file (exact
+# entry, then group rule), CRDs, the exact entries of
+# etcd-encryption/builtin-prefixes.map (the table etcd-encryption embeds),
+# aggregated APIServices, the table's group rules, then the CRD default.
+# ============================================================================
+BUILTIN_PREFIX_FILE="$SCRIPT_DIR/etcd-encryption/builtin-prefixes.map"
+
+# lookup_prefix FILE RESOURCE GROUP exact|rule prints the exact entry for
+# <resource>[.<group>] in a mapping file, or the group's "*.<group>" rule
+# with * replaced by the resource.
+lookup_prefix() {
+    awk -v res="$2" -v group="$3" -v kind="$4" '
+        /^[ \t]*#/ || NF < 2 { next }
+        { gr = (group == "") ? res : res "." group; rule = (group == "") ? "*" : "*." group }
+        kind == "exact" && $1 == gr   { found = $2 }
+        kind == "rule"  && $1 == rule { found = $2; sub(/\*/, res, found) }
+        END { if (found != "") print found }' "$1" 2>/dev/null || true
+}
+
+# is_aggregated_group GROUP is true if GROUP is served through an
+# APIService backed by openshift-apiserver or oauth-apiserver, which store
+# their resources under /openshift.io/.
+is_aggregated_group() {
+    oc get apiservices -o jsonpath='{range .items[*]}{.spec.group}{" "}{.spec.service.namespace}{"\n"}{end}' 2>/dev/null |
+        awk -v group="$1" '$1 == group && ($2 == "openshift-apiserver" || $2 == "openshift-oauth-apiserver") { found = 1 }
+            END { exit !found }'
+}
+
+etcd_prefix_for() {
+    local gr="$1"
+    local resource="${gr%%.*}"
+    local group=""
+    [ "$gr" != "$resource" ] && group="${gr#*.}"
+
+    local mapped="" kind
+    if [ -n "$PREFIX_MAP_FILE" ]; then
+        for kind in exact rule; do
+            mapped=$(lookup_prefix "$PREFIX_MAP_FILE" "$resource" "$group" "$kind")
+            if [ -n "$mapped" ]; then
+                echo "${mapped%/}/"
+                return
+            fi
+        done
+    fi
+
+    if [ -n "$group" ] && oc get crd "$gr" &>/dev/null; then
+        echo "/kubernetes.io/${group}/${resource}/"
+        return
+    fi
+
+    mapped=$(lookup_prefix "$BUILTIN_PREFIX_FILE" "$resource" "$group" exact)
+    if [ -n "$mapped" ]; then
+        echo "${mapped%/}/"
+        return
+    fi
+
+    if [ -n "$group" ] && is_aggregated_group "$group"; then
+        echo "/openshift.io/${resource}/"
+        return
+    fi
+
+    mapped=$(lookup_prefix "$BUILTIN_PREFIX_FILE" "$resource" "$group" rule)
+    if [ -n "$mapped" ]; then
+        echo "${mapped%/}/"
+        return
+    fi
+    echo "/kubernetes.io/${group}/${resource}/"
+}
+
+# Helper: true if the resource is namespaced (cluster-scoped keys have no
+# namespace segment)
+is_namespaced_resource() {
+    oc api-resources --namespaced=true -o name 2>/dev/null | grep -qx "$1"
+}
+
 # ============================================================================
 # Helper: Scan etcd for resource keys
-# Sets: SCANNED_KEYS (array), SCANNED_TOTAL (int)
+# Sets: SCANNED_KEYS (array), SCANNED_TOTAL (int), SCANNED_PREFIX (string)
 # ============================================================================
 scan_etcd_keys() {
-    local resource_type="$1"  # "secrets" or "configmaps"
+    local resource_type="$1"  # <resource>[.<group>], e.g. "secrets" or "widgets.example.com"
     local scope="$2"          # "operator" or "all"
 
     SCANNED_KEYS=()
     SCANNED_TOTAL=0
+    SCANNED_PREFIX=$(etcd_prefix_for "$resource_type")
+    local file_tag="${resource_type//./_}"
+    local namespaced="true"
+
+    if ! is_namespaced_resource "$resource_type"; then
+        namespaced="false"
+        if [ "$scope" != "all" ]; then
+            log_info "$resource_type is cluster-scoped — scanning all keys"
+            scope="all"
+        fi
+    fi
 
     if [ "$scope" = "all" ]; then
         log_step "Scanning etcd for ALL $resource_type (every namespace)"
 
-        local etcd_prefix="/kubernetes.io/${resource_type}/"
+        local etcd_prefix="$SCANNED_PREFIX"
         log_cmd "etcdctl get '$etcd_prefix' --prefix --keys-only"
         local keys
         keys=$(run_etcdctl get "$etcd_prefix" --prefix --keys-only 2>/dev/null | grep -v '^$' || echo "")
 
         if [ -n "$keys" ]; then
             SCANNED_TOTAL=$(echo "$keys" | wc -l | tr -d ' ')
-            echo "$keys" >> "$INVENTORY_DIR/etcd-${resource_type}-all-keys.txt"
+            echo "$keys" >> "$INVENTORY_DIR/etcd-${file_tag}-all-keys.txt"
 
             local current_ns=""
             local ns_count=0
             while IFS= read -r key; do
                 [ -z "$key" ] && continue
                 SCANNED_KEYS+=("$key")
+                [ "$namespaced" = "true" ] || continue
                 local ns
-                ns=$(echo "$key" | sed "s|/kubernetes.io/${resource_type}/||" | cut -d'/' -f1)
+                ns=$(echo "${key#"$etcd_prefix"}" | cut -d'/' -f1)
                 if [ "$ns" != "$current_ns" ]; then
                     [ -n "$current_ns" ] && echo "  $current_ns: $ns_count $resource_type"
                     current_ns="$ns"
@@ -1685,7 +1810,7 @@ scan_etcd_keys() {
                 continue
             fi
 
-            local etcd_prefix="/kubernetes.io/${resource_type}/${ns}/"
+            local etcd_prefix="${SCANNED_PREFIX}${ns}/"
             log_cmd "etcdctl get '$etcd_prefix' --prefix --keys-only"
             local keys
             keys=$(run_etcdctl get "$etcd_prefix" --prefix --keys-only 2>/dev/null | grep -v '^$' || echo "")
@@ -1695,7 +1820,7 @@ scan_etcd_keys() {
                 count=$(echo "$keys" | wc -l | tr -d ' ')
                 SCANNED_TOTAL=$((SCANNED_TOTAL + count))
                 echo "  $ns: $count $resource_type"
-                echo "$keys" >> "$INVENTORY_DIR/etcd-${resource_type}-keys.txt"
+                echo "$keys" >> "$INVENTORY_DIR/etcd-${file_tag}-keys.txt"
 
                 while IFS= read -r key; do
                     [ -z "$key" ] && continue
@@ -1721,7 +1846,7 @@ delete_etcd_keys() {
     for key in "${SCANNED_KEYS[@]}"; do
         [ -z "$key" ] && continue
         local short_key
-        short_key=$(echo "$key" | sed "s|/kubernetes.io/${resource_type}/||")
+        short_key="${key#"$SCANNED_PREFIX"}"
         log_cmd "etcdctl del '$key'"
 
         local del_result
@@ -1930,6 +2055,57 @@ delete_etcd_configmaps() {
     fi
 }
 
+# ============================================================================
+# Scan etcd: count keys for any resource types (--resources)
+# ============================================================================
+scan_etcd() {
+    local scope="operator"
+    [ "$ALL_NAMESPACES" = "true" ] && scope="all"
+
+    local resources=("${ENCRYPTED_RESOURCE_TYPES[@]}")
+    if [ -n "$SCAN_RESOURCES" ]; then
+        IFS=',' read -r -a resources <<< "$SCAN_RESOURCES"
+    fi
+
+    log_header "etcd Key Scan (scope: $scope)"
+    [ -n "$PREFIX_MAP_FILE" ] && log_info "Prefix map: $PREFIX_MAP_FILE"
+    echo ""
+
+    get_etcd_pod_and_env
+
+    local summary=""
+    local empty=()
+    for resource_type in "${resources[@]}"; do
+        resource_type=$(echo "$resource_type" | tr -d ' ')
+        [ -z "$resource_type" ] && continue
+        if ! oc api-resources -o name 2>/dev/null | grep -qx "$resource_type"; then
+            log_warn "$resource_type is not served by this cluster (typo or CRD not installed?)"
+        fi
+        scan_etcd_keys "$resource_type" "$scope"
+        summary="${summary}$(printf "%-50s %-45s %8s" "$resource_type" "$SCANNED_PREFIX" "$SCANNED_TOTAL")\n"
+        # An asked-for resource with no keys usually means a wrong prefix,
+        # not an empty resource.
+        if [ -n "$SCAN_RESOURCES" ] && [ "$SCANNED_TOTAL" -eq 0 ]; then
+            log_error "No etcd keys under $SCANNED_PREFIX for $resource_type (wrong prefix? see --prefix-map)"
+            empty+=("$resource_type")
+        fi
+        echo ""
+    done
+
+    log_header "etcd Key Counts"
+    printf "%-50s %-45s %8s\n" "RESOURCE" "ETCD PREFIX" "KEYS"
+    printf "$summary"
+    echo ""
+    log_info "Key lists saved to $INVENTORY_DIR/etcd-*-keys.txt"
+    log_info "For per-object encryption state, run:"
+    echo "    etcd-encryption/etcd-encryption coverage --resources $(IFS=','; echo "${resources[*]}")"
+
+    if [ ${#empty[@]} -gt 0 ]; then
+        log_error "No keys found for: ${empty[*]}"
+        exit 1
+    fi
+}
+
 # ============================================================================
 # Full Test
 # ============================================================================
@@ -2038,8 +2214,9 @@ main() {
         echo "  Direct etcd Deletion Tests:"
         echo "    9)  Delete secrets directly from etcd"
         echo "    10) Delete configmaps directly from etcd"
+        echo "    11) Scan etcd key counts (--resources, default: encrypted types)"
         echo ""
-        read -p "Enter choice [1-10]: " choice
+        read -p "Enter choice [1-11]: " choice
         case $choice in
             1) ACTION="full-test" ;;
             2) ACTION="inventory" ;;
@@ -2051,6 +2228,7 @@ main() {
             8) ACTION="recover-corrupted-key" ;;
             9) ACTION="delete-etcd-secrets" ;;
             10) ACTION="delete-etcd-configmaps" ;;
+            11) ACTION="scan-etcd" ;;
             *) echo "Invalid choice"; exit 1 ;;
         esac
     fi
@@ -2099,6 +2277,11 @@ main() {
             mkdir -p "$INVENTORY_DIR"
             delete_etcd_configmaps
             ;;
+        scan-etcd)
+            check_prerequisites
+            mkdir -p "$INVENTORY_DIR"
+            scan_etcd
+            ;;
         *)
             log_error "Unknown action: $ACTION"
             exit 1
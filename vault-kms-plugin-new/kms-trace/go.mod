@@ -0,0 +1,7 @@
+module github.com/gangwgr/kms-trace
+
+go 1.25.0
+
+require github.com/gangwgr/report v0.0.0
+
+replace github.com/gangwgr/report => ../../report
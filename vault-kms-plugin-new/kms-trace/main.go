@@ -0,0 +1,274 @@
+// kms-trace: joins kube-apiserver, KMS plugin and Vault audit logs into
+// one trace per KMS operation.
+//
+// Explaining a failed secret write means finding the same operation in
+// three components' logs. They share one key: the uid the apiserver gives
+// every KMS RPC. The apiserver logs it at -v=6 with the object, the
+// plugin (mock-vault-kms --audit-log) records it as correlationId, and the
+// plugin sends it to Vault in the X-KMS-Correlation-ID header, which Vault
+// audits once the header is configured. kube-apiserver audit events carry
+// no uid; they are matched to the apiserver log by verb, object and time.
+//
+// Failed requests that never got a uid, such as writes refused because no
+// DEK could be generated, are listed with the KMS failures around them.
+//
+// Usage:
+//
+//	kms-trace --apiserver-log kas.log --apiserver-audit audit.log --plugin-audit plugin-audit.log --vault-audit vault-audit.log --failed
+//	kms-trace --apiserver-log kas.log --plugin-audit plugin-audit.log --object secrets/my-ns/db-password
+//	kms-trace --plugin-audit plugin-audit.log --vault-audit vault-audit.log --uid 6a1f... --json trace.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gangwgr/report"
+)
+
+func main() {
+	var apiserverLogs, auditLogs, pluginLogs, vaultLogs multiFlag
+	flag.Var(&apiserverLogs, "apiserver-log", "kube-apiserver log at -v=6 or higher (repeatable)")
+	flag.Var(&auditLogs, "apiserver-audit", "kube-apiserver audit log (repeatable)")
+	flag.Var(&pluginLogs, "plugin-audit", "KMS plugin audit log (repeatable)")
+	flag.Var(&vaultLogs, "vault-audit", "Vault file audit log, or a Vault pod log with audit to stdout (repeatable)")
+	uid := flag.String("uid", "", "Only the trace with this correlation ID")
+	object := flag.String("object", "", "Only traces touching this object, e.g. secrets/my-ns/db-password or my-ns/db-password")
+	failed := flag.Bool("failed", false, "Only failed traces")
+	window := flag.Duration("window", 5*time.Second, "Clock skew allowed when matching audit events and nearby failures")
+	year := flag.Int("year", time.Now().UTC().Year(), "Year for klog timestamps, which have none")
+	maxEntries := flag.Int("max-entries", 20, "Lines printed per component per trace (0 for all)")
+	jsonOut := flag.String("json", "", "Also write the traces as JSON to this file")
+	flag.Parse()
+
+	if err := run(apiserverLogs, auditLogs, pluginLogs, vaultLogs, *uid, *object, *failed, *window, *year, *maxEntries, *jsonOut); err != nil {
+		fmt.Fprintf(os.Stderr, "%sError:%s %v\n", report.Red, report.Reset, err)
+		os.Exit(1)
+	}
+}
+
+func run(apiserverLogs, auditLogs, pluginLogs, vaultLogs []string, uid, object string, failedOnly bool, window time.Duration, year, maxEntries int, jsonOut string) error {
+	if len(apiserverLogs)+len(pluginLogs)+len(vaultLogs) == 0 {
+		return fmt.Errorf("at least one of --apiserver-log, --plugin-audit or --vault-audit is required")
+	}
+	r := &report.Reporter{}
+	r.Section("Loading Logs")
+	var s sources
+	for _, p := range apiserverLogs {
+		entries, err := readApiserverLog(p, year)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		r.Info("apiserver log    %s: %d KMS entries", p, len(entries))
+		if len(entries) == 0 {
+			r.Warn("No KMS entries in %s; the apiserver logs them only at -v=6 or higher", p)
+		}
+		s.apiserver = append(s.apiserver, entries...)
+	}
+	for _, p := range auditLogs {
+		events, err := readAuditEvents(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		r.Info("apiserver audit  %s: %d completed requests", p, len(events))
+		s.audit = append(s.audit, events...)
+	}
+	for _, p := range pluginLogs {
+		records, err := readPluginAudit(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		r.Info("plugin audit     %s: %d RPCs", p, len(records))
+		if len(records) == 0 {
+			r.Warn("No audit records in %s; is mock-vault-kms running with --audit-log?", p)
+		}
+		s.plugin = append(s.plugin, records...)
+	}
+	for _, p := range vaultLogs {
+		entries, hmacHeaders, err := readVaultAudit(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		correlated := 0
+		for _, e := range entries {
+			if e.CorrelationID != "" {
+				correlated++
+			}
+		}
+		r.Info("vault audit      %s: %d requests, %d with a correlation ID", p, len(entries), correlated)
+		if hmacHeaders > 0 {
+			r.Warn("%d correlation ID(s) in %s are HMAC'd; run: vault write sys/config/auditing/request-headers/%s hmac=false", hmacHeaders, p, correlationHeader)
+		} else if len(entries) > 0 && correlated == 0 {
+			r.Warn("No request in %s has %s; run: vault write sys/config/auditing/request-headers/%s hmac=false", p, correlationHeader, correlationHeader)
+		}
+		s.vault = append(s.vault, entries...)
+	}
+
+	traces, orphans := join(s, window)
+	shown := filter(traces, uid, object, failedOnly)
+
+	r.Section(fmt.Sprintf("Traces (%d of %d)", len(shown), len(traces)))
+	for _, tr := range shown {
+		printTrace(tr, maxEntries)
+	}
+	if len(orphans) > 0 && uid == "" {
+		r.Section("Failed Requests Without a KMS Operation")
+		for _, o := range orphans {
+			if object != "" && !auditMentions(o.Request, object) {
+				continue
+			}
+			printOrphan(o)
+		}
+	}
+
+	r.Section("Summary")
+	failedCount, incomplete := 0, 0
+	for _, tr := range traces {
+		if tr.Failed {
+			failedCount++
+		}
+		if len(tr.Missing) > 0 {
+			incomplete++
+		}
+	}
+	r.Info("Operations: %d, failed: %d, failed requests without an operation: %d", len(traces), failedCount, len(orphans))
+	if incomplete > 0 {
+		r.Warn("%d operation(s) are missing from a component's log; the logs may cover different time ranges", incomplete)
+	}
+
+	if jsonOut != "" {
+		out, err := json.MarshalIndent(struct {
+			Traces  []*trace  `json:"traces"`
+			Orphans []*orphan `json:"failedRequestsWithoutOperation,omitempty"`
+		}{shown, orphans}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(jsonOut, out, 0o644); err != nil {
+			return err
+		}
+		r.Info("Traces written to %s", jsonOut)
+	}
+	return nil
+}
+
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+func printTrace(tr *trace, maxEntries int) {
+	state := report.Green + "OK" + report.Reset
+	if tr.Failed {
+		state = report.Red + "FAILED" + report.Reset
+	}
+	fmt.Printf("\n%s%s%s  %s  %s", report.Bold, tr.ID, report.Reset, tr.Start.UTC().Format(timeFormat), state)
+	if len(tr.Missing) > 0 {
+		fmt.Printf("  %s(not in %s log)%s", report.Yellow, strings.Join(tr.Missing, ", "), report.Reset)
+	}
+	fmt.Println()
+
+	limit := func(n int) int {
+		if maxEntries > 0 && n > maxEntries {
+			return maxEntries
+		}
+		return n
+	}
+	for _, ev := range tr.Requests[:limit(len(tr.Requests))] {
+		fmt.Printf("  %-9s  %s\n", "request", describeAudit(ev))
+	}
+	for _, e := range tr.Apiserver[:limit(len(tr.Apiserver))] {
+		line := e.Kind
+		if e.Key != "" {
+			line = fmt.Sprintf("%-12s %s", e.Kind, e.Key)
+		}
+		if e.Verb != "" {
+			line += fmt.Sprintf("  (%s %s)", e.Verb, objectName(e.Group, e.Resource, e.Namespace, e.Name))
+		}
+		fmt.Printf("  %-9s  %s  %s\n", "apiserver", e.Time.UTC().Format(timeFormat), line)
+	}
+	for _, p := range tr.Plugin[:limit(len(tr.Plugin))] {
+		line := fmt.Sprintf("%-12s %-16s %.1fms", p.Method, p.Code, p.DurationMS)
+		if p.QueueMS > 0 {
+			line += fmt.Sprintf(" (queued %.1fms)", p.QueueMS)
+		}
+		if p.KeyID != "" {
+			line += "  key " + p.KeyID
+		}
+		if p.Error != "" {
+			line += "  " + report.Red + p.Error + report.Reset
+		}
+		fmt.Printf("  %-9s  %s  %s\n", "plugin", p.Time.UTC().Format(timeFormat), line)
+	}
+	for _, v := range tr.Vault[:limit(len(tr.Vault))] {
+		line := fmt.Sprintf("%-12s %s", v.Operation, v.Path)
+		if v.Namespace != "" {
+			line += "  ns " + v.Namespace
+		}
+		switch {
+		case v.Error != "":
+			line += "  " + report.Red + v.Error + report.Reset
+		case !v.Responded:
+			line += "  " + report.Red + "no response logged" + report.Reset
+		}
+		fmt.Printf("  %-9s  %s  %s\n", "vault", v.Time.UTC().Format(timeFormat), line)
+	}
+	hidden := len(tr.Requests) + len(tr.Apiserver) + len(tr.Plugin) + len(tr.Vault) -
+		limit(len(tr.Requests)) - limit(len(tr.Apiserver)) - limit(len(tr.Plugin)) - limit(len(tr.Vault))
+	if hidden > 0 {
+		fmt.Printf("  ... %d more (--max-entries 0 or --json for all)\n", hidden)
+	}
+}
+
+func printOrphan(o *orphan) {
+	fmt.Printf("\n  %-9s  %s\n", "request", describeAudit(o.Request))
+	if len(o.Nearby) == 0 {
+		fmt.Printf("  %sno KMS failure logged within the window%s\n", report.Yellow, report.Reset)
+	}
+	for _, tr := range o.Nearby {
+		var what []string
+		for _, p := range tr.Plugin {
+			if p.Code != "OK" {
+				what = append(what, p.Method+": "+p.Error)
+			}
+		}
+		for _, v := range tr.Vault {
+			if v.Error != "" {
+				what = append(what, v.Path+": "+v.Error)
+			}
+		}
+		fmt.Printf("  %-9s  %s  %s  %s\n", "nearby", tr.Start.UTC().Format(timeFormat), tr.ID, strings.Join(what, "; "))
+	}
+}
+
+func describeAudit(ev *auditEvent) string {
+	name := ev.RequestURI
+	if ref := ev.ObjectRef; ref != nil {
+		name = objectName(ref.APIGroup, ref.Resource, ref.Namespace, ref.Name)
+	}
+	code := fmt.Sprintf("%d", ev.code())
+	if ev.code() >= 400 {
+		code = report.Red + code + report.Reset
+		if ev.ResponseStatus.Message != "" {
+			code += " " + ev.ResponseStatus.Message
+		}
+	}
+	return fmt.Sprintf("%s  %s %s  by %s  -> %s  (audit %s)",
+		ev.RequestReceived.UTC().Format(timeFormat), ev.Verb, name, ev.User.Username, code, ev.AuditID)
+}
+
+func objectName(group, resource, namespace, name string) string {
+	r := resource
+	if group != "" {
+		r += "." + group
+	}
+	parts := []string{r}
+	if namespace != "" {
+		parts = append(parts, namespace)
+	}
+	if name != "" {
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, "/")
+}
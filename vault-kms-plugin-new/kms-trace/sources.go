@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// correlationHeader is the header mock-vault-kms sends to Vault, as Vault
+// records it in request.headers: lower case.
+const correlationHeader = "x-kms-correlation-id"
+
+// apiserverEntry is one KMS line of the kube-apiserver log. The envelope
+// transformer logs these at -v=6 with the uid of the KMS RPC:
+//
+//	decrypt       "decrypting content using envelope service": a Decrypt RPC for a read
+//	generate-dek  "encrypting content using envelope service": the Encrypt RPC that wraps a new DEK
+//	write         "encrypting content using DEK": a write, with the uid of the Encrypt that wrapped its DEK
+type apiserverEntry struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	UID       string    `json:"uid"`
+	Key       string    `json:"key,omitempty"`
+	Verb      string    `json:"verb,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Resource  string    `json:"resource,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Source    string    `json:"source"`
+}
+
+var apiserverMessages = map[string]string{
+	"decrypting content using envelope service": "decrypt",
+	"encrypting content using envelope service": "generate-dek",
+	"encrypting content using DEK":              "write",
+}
+
+// auditEvent is the part of an audit.k8s.io/v1 Event that is joined to
+// the apiserver log.
+type auditEvent struct {
+	AuditID    string `json:"auditID"`
+	Stage      string `json:"stage"`
+	Verb       string `json:"verb"`
+	RequestURI string `json:"requestURI"`
+	User       struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectRef *struct {
+		Resource  string `json:"resource"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		APIGroup  string `json:"apiGroup"`
+	} `json:"objectRef"`
+	ResponseStatus *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"responseStatus"`
+	RequestReceived time.Time `json:"requestReceivedTimestamp"`
+	StageTimestamp  time.Time `json:"stageTimestamp"`
+}
+
+func (e *auditEvent) code() int {
+	if e.ResponseStatus == nil {
+		return 0
+	}
+	return e.ResponseStatus.Code
+}
+
+// pluginRecord is a line of the mock-vault-kms --audit-log.
+type pluginRecord struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	UID           string    `json:"uid,omitempty"`
+	CorrelationID string    `json:"correlationId"`
+	Code          string    `json:"code"`
+	DurationMS    float64   `json:"durationMs"`
+	QueueMS       float64   `json:"queueMs,omitempty"`
+	KeyID         string    `json:"keyID,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func (r *pluginRecord) id() string {
+	if r.CorrelationID != "" {
+		return r.CorrelationID
+	}
+	return r.UID
+}
+
+// vaultEntry is a Vault audit request and its response, joined on the
+// request ID.
+type vaultEntry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"requestID"`
+	CorrelationID string    `json:"correlationId"`
+	Operation     string    `json:"operation"`
+	Path          string    `json:"path"`
+	Namespace     string    `json:"namespace,omitempty"`
+	RemoteAddress string    `json:"remoteAddress,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Responded     bool      `json:"responded"`
+}
+
+// vaultAuditLine is one line of a Vault file audit device.
+type vaultAuditLine struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Error   string    `json:"error"`
+	Request struct {
+		ID        string `json:"id"`
+		Operation string `json:"operation"`
+		Path      string `json:"path"`
+		Namespace struct {
+			ID   string `json:"id"`
+			Path string `json:"path"`
+		} `json:"namespace"`
+		RemoteAddress string              `json:"remote_address"`
+		Headers       map[string][]string `json:"headers"`
+	} `json:"request"`
+}
+
+// eachLine calls fn for every line of path; "-" is stdin.
+func eachLine(path string, fn func(line string) error) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if err := fn(sc.Text()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// readApiserverLog reads KMS entries from kube-apiserver logs in klog text
+// or JSON format, with or without the timestamps `oc logs --timestamps`
+// adds. klog text headers have no year, so year is used.
+func readApiserverLog(path string, year int) ([]apiserverEntry, error) {
+	var out []apiserverEntry
+	err := eachLine(path, func(line string) error {
+		var e apiserverEntry
+		var ok bool
+		if strings.HasPrefix(strings.TrimSpace(line), "{") {
+			e, ok = parseApiserverJSON(line)
+		} else {
+			e, ok = parseKlogLine(line, year)
+		}
+		if ok {
+			e.Source = path
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func parseApiserverJSON(line string) (apiserverEntry, bool) {
+	var raw map[string]any
+	if json.Unmarshal([]byte(line), &raw) != nil {
+		return apiserverEntry{}, false
+	}
+	msg, _ := raw["msg"].(string)
+	kind, ok := apiserverMessages[msg]
+	if !ok {
+		return apiserverEntry{}, false
+	}
+	str := func(k string) string { s, _ := raw[k].(string); return s }
+	e := apiserverEntry{
+		Kind: kind, UID: str("uid"), Key: str("key"), Verb: str("verb"), Group: str("group"),
+		Resource: str("resource"), Namespace: str("namespace"), Name: str("name"),
+	}
+	// klog's JSON format writes ts as fractional Unix milliseconds.
+	if ts, ok := raw["ts"].(float64); ok {
+		ms := int64(ts)
+		e.Time = time.UnixMilli(ms).Add(time.Duration((ts - float64(ms)) * float64(time.Millisecond))).UTC()
+	}
+	return e, e.UID != ""
+}
+
+// parseKlogLine parses
+//
+//	[2026-10-16T20:06:03.220006789Z ]I1016 20:06:03.220006      12 envelope.go:215] "decrypting content using envelope service" uid="..." key="..." ...
+func parseKlogLine(line string, year int) (apiserverEntry, bool) {
+	var e apiserverEntry
+	var podTime time.Time
+	if ts, rest, ok := strings.Cut(line, " "); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			podTime, line = t, rest
+		}
+	}
+	header, msg, ok := strings.Cut(line, "] ")
+	if !ok || len(header) < 21 || !strings.ContainsRune("IWEF", rune(header[0])) {
+		return e, false
+	}
+	quoted, rest, err := unquotePrefix(msg)
+	if err != nil {
+		return e, false
+	}
+	if e.Kind, ok = apiserverMessages[quoted]; !ok {
+		return e, false
+	}
+	for k, v := range parseKeyValues(rest) {
+		switch k {
+		case "uid":
+			e.UID = v
+		case "key":
+			e.Key = v
+		case "verb":
+			e.Verb = v
+		case "group":
+			e.Group = v
+		case "resource":
+			e.Resource = v
+		case "namespace":
+			e.Namespace = v
+		case "name":
+			e.Name = v
+		}
+	}
+	e.Time = podTime
+	if e.Time.IsZero() {
+		// Lmmdd hh:mm:ss.uuuuuu; the apiserver logs in UTC.
+		t, err := time.Parse("0102 15:04:05.000000", header[1:21])
+		if err != nil {
+			return e, false
+		}
+		e.Time = t.AddDate(year, 0, 0).UTC()
+	}
+	return e, e.UID != ""
+}
+
+// unquotePrefix reads the Go-quoted string at the start of s.
+func unquotePrefix(s string) (string, string, error) {
+	q, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", err
+	}
+	v, err := strconv.Unquote(q)
+	return v, s[len(q):], err
+}
+
+// parseKeyValues parses klog structured key="value" pairs. Unquoted
+// values run to the next space.
+func parseKeyValues(s string) map[string]string {
+	out := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ")
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok || k == "" || strings.ContainsRune(k, ' ') {
+			return out
+		}
+		if strings.HasPrefix(rest, `"`) {
+			v, after, err := unquotePrefix(rest)
+			if err != nil {
+				return out
+			}
+			out[k], s = v, after
+			continue
+		}
+		v, after, _ := strings.Cut(rest, " ")
+		out[k], s = v, after
+	}
+}
+
+// readAuditEvents reads completed requests from kube-apiserver audit logs.
+func readAuditEvents(path string) ([]*auditEvent, error) {
+	var out []*auditEvent
+	err := eachLine(path, func(line string) error {
+		e := &auditEvent{}
+		if json.Unmarshal([]byte(line), e) != nil || e.AuditID == "" {
+			return nil
+		}
+		if e.Stage == "ResponseComplete" || e.Stage == "Panic" {
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// readPluginAudit reads a mock-vault-kms audit log, or the log of its pod
+// with --audit-log=-; other lines and timestamp prefixes are skipped.
+func readPluginAudit(path string) ([]*pluginRecord, error) {
+	var out []*pluginRecord
+	err := eachLine(path, func(line string) error {
+		start := strings.IndexByte(line, '{')
+		if start < 0 {
+			return nil
+		}
+		r := &pluginRecord{}
+		if json.Unmarshal([]byte(line[start:]), r) != nil || r.Method == "" {
+			return nil
+		}
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
+
+// readVaultAudit reads a Vault file audit device, or the log of a Vault
+// pod whose audit device writes to stdout; other lines are skipped.
+// hmacHeaders counts correlation headers Vault HMAC'd because the header
+// was not configured with hmac=false.
+func readVaultAudit(path string) (entries []*vaultEntry, hmacHeaders int, err error) {
+	byID := map[string]*vaultEntry{}
+	err = eachLine(path, func(line string) error {
+		start := strings.IndexByte(line, '{')
+		if start < 0 {
+			return nil
+		}
+		var l vaultAuditLine
+		if json.Unmarshal([]byte(line[start:]), &l) != nil || l.Request.ID == "" {
+			return nil
+		}
+		if l.Type != "request" && l.Type != "response" {
+			return nil
+		}
+		e := byID[l.Request.ID]
+		if e == nil {
+			e = &vaultEntry{
+				Time:          l.Time,
+				RequestID:     l.Request.ID,
+				Operation:     l.Request.Operation,
+				Path:          l.Request.Path,
+				Namespace:     l.Request.Namespace.Path,
+				RemoteAddress: l.Request.RemoteAddress,
+			}
+			byID[l.Request.ID] = e
+			entries = append(entries, e)
+		}
+		for name, values := range l.Request.Headers {
+			if strings.EqualFold(name, correlationHeader) && len(values) > 0 {
+				e.CorrelationID = values[0]
+			}
+		}
+		if l.Type == "response" {
+			e.Responded = true
+			if l.Error != "" {
+				e.Error = strings.Join(strings.Fields(l.Error), " ")
+			}
+		}
+		return nil
+	})
+	for _, e := range entries {
+		if strings.HasPrefix(e.CorrelationID, "hmac-") {
+			hmacHeaders++
+		}
+	}
+	return entries, hmacHeaders, err
+}
+
+// multiFlag is a flag that may be repeated or given a comma-separated
+// list.
+type multiFlag []string
+
+func (m *multiFlag) String() string { return strings.Join(*m, ",") }
+
+func (m *multiFlag) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*m = append(*m, p)
+		}
+	}
+	if len(*m) == 0 {
+		return fmt.Errorf("empty path")
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 10, 16, 20, 6, 3, 220006000, time.UTC)
+
+func TestParseApiserverJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   apiserverEntry
+		wantOK bool
+	}{
+		{
+			name: "decrypt",
+			line: `{"ts":1792181163220.006,"caller":"envelope/envelope.go:215","msg":"decrypting content using envelope service","v":6,"uid":"5f1c2a7e-0d4b-4c55-9a1e-3b8f0c6d2e11","key":"/kubernetes.io/secrets/demo/db-password","group":"","version":"v1","resource":"secrets","subresource":"","verb":"get","namespace":"demo","name":"db-password"}`,
+			want: apiserverEntry{
+				Time: t0, Kind: "decrypt", UID: "5f1c2a7e-0d4b-4c55-9a1e-3b8f0c6d2e11", Key: "/kubernetes.io/secrets/demo/db-password",
+				Verb: "get", Resource: "secrets", Namespace: "demo", Name: "db-password",
+			},
+			wantOK: true,
+		},
+		{
+			name:   "generate DEK",
+			line:   `{"ts":1792181163220.006,"caller":"envelope/envelope.go:178","msg":"encrypting content using envelope service","v":6,"uid":"9c0e"}`,
+			want:   apiserverEntry{Time: t0, Kind: "generate-dek", UID: "9c0e"},
+			wantOK: true,
+		},
+		{
+			name: "other message",
+			line: `{"ts":1792181163220.006,"caller":"cacher/cacher.go:460","msg":"cacher initialized","v":1}`,
+		},
+		{
+			name: "no uid",
+			line: `{"ts":1792181163220.006,"msg":"decrypting content using envelope service","v":6}`,
+		},
+		{
+			name: "not JSON",
+			line: `{"ts":`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseApiserverJSON(tt.line)
+			if ok != tt.wantOK {
+				t.Fatalf("parseApiserverJSON ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			// ts is a float64 of milliseconds, precise to a few hundred
+			// nanoseconds.
+			if d := got.Time.Sub(tt.want.Time).Abs(); d > time.Microsecond {
+				t.Errorf("time = %s, want %s", got.Time, tt.want.Time)
+			}
+			got.Time = tt.want.Time
+			if got != tt.want {
+				t.Errorf("parseApiserverJSON = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKlogLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   apiserverEntry
+		wantOK bool
+	}{
+		{
+			name: "klog header",
+			line: `I1016 20:06:03.220006      12 envelope.go:215] "decrypting content using envelope service" uid="5f1c" key="/kubernetes.io/secrets/demo/db-password" group="" version="v1" resource="secrets" subresource="" verb="get" namespace="demo" name="db-password"`,
+			want: apiserverEntry{
+				Time: t0, Kind: "decrypt", UID: "5f1c", Key: "/kubernetes.io/secrets/demo/db-password",
+				Verb: "get", Resource: "secrets", Namespace: "demo", Name: "db-password",
+			},
+			wantOK: true,
+		},
+		{
+			name: "oc logs --timestamps",
+			line: `2026-10-16T20:06:04.5Z I1016 20:06:03.220006      12 envelope.go:178] "encrypting content using DEK" uid="9c0e" verb="create" resource="secrets" namespace="demo"`,
+			want: apiserverEntry{
+				Time: time.Date(2026, 10, 16, 20, 6, 4, 500000000, time.UTC), Kind: "write", UID: "9c0e",
+				Verb: "create", Resource: "secrets", Namespace: "demo",
+			},
+			wantOK: true,
+		},
+		{
+			name:   "unquoted values",
+			line:   `I1016 20:06:03.220006      12 envelope.go:178] "encrypting content using envelope service" uid=9c0e key=/registry/x`,
+			want:   apiserverEntry{Time: t0, Kind: "generate-dek", UID: "9c0e", Key: "/registry/x"},
+			wantOK: true,
+		},
+		{
+			name: "other message",
+			line: `I1016 20:06:03.220006      12 cacher.go:460] "cacher initialized" resource="secrets"`,
+		},
+		{
+			name: "no uid",
+			line: `I1016 20:06:03.220006      12 envelope.go:215] "decrypting content using envelope service" key="/k"`,
+		},
+		{
+			name: "not klog",
+			line: `Flag --insecure-port has been deprecated`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseKlogLine(tt.line, 2026)
+			if ok != tt.wantOK {
+				t.Fatalf("parseKlogLine ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKlogLine = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	ms := time.Millisecond
+	event := func(verb, name string, code int, received time.Time) *auditEvent {
+		ev := &auditEvent{AuditID: verb + "-" + name, Stage: "ResponseComplete", Verb: verb,
+			RequestReceived: received, StageTimestamp: received.Add(20 * ms)}
+		ev.ObjectRef = &struct {
+			Resource  string `json:"resource"`
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+			APIGroup  string `json:"apiGroup"`
+		}{Resource: "secrets", Namespace: "demo", Name: name}
+		ev.ResponseStatus = &struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{Code: code}
+		return ev
+	}
+	read := event("get", "db-password", 200, t0.Add(-10*ms))
+	stale := event("get", "db-password", 200, t0.Add(-time.Minute))
+	refused := event("create", "api-token", 500, t0.Add(time.Second))
+	s := sources{
+		apiserver: []apiserverEntry{
+			{Time: t0, Kind: "decrypt", UID: "read", Verb: "get", Resource: "secrets", Namespace: "demo", Name: "db-password"},
+			{Time: t0.Add(time.Second), Kind: "generate-dek", UID: "dek"},
+			{Time: t0.Add(2 * time.Second), Kind: "write", UID: "reused", Verb: "update", Resource: "secrets", Namespace: "demo", Name: "other"},
+		},
+		audit: []*auditEvent{read, stale, refused},
+		plugin: []*pluginRecord{
+			{Time: t0.Add(ms), Method: "Decrypt", CorrelationID: "read", Code: "OK"},
+			{Time: t0.Add(time.Second), Method: "Encrypt", CorrelationID: "dek", Code: "Unavailable"},
+			{Time: t0.Add(-time.Second), Method: "Status", UID: "status-1", Code: "OK"},
+		},
+		vault: []*vaultEntry{
+			{Time: t0.Add(2 * ms), RequestID: "r1", CorrelationID: "read", Responded: true},
+			{Time: t0, RequestID: "r2", Path: "sys/health"},
+		},
+	}
+
+	traces, orphans := join(s, time.Second)
+
+	tests := []struct {
+		id          string
+		wantReqs    []*auditEvent
+		wantFailed  bool
+		wantMissing []string
+	}{
+		{id: "status-1", wantMissing: []string{"vault"}},
+		{id: "read", wantReqs: []*auditEvent{read}},
+		{id: "dek", wantFailed: true, wantMissing: []string{"vault"}},
+		{id: "reused"},
+	}
+	if len(traces) != len(tests) {
+		t.Fatalf("join returned %d traces, want %d", len(traces), len(tests))
+	}
+	for i, tt := range tests {
+		tr := traces[i]
+		if tr.ID != tt.id {
+			t.Errorf("trace %d = %s, want %s (traces are ordered by start)", i, tr.ID, tt.id)
+			continue
+		}
+		if !reflect.DeepEqual(tr.Requests, tt.wantReqs) {
+			t.Errorf("%s: requests = %v, want %v", tr.ID, tr.Requests, tt.wantReqs)
+		}
+		if tr.Failed != tt.wantFailed {
+			t.Errorf("%s: failed = %v, want %v", tr.ID, tr.Failed, tt.wantFailed)
+		}
+		if strings.Join(tr.Missing, ",") != strings.Join(tt.wantMissing, ",") {
+			t.Errorf("%s: missing = %v, want %v", tr.ID, tr.Missing, tt.wantMissing)
+		}
+	}
+
+	if len(orphans) != 1 || orphans[0].Request != refused {
+		t.Fatalf("orphans = %+v, want the refused create", orphans)
+	}
+	if nearby := orphans[0].Nearby; len(nearby) != 1 || nearby[0].ID != "dek" {
+		t.Errorf("orphan nearby failures = %v, want dek", nearby)
+	}
+}
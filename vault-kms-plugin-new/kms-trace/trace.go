@@ -0,0 +1,242 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// trace is everything the logs say about one KMS operation, keyed by its
+// correlation ID: the uid the apiserver gave the RPC.
+type trace struct {
+	ID    string    `json:"id"`
+	Start time.Time `json:"start"`
+	// Requests are the kube-apiserver audit events for the reads and
+	// writes that used this operation.
+	Requests  []*auditEvent    `json:"requests,omitempty"`
+	Apiserver []apiserverEntry `json:"apiserver,omitempty"`
+	Plugin    []*pluginRecord  `json:"plugin,omitempty"`
+	Vault     []*vaultEntry    `json:"vault,omitempty"`
+	Failed    bool             `json:"failed"`
+	// Missing lists the components that should have logged the operation
+	// but did not.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// orphan is a failed kube-apiserver request without a KMS uid of its own,
+// for example a write refused because no DEK could be generated, with
+// the KMS failures logged around it.
+type orphan struct {
+	Request *auditEvent `json:"request"`
+	Nearby  []*trace    `json:"nearbyFailures"`
+}
+
+type sources struct {
+	apiserver []apiserverEntry
+	audit     []*auditEvent
+	plugin    []*pluginRecord
+	vault     []*vaultEntry
+}
+
+// join builds a trace per correlation ID. Audit events carry no uid, so
+// they are matched to apiserver log entries for the same verb and object
+// logged while the request was in flight (plus window for clock skew).
+func join(s sources, window time.Duration) ([]*trace, []*orphan) {
+	byID := map[string]*trace{}
+	get := func(id string, t time.Time) *trace {
+		tr := byID[id]
+		if tr == nil {
+			tr = &trace{ID: id, Start: t}
+			byID[id] = tr
+		}
+		if !t.IsZero() && (tr.Start.IsZero() || t.Before(tr.Start)) {
+			tr.Start = t
+		}
+		return tr
+	}
+	for _, e := range s.apiserver {
+		tr := get(e.UID, e.Time)
+		tr.Apiserver = append(tr.Apiserver, e)
+	}
+	for _, r := range s.plugin {
+		tr := get(r.id(), r.Time)
+		tr.Plugin = append(tr.Plugin, r)
+	}
+	for _, v := range s.vault {
+		if v.CorrelationID == "" {
+			continue // not a KMS plugin request
+		}
+		tr := get(v.CorrelationID, v.Time)
+		tr.Vault = append(tr.Vault, v)
+	}
+
+	// Index the log entries by object collection so that large audit logs
+	// are not matched against every entry.
+	type logged struct {
+		tr *trace
+		e  apiserverEntry
+	}
+	byCollection := map[string][]logged{}
+	for _, tr := range byID {
+		for _, e := range tr.Apiserver {
+			if e.Kind != "generate-dek" {
+				k := e.Group + "/" + e.Resource + "/" + e.Namespace
+				byCollection[k] = append(byCollection[k], logged{tr, e})
+			}
+		}
+	}
+	matched := map[*auditEvent]bool{}
+	for _, ev := range s.audit {
+		if ev.ObjectRef == nil {
+			continue
+		}
+		ref := ev.ObjectRef
+		for _, l := range byCollection[ref.APIGroup+"/"+ref.Resource+"/"+ref.Namespace] {
+			if !sameObject(ev, l.e) {
+				continue
+			}
+			if l.e.Time.Before(ev.RequestReceived.Add(-window)) || l.e.Time.After(ev.StageTimestamp.Add(window)) {
+				continue
+			}
+			l.tr.Requests = appendOnce(l.tr.Requests, ev)
+			matched[ev] = true
+		}
+	}
+
+	traces := make([]*trace, 0, len(byID))
+	for _, tr := range byID {
+		classify(tr, len(s.apiserver) > 0, len(s.plugin) > 0, len(s.vault) > 0)
+		traces = append(traces, tr)
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Start.Before(traces[j].Start) })
+
+	var orphans []*orphan
+	for _, ev := range s.audit {
+		if matched[ev] || ev.code() < 500 || ev.ObjectRef == nil {
+			continue
+		}
+		o := &orphan{Request: ev}
+		for _, tr := range traces {
+			if tr.Failed && !tr.Start.Before(ev.RequestReceived.Add(-window)) && !tr.Start.After(ev.StageTimestamp.Add(window)) {
+				o.Nearby = append(o.Nearby, tr)
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	return traces, orphans
+}
+
+// sameObject reports whether the log entry is for the audited object and
+// verb; join has already matched the collection.
+func sameObject(ev *auditEvent, e apiserverEntry) bool {
+	ref := ev.ObjectRef
+	// A create is logged before the apiserver knows the generated name.
+	if e.Name != "" && ref.Name != "" && ref.Name != e.Name {
+		return false
+	}
+	return e.Verb == "" || e.Verb == ev.Verb
+}
+
+func appendOnce(events []*auditEvent, ev *auditEvent) []*auditEvent {
+	for _, e := range events {
+		if e == ev {
+			return events
+		}
+	}
+	return append(events, ev)
+}
+
+// classify marks a trace failed if any component logged an error, and
+// records which components with logs loaded never saw it. A plugin RPC
+// without a Vault request, for instance, means the plugin failed before
+// calling Vault or the correlation header is not audited.
+func classify(tr *trace, haveApiserver, havePlugin, haveVault bool) {
+	for _, r := range tr.Requests {
+		if r.code() >= 400 {
+			tr.Failed = true
+		}
+	}
+	for _, r := range tr.Plugin {
+		if r.Code != "OK" {
+			tr.Failed = true
+		}
+	}
+	for _, v := range tr.Vault {
+		if v.Error != "" || !v.Responded {
+			tr.Failed = true
+		}
+	}
+	// Status RPCs come from the apiserver health check, not a request,
+	// and get an ID from the plugin.
+	status := false
+	for _, r := range tr.Plugin {
+		status = status || r.Method == "Status"
+	}
+	if haveApiserver && len(tr.Apiserver) == 0 && !status {
+		tr.Missing = append(tr.Missing, "apiserver")
+	}
+	if havePlugin && len(tr.Plugin) == 0 {
+		tr.Missing = append(tr.Missing, "plugin")
+	}
+	// Writes reuse their DEK and never reach the plugin or Vault.
+	writesOnly := len(tr.Apiserver) > 0
+	for _, e := range tr.Apiserver {
+		writesOnly = writesOnly && e.Kind == "write"
+	}
+	if writesOnly {
+		tr.Missing = removeAll(tr.Missing, "plugin")
+	} else if haveVault && len(tr.Vault) == 0 {
+		tr.Missing = append(tr.Missing, "vault")
+	}
+}
+
+func removeAll(s []string, v string) []string {
+	out := s[:0]
+	for _, x := range s {
+		if x != v {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// filter keeps traces whose ID matches id, whose objects contain object,
+// and, if failedOnly, that failed.
+func filter(traces []*trace, id, object string, failedOnly bool) []*trace {
+	var out []*trace
+	for _, tr := range traces {
+		if id != "" && tr.ID != id {
+			continue
+		}
+		if failedOnly && !tr.Failed {
+			continue
+		}
+		if object != "" && !mentions(tr, object) {
+			continue
+		}
+		out = append(out, tr)
+	}
+	return out
+}
+
+func mentions(tr *trace, object string) bool {
+	for _, e := range tr.Apiserver {
+		if strings.Contains(e.Key, object) || strings.Contains(e.Namespace+"/"+e.Name, object) {
+			return true
+		}
+	}
+	for _, r := range tr.Requests {
+		if auditMentions(r, object) {
+			return true
+		}
+	}
+	return false
+}
+
+func auditMentions(ev *auditEvent, object string) bool {
+	if strings.Contains(ev.RequestURI, object) {
+		return true
+	}
+	ref := ev.ObjectRef
+	return ref != nil && strings.Contains(objectName(ref.APIGroup, ref.Resource, ref.Namespace, ref.Name), object)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"k8s.io/kms/pkg/service"
+)
+
+// keyring is the key material a restore needs: whatever wrapped the DEK
+// seeds stored in etcd.
+type keyring interface {
+	keyID() string
+	encrypt(plaintext []byte) ([]byte, error)
+	decrypt(ciphertext []byte) ([]byte, error)
+	describe() string
+}
+
+// transitKeyring holds the versions of a Vault transit key as returned by
+// "vault read -format=json transit/export/encryption-key/<key>". The key
+// must have been created with exportable=true.
+type transitKeyring struct {
+	name     string
+	keyType  string
+	versions map[int]cipher.AEAD
+	latest   int
+}
+
+// transitExport matches both the raw API response ({"data": {...}}) and the
+// data object on its own.
+type transitExport struct {
+	Data *transitExport    `json:"data"`
+	Name string            `json:"name"`
+	Type string            `json:"type"`
+	Keys map[string]string `json:"keys"`
+}
+
+func loadTransitEscrow(path string) (*transitKeyring, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read escrow file: %w", err)
+	}
+	var exp transitExport
+	if err := json.Unmarshal(raw, &exp); err != nil {
+		return nil, fmt.Errorf("failed to parse escrow file %s: %w", path, err)
+	}
+	if exp.Data != nil {
+		exp = *exp.Data
+	}
+	switch exp.Type {
+	case "aes256-gcm96", "aes128-gcm96":
+	case "":
+		return nil, fmt.Errorf("%s: no key type; expected the output of transit/export/encryption-key/<key>", path)
+	default:
+		return nil, fmt.Errorf("%s: transit key type %q is not supported (want aes256-gcm96 or aes128-gcm96)", path, exp.Type)
+	}
+	if len(exp.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no key versions", path)
+	}
+
+	kr := &transitKeyring{name: exp.Name, keyType: exp.Type, versions: map[int]cipher.AEAD{}}
+	for v, k := range exp.Keys {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid key version %q", path, v)
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key version %d is not base64: %w", path, version, err)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key version %d: %w", path, version, err)
+		}
+		kr.versions[version] = aead
+		if version > kr.latest {
+			kr.latest = version
+		}
+	}
+	return kr, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *transitKeyring) keyID() string {
+	return fmt.Sprintf("%s:v%d", k.name, k.latest)
+}
+
+func (k *transitKeyring) describe() string {
+	versions := make([]int, 0, len(k.versions))
+	for v := range k.versions {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return fmt.Sprintf("transit key %q (%s, versions %v)", k.name, k.keyType, versions)
+}
+
+// encrypt produces a transit ciphertext, "vault:v<N>:" followed by the
+// base64 of nonce and sealed data, as transit/encrypt would.
+func (k *transitKeyring) encrypt(plaintext []byte) ([]byte, error) {
+	aead := k.versions[k.latest]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return []byte(fmt.Sprintf("vault:v%d:%s", k.latest, base64.StdEncoding.EncodeToString(sealed))), nil
+}
+
+func (k *transitKeyring) decrypt(ciphertext []byte) ([]byte, error) {
+	rest, ok := strings.CutPrefix(string(ciphertext), "vault:v")
+	if !ok {
+		return nil, fmt.Errorf("ciphertext is not a Vault transit ciphertext (no vault:v<N>: prefix)")
+	}
+	v, b64, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, fmt.Errorf("malformed transit ciphertext")
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("malformed transit key version %q", v)
+	}
+	aead, ok := k.versions[version]
+	if !ok {
+		return nil, fmt.Errorf("key version %d is not in the escrow (have %s)", version, k.describe())
+	}
+	sealed, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, fmt.Errorf("transit ciphertext is not base64: %w", err)
+	}
+	return openGCM(aead, sealed)
+}
+
+func openGCM(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ct := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// mockKeyring is the static key of mock-vault-kms, for drills on clusters
+// that run the mock plugin. It must match mock-vault-kms/main.go.
+type mockKeyring struct {
+	aead cipher.AEAD
+}
+
+const mockKeyID = "mock-vault-kms-key-v1"
+
+func newMockKeyring() (*mockKeyring, error) {
+	key := sha256.Sum256([]byte("mock-vault-kms-static-key-for-testing-only"))
+	aead, err := newGCM(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &mockKeyring{aead: aead}, nil
+}
+
+func (m *mockKeyring) keyID() string    { return mockKeyID }
+func (m *mockKeyring) describe() string { return "mock-vault-kms static key" }
+
+func (m *mockKeyring) encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return m.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (m *mockKeyring) decrypt(ciphertext []byte) ([]byte, error) {
+	return openGCM(m.aead, ciphertext)
+}
+
+// escrowService is a KMS v2 plugin backed by a keyring instead of Vault.
+// It counts calls so the report can show that decryption really went
+// through the escrowed key.
+type escrowService struct {
+	keys     keyring
+	decrypts atomic.Int64
+	failures atomic.Int64
+}
+
+func (s *escrowService) Status(_ context.Context) (*service.StatusResponse, error) {
+	return &service.StatusResponse{Version: "v2", Healthz: "ok", KeyID: s.keys.keyID()}, nil
+}
+
+func (s *escrowService) Encrypt(_ context.Context, _ string, data []byte) (*service.EncryptResponse, error) {
+	ct, err := s.keys.encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return &service.EncryptResponse{Ciphertext: ct, KeyID: s.keys.keyID()}, nil
+}
+
+func (s *escrowService) Decrypt(_ context.Context, _ string, req *service.DecryptRequest) ([]byte, error) {
+	s.decrypts.Add(1)
+	pt, err := s.keys.decrypt(req.Ciphertext)
+	if err != nil {
+		s.failures.Add(1)
+	}
+	return pt, err
+}
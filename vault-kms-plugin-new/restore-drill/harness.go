@@ -0,0 +1,248 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	apiserverv1 "k8s.io/apiserver/pkg/apis/apiserver/v1"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/apiserver/pkg/server/options/encryptionconfig"
+	"k8s.io/apiserver/pkg/storage/value"
+	"sigs.k8s.io/yaml"
+)
+
+// harness is the apiserver storage layer without the apiserver: the
+// transformers built by k8s.io/apiserver from the backed-up
+// EncryptionConfigurations, with every KMS provider pointed at the drill's
+// plugin. Values read through it are decrypted exactly as a restored
+// apiserver would decrypt them.
+type harness struct {
+	endpoint string
+	workDir  string
+	configs  []ConfigInfo
+	chain    []value.Transformer
+	// kmsWriter is the first transformer that writes with a KMS provider,
+	// for the write probe; kmsWriterGR is its resource.
+	kmsWriter   value.Transformer
+	kmsWriterGR string
+}
+
+// ConfigInfo describes one EncryptionConfiguration loaded into the harness.
+type ConfigInfo struct {
+	APIServer string   `json:"apiserver"`
+	Source    string   `json:"source"`
+	Resources []string `json:"resources"`
+	Providers []string `json:"providers"`
+}
+
+func newHarness(endpoint, workDir string) *harness {
+	return &harness{endpoint: endpoint, workDir: workDir}
+}
+
+// load rewrites the KMS endpoints in data, loads the result and waits for
+// the KMS providers to report healthy.
+func (h *harness) load(ctx context.Context, server, source string, data []byte) error {
+	var cfg apiserverv1.EncryptionConfiguration
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return fmt.Errorf("%s: invalid EncryptionConfiguration: %w", source, err)
+	}
+	info := ConfigInfo{APIServer: server, Source: source}
+	kmsFirst := map[string]bool{}
+	for i := range cfg.Resources {
+		info.Resources = append(info.Resources, cfg.Resources[i].Resources...)
+		if ps := cfg.Resources[i].Providers; len(ps) > 0 && ps[0].KMS != nil {
+			for _, res := range cfg.Resources[i].Resources {
+				kmsFirst[schema.ParseGroupResource(res).String()] = true
+			}
+		}
+		for j := range cfg.Resources[i].Providers {
+			p := &cfg.Resources[i].Providers[j]
+			info.Providers = append(info.Providers, providerName(*p))
+			if p.KMS != nil {
+				p.KMS.Endpoint = h.endpoint
+			}
+		}
+	}
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(h.workDir, server+"-encryption-config.yaml")
+	if err := os.WriteFile(path, out, 0o600); err != nil {
+		return err
+	}
+
+	loaded, err := encryptionconfig.LoadEncryptionConfig(ctx, path, false, memberName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	if err := waitHealthy(ctx, loaded.HealthChecks, 60*time.Second); err != nil {
+		return fmt.Errorf("%s: KMS provider not healthy: %w", source, err)
+	}
+
+	grs := make([]string, 0, len(loaded.Transformers))
+	byName := map[string]value.Transformer{}
+	for gr, t := range loaded.Transformers {
+		grs = append(grs, gr.String())
+		byName[gr.String()] = t
+	}
+	sort.Strings(grs)
+	for _, gr := range grs {
+		h.chain = append(h.chain, byName[gr])
+		if h.kmsWriter == nil && kmsFirst[gr] {
+			h.kmsWriter, h.kmsWriterGR = byName[gr], gr
+		}
+	}
+	h.configs = append(h.configs, info)
+	return nil
+}
+
+func providerName(p apiserverv1.ProviderConfiguration) string {
+	switch {
+	case p.KMS != nil:
+		return "kms:" + p.KMS.Name
+	case p.AESCBC != nil:
+		return "aescbc"
+	case p.AESGCM != nil:
+		return "aesgcm"
+	case p.Secretbox != nil:
+		return "secretbox"
+	default:
+		return "identity"
+	}
+}
+
+func waitHealthy(ctx context.Context, checks []healthz.HealthChecker, timeout time.Duration) error {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/healthz", nil)
+	deadline := time.Now().Add(timeout)
+	for _, c := range checks {
+		for {
+			err := c.Check(req)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s: %w", c.Name(), err)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	return nil
+}
+
+var errNoProvider = errors.New("no provider in the loaded EncryptionConfigurations matches this value")
+
+// fromStorage decrypts an etcd value. The etcd key is the authenticated
+// data, so any transformer holding the right provider can read it; they
+// are tried in turn.
+func (h *harness) fromStorage(ctx context.Context, key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("k8s:enc:")) {
+		return data, nil
+	}
+	var firstErr error
+	for _, t := range h.chain {
+		out, _, err := t.TransformFromStorage(ctx, data, value.DefaultContext(key))
+		if err == nil {
+			return out, nil
+		}
+		if firstErr == nil && !strings.Contains(err.Error(), "no matching prefix") {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		return nil, errNoProvider
+	}
+	return nil, firstErr
+}
+
+// probe writes a value through a transformer whose first provider is KMS
+// and reads it back, proving the harness can also encrypt with the restored
+// key. It returns the resource whose transformer it wrote through.
+func (h *harness) probe(ctx context.Context) (string, error) {
+	if h.kmsWriter == nil {
+		return "", errors.New("no loaded EncryptionConfiguration has a KMS provider first, so nothing is written with KMS")
+	}
+	gr := h.kmsWriterGR
+	key := "/kubernetes.io/secrets/restore-drill/probe"
+	want := []byte("restore-drill probe " + time.Now().UTC().Format(time.RFC3339))
+	ct, err := h.kmsWriter.TransformToStorage(ctx, want, value.DefaultContext(key))
+	if err != nil {
+		return gr, fmt.Errorf("encrypt: %w", err)
+	}
+	if !bytes.HasPrefix(ct, []byte("k8s:enc:kms:")) {
+		return gr, fmt.Errorf("%s was not written with KMS: value starts with %q", gr, ct[:min(len(ct), 16)])
+	}
+	got, err := h.fromStorage(ctx, key, ct)
+	if err != nil {
+		return gr, fmt.Errorf("decrypt: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		return gr, fmt.Errorf("round trip returned different data")
+	}
+	return gr, nil
+}
+
+var apiserverPodDir = regexp.MustCompile(`kube-apiserver-pod-(\d+)/secrets/encryption-config/encryption-config$`)
+
+// configFromStaticResources extracts the kube-apiserver EncryptionConfiguration
+// of the newest revision from a static_kuberesources_*.tar.gz written by
+// cluster-backup.sh.
+func configFromStaticResources(path string) ([]byte, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+	tr := tar.NewReader(gz)
+
+	var best []byte
+	bestRev, bestName := -1, ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", path, err)
+		}
+		m := apiserverPodDir.FindStringSubmatch(hdr.Name)
+		if m == nil || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		rev, _ := strconv.Atoi(m[1])
+		if rev <= bestRev {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", path, err)
+		}
+		best, bestRev, bestName = data, rev, hdr.Name
+	}
+	if best == nil {
+		return nil, "", fmt.Errorf("%s has no kube-apiserver encryption-config (was encryption enabled when the backup was taken?)", path)
+	}
+	return best, path + ":" + bestName, nil
+}
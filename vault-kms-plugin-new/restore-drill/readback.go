@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gangwgr/report"
+	"google.golang.org/protobuf/encoding/protowire"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// protoMagic starts every protobuf-encoded object the apiserver writes.
+var protoMagic = []byte("k8s\x00")
+
+// openshiftConfigSecrets hold the EncryptionConfigurations of the
+// aggregated apiservers. Unlike kube-apiserver's, they are not files in the
+// backup; they are secrets inside etcd, readable once kube-apiserver's
+// config is loaded.
+var openshiftConfigSecrets = map[string]string{
+	"openshift-apiserver": "/kubernetes.io/secrets/openshift-config-managed/encryption-config-openshift-apiserver",
+	"oauth-apiserver":     "/kubernetes.io/secrets/openshift-config-managed/encryption-config-openshift-oauth-apiserver",
+}
+
+// loadOpenShiftConfigs adds the openshift-apiserver and oauth-apiserver
+// configs found in the restored etcd. Missing secrets are not an error:
+// those apiservers may not be encrypting anything.
+func loadOpenShiftConfigs(ctx context.Context, db *scratchEtcd, h *harness, r *report.Reporter) error {
+	for _, server := range []string{"openshift-apiserver", "oauth-apiserver"} {
+		key := openshiftConfigSecrets[server]
+		raw, err := db.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if raw == nil {
+			r.Info("%s: no encryption config in etcd, skipping", server)
+			continue
+		}
+		plain, err := h.fromStorage(ctx, key, raw)
+		if err != nil {
+			return fmt.Errorf("%s: cannot decrypt %s: %w", server, key, err)
+		}
+		obj, err := decodeProto(plain)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		var secret corev1.Secret
+		if err := secret.Unmarshal(obj.Raw); err != nil {
+			return fmt.Errorf("%s: not a Secret: %w", key, err)
+		}
+		data, ok := secret.Data["encryption-config"]
+		if !ok {
+			return fmt.Errorf("%s: no encryption-config key", key)
+		}
+		if err := h.load(ctx, server, "etcd:"+key, data); err != nil {
+			return err
+		}
+		r.Info("%s: loaded encryption config from etcd", server)
+	}
+	return nil
+}
+
+func decodeProto(data []byte) (*runtime.Unknown, error) {
+	if !bytes.HasPrefix(data, protoMagic) {
+		return nil, fmt.Errorf("not a protobuf object")
+	}
+	var u runtime.Unknown
+	if err := u.Unmarshal(data[len(protoMagic):]); err != nil {
+		return nil, fmt.Errorf("invalid protobuf envelope: %w", err)
+	}
+	return &u, nil
+}
+
+// Failure kinds, in the order an object is processed.
+const (
+	failDecrypt = "decrypt"
+	failDecode  = "decode"
+	failName    = "name-mismatch"
+)
+
+// Object is what could be read back for one key.
+type Object struct {
+	APIVersion string
+	Kind       string
+	Name       string
+}
+
+// readObject decodes a plaintext value as the apiserver would store it:
+// protobuf for built-in types, JSON for CRDs.
+func readObject(data []byte) (Object, error) {
+	if bytes.HasPrefix(data, protoMagic) {
+		u, err := decodeProto(data)
+		if err != nil {
+			return Object{}, err
+		}
+		if u.Kind == "" || len(u.Raw) == 0 {
+			return Object{}, fmt.Errorf("protobuf envelope has no kind or body")
+		}
+		return Object{APIVersion: u.APIVersion, Kind: u.Kind, Name: protoObjectName(u.Raw)}, nil
+	}
+	var obj struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return Object{}, fmt.Errorf("neither protobuf nor JSON: %w", err)
+	}
+	if obj.Kind == "" {
+		return Object{}, fmt.Errorf("JSON object has no kind")
+	}
+	return Object{APIVersion: obj.APIVersion, Kind: obj.Kind, Name: obj.Metadata.Name}, nil
+}
+
+// protoObjectName reads metadata.name without the type's Go definition:
+// generated Kubernetes types put ObjectMeta in field 1 and ObjectMeta puts
+// name in field 1. Returns "" when the body does not follow that layout.
+func protoObjectName(body []byte) string {
+	meta := protoField(body, 1)
+	if meta == nil {
+		return ""
+	}
+	return string(protoField(meta, 1))
+}
+
+func protoField(b []byte, want protowire.Number) []byte {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return nil
+			}
+			if num == want {
+				return v
+			}
+			b = b[m:]
+			continue
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return nil
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+// resourcePrefix groups keys by the resource part of the key:
+// /kubernetes.io/secrets, /kubernetes.io/example.com/widgets,
+// /openshift.io/oauth/accesstokens.
+func resourcePrefix(key string) string {
+	parts := strings.SplitN(strings.TrimPrefix(key, "/"), "/", 4)
+	if len(parts) < 2 {
+		return key
+	}
+	n := 2
+	if len(parts) > 2 && (strings.Contains(parts[1], ".") || parts[1] == "services" || parts[1] == "oauth") {
+		n = 3
+	}
+	if n > len(parts) {
+		n = len(parts)
+	}
+	return "/" + strings.Join(parts[:n], "/")
+}
+
+// encryptionState is the provider prefix of a stored value, e.g.
+// kms:vault-kms or identity.
+func encryptionState(data []byte) string {
+	rest, ok := bytes.CutPrefix(data, []byte("k8s:enc:"))
+	if !ok {
+		return "identity"
+	}
+	parts := strings.SplitN(string(rest), ":", 4)
+	if len(parts) >= 3 {
+		return parts[0] + ":" + parts[2]
+	}
+	return parts[0]
+}
+
+// ResourceResult is the read-back tally for one resource prefix.
+type ResourceResult struct {
+	Prefix   string         `json:"prefix"`
+	Objects  int            `json:"objects"`
+	Readable int            `json:"readable"`
+	States   map[string]int `json:"states"`
+	Failures map[string]int `json:"failures,omitempty"`
+}
+
+// Failure is one object that could not be read back.
+type Failure struct {
+	Key   string `json:"key"`
+	State string `json:"state"`
+	Kind  string `json:"kind"`
+	Error string `json:"error"`
+}
+
+// readBack reads every key under prefixes through the harness.
+func readBack(ctx context.Context, db *scratchEtcd, h *harness, prefixes []string, maxFailures int, r *report.Reporter) ([]ResourceResult, []Failure, int, error) {
+	results := map[string]*ResourceResult{}
+	var failures []Failure
+	total, failed := 0, 0
+
+	for _, prefix := range prefixes {
+		err := db.Walk(ctx, prefix, func(kv KV) {
+			total++
+			if total%10000 == 0 {
+				r.Info("read %d objects", total)
+			}
+			rp := resourcePrefix(kv.Key)
+			res := results[rp]
+			if res == nil {
+				res = &ResourceResult{Prefix: rp, States: map[string]int{}, Failures: map[string]int{}}
+				results[rp] = res
+			}
+			res.Objects++
+			state := encryptionState(kv.Value)
+			res.States[state]++
+
+			kind, msg := "", ""
+			plain, err := h.fromStorage(ctx, kv.Key, kv.Value)
+			if err != nil {
+				kind, msg = failDecrypt, err.Error()
+			} else if obj, err := readObject(plain); err != nil {
+				kind, msg = failDecode, err.Error()
+			} else if obj.Name != "" && obj.Name != kv.Key[strings.LastIndex(kv.Key, "/")+1:] {
+				kind, msg = failName, fmt.Sprintf("%s has metadata.name %q", obj.Kind, obj.Name)
+			}
+			if kind == "" {
+				res.Readable++
+				return
+			}
+			failed++
+			res.Failures[kind]++
+			if len(failures) < maxFailures {
+				failures = append(failures, Failure{Key: kv.Key, State: state, Kind: kind, Error: msg})
+			}
+		})
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	out := make([]ResourceResult, 0, len(results))
+	for _, res := range results {
+		if len(res.Failures) == 0 {
+			res.Failures = nil
+		}
+		out = append(out, *res)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix < out[j].Prefix })
+	return out, failures, failed, nil
+}
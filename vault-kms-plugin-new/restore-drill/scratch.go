@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.etcd.io/etcd/server/v3/etcdserver/api/v3client"
+	"go.uber.org/zap"
+)
+
+const memberName = "restore-drill"
+
+// SnapshotInfo describes the snapshot that was restored.
+type SnapshotInfo struct {
+	Path      string `json:"path"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Revision  int64  `json:"revision"`
+	TotalKeys int    `json:"totalKeys"`
+	Hash      uint32 `json:"hash"`
+}
+
+// scratchEtcd is a single-member etcd restored from a snapshot, listening
+// on loopback only. Nothing in it can reach the source cluster.
+type scratchEtcd struct {
+	server *embed.Etcd
+	client *clientv3.Client
+}
+
+// restoreSnapshot restores path into dataDir the way "etcdutl snapshot
+// restore" does, after checking the snapshot's integrity.
+func restoreSnapshot(path, dataDir string, skipHashCheck bool) (SnapshotInfo, string, error) {
+	info := SnapshotInfo{Path: path}
+	sum, size, err := fileSHA256(path)
+	if err != nil {
+		return info, "", err
+	}
+	info.SHA256, info.Size = sum, size
+
+	mgr := snapshot.NewV3(zap.NewNop())
+	status, err := mgr.Status(path)
+	if err != nil {
+		return info, "", fmt.Errorf("snapshot %s is not readable: %w", path, err)
+	}
+	info.Revision, info.TotalKeys, info.Hash = status.Revision, status.TotalKey, status.Hash
+
+	peerURL, err := loopbackURL()
+	if err != nil {
+		return info, "", err
+	}
+	err = mgr.Restore(snapshot.RestoreConfig{
+		SnapshotPath:        path,
+		Name:                memberName,
+		OutputDataDir:       dataDir,
+		PeerURLs:            []string{peerURL},
+		InitialCluster:      memberName + "=" + peerURL,
+		InitialClusterToken: memberName,
+		SkipHashCheck:       skipHashCheck,
+	})
+	if err != nil {
+		return info, "", fmt.Errorf("snapshot restore failed: %w", err)
+	}
+	return info, peerURL, nil
+}
+
+// startScratchEtcd starts an embedded etcd on the restored data dir.
+func startScratchEtcd(dataDir, peerURL string) (*scratchEtcd, error) {
+	clientURL, err := loopbackURL()
+	if err != nil {
+		return nil, err
+	}
+	peer, _ := url.Parse(peerURL)
+	client, _ := url.Parse(clientURL)
+
+	cfg := embed.NewConfig()
+	cfg.Name = memberName
+	cfg.Dir = dataDir
+	cfg.ListenPeerUrls = []url.URL{*peer}
+	cfg.AdvertisePeerUrls = []url.URL{*peer}
+	cfg.ListenClientUrls = []url.URL{*client}
+	cfg.AdvertiseClientUrls = []url.URL{*client}
+	cfg.InitialCluster = memberName + "=" + peerURL
+	cfg.LogLevel = "error"
+	cfg.LogOutputs = []string{filepath.Join(filepath.Dir(dataDir), "etcd.log")}
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start embedded etcd: %w", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case err := <-e.Err():
+		e.Close()
+		return nil, fmt.Errorf("embedded etcd failed: %w", err)
+	case <-time.After(60 * time.Second):
+		e.Close()
+		return nil, fmt.Errorf("embedded etcd did not become ready within 60s")
+	}
+	return &scratchEtcd{server: e, client: v3client.New(e.Server)}, nil
+}
+
+func (s *scratchEtcd) Close() {
+	s.client.Close()
+	s.server.Close()
+}
+
+// KV is one etcd entry.
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+const pageSize = 500
+
+// Walk calls fn for every key under prefix, one page at a time.
+func (s *scratchEtcd) Walk(ctx context.Context, prefix string, fn func(KV)) error {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	start := prefix
+	for {
+		resp, err := s.client.Get(ctx, start, clientv3.WithRange(end), clientv3.WithLimit(pageSize))
+		if err != nil {
+			return fmt.Errorf("get %s: %w", prefix, err)
+		}
+		for _, kv := range resp.Kvs {
+			fn(KV{Key: string(kv.Key), Value: kv.Value})
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+func (s *scratchEtcd) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// loopbackURL reserves a free port on 127.0.0.1.
+func loopbackURL() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to reserve a loopback port: %w", err)
+	}
+	defer l.Close()
+	return "http://" + l.Addr().String(), nil
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
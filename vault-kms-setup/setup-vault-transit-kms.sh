@@ -180,6 +180,18 @@ retry_command "oc exec -n ${VAULT_NAMESPACE} ${VAULT_POD} -- vault write -f tran
 
 log_info "Transit engine configured with key: ${TRANSIT_KEY_NAME}"
 
+# Audit to the pod log, including the KMS plugin's correlation header
+# unhashed, so kms-trace can join Vault requests to KMS RPCs
+log_info "Enabling audit log with KMS correlation header..."
+# Enabling a path that is already in use fails, so only enable it when missing.
+# sys/audit, unlike `vault audit list`, succeeds when no device is enabled
+if retry_command "oc exec -n ${VAULT_NAMESPACE} ${VAULT_POD} -- vault read -format=json sys/audit" | grep -q '"file/"'; then
+    log_info "Audit device file/ already enabled"
+else
+    retry_command "oc exec -n ${VAULT_NAMESPACE} ${VAULT_POD} -- vault audit enable file file_path=stdout"
+fi
+retry_command "oc exec -n ${VAULT_NAMESPACE} ${VAULT_POD} -- vault write sys/config/auditing/request-headers/x-kms-correlation-id hmac=false"
+
 # Step 6: Configure AppRole Authentication
 log_info "Configuring AppRole authentication..."
 
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeVault is an in-memory subset of the Vault Enterprise HTTP API: just
+// enough namespaces, transit, ACL policies and AppRole to exercise
+// provision and verify without a license. Namespace semantics follow
+// Vault: the request namespace is X-Vault-Namespace plus any leading path
+// segments naming child namespaces, a token only works in the namespace
+// it was issued in and its children, and policies are evaluated against
+// the path relative to the token's namespace.
+type fakeVault struct {
+	rootToken string
+
+	mu     sync.Mutex
+	root   *fakeNamespace
+	tokens map[string]*fakeToken
+}
+
+type fakeNamespace struct {
+	path     string
+	children map[string]*fakeNamespace
+	mounts   map[string]*transitMount
+	policies map[string]string
+	approle  map[string]*fakeRole // nil until auth/approle is enabled
+}
+
+type transitMount struct {
+	keys map[string]cipher.AEAD
+}
+
+type fakeRole struct {
+	roleID    string
+	policies  []string
+	secretIDs map[string]bool
+}
+
+type fakeToken struct {
+	ns       *fakeNamespace
+	policies []string
+	root     bool
+}
+
+func newFakeVault(rootToken string, namespaces []string) *fakeVault {
+	v := &fakeVault{
+		rootToken: rootToken,
+		root:      newFakeNamespace(""),
+		tokens:    map[string]*fakeToken{},
+	}
+	v.tokens[rootToken] = &fakeToken{ns: v.root, root: true}
+	for _, ns := range namespaces {
+		cur := v.root
+		for _, seg := range strings.Split(strings.Trim(ns, "/"), "/") {
+			if seg == "" {
+				continue
+			}
+			cur = cur.child(seg)
+		}
+	}
+	return v
+}
+
+func newFakeNamespace(path string) *fakeNamespace {
+	return &fakeNamespace{
+		path:     path,
+		children: map[string]*fakeNamespace{},
+		mounts:   map[string]*transitMount{},
+		policies: map[string]string{},
+	}
+}
+
+// child returns the named child namespace, creating it if needed.
+func (n *fakeNamespace) child(name string) *fakeNamespace {
+	if c, ok := n.children[name]; ok {
+		return c
+	}
+	p := name
+	if n.path != "" {
+		p = n.path + "/" + name
+	}
+	c := newFakeNamespace(p)
+	n.children[name] = c
+	return c
+}
+
+// within reports whether n is ns or one of its descendants.
+func (n *fakeNamespace) within(ns *fakeNamespace) bool {
+	return ns.path == "" || n.path == ns.path || strings.HasPrefix(n.path, ns.path+"/")
+}
+
+// fakeError is returned by handlers and rendered as a Vault error body.
+type fakeError struct {
+	status int
+	msg    string
+}
+
+func (e *fakeError) Error() string { return e.msg }
+
+func errf(status int, format string, args ...any) *fakeError {
+	return &fakeError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+var errDenied = errf(http.StatusForbidden, "permission denied")
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p, ok := strings.CutPrefix(req.URL.Path, "/v1/")
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+		return
+	}
+	var body map[string]any
+	if req.Body != nil {
+		raw, _ := io.ReadAll(req.Body)
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"errors": []string{"failed to parse JSON input"}})
+				return
+			}
+		}
+	}
+
+	v.mu.Lock()
+	resp, err := v.handle(req.Method, req.Header.Get("X-Vault-Namespace"), req.Header.Get("X-Vault-Token"), strings.Trim(p, "/"), body)
+	v.mu.Unlock()
+
+	log.Printf("%s %s ns=%q → %v", req.Method, p, req.Header.Get("X-Vault-Namespace"), statusOf(err))
+	if err != nil {
+		fe, ok := err.(*fakeError)
+		if !ok {
+			fe = errf(http.StatusInternalServerError, "%v", err)
+		}
+		writeJSON(w, fe.status, map[string]any{"errors": []string{fe.msg}})
+		return
+	}
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func statusOf(err error) int {
+	if fe, ok := err.(*fakeError); ok {
+		return fe.status
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (v *fakeVault) handle(method, header, token, p string, body map[string]any) (map[string]any, error) {
+	if p == "sys/health" {
+		return map[string]any{"initialized": true, "sealed": false}, nil
+	}
+
+	// Resolve the request namespace: header first, then path segments.
+	ns := v.root
+	for _, seg := range strings.Split(strings.Trim(header, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+		c, ok := ns.children[seg]
+		if !ok {
+			return nil, errDenied
+		}
+		ns = c
+	}
+	for {
+		seg, rest, _ := strings.Cut(p, "/")
+		c, ok := ns.children[seg]
+		if !ok || rest == "" {
+			break
+		}
+		ns, p = c, rest
+	}
+
+	if p == "auth/approle/login" && method != http.MethodGet {
+		return v.login(ns, body)
+	}
+
+	tok, ok := v.tokens[token]
+	if !ok || !ns.within(tok.ns) {
+		return nil, errDenied
+	}
+	if !tok.root && !v.authorized(tok, ns, method, p) {
+		return nil, errDenied
+	}
+	return v.route(ns, method, p, body)
+}
+
+// authorized evaluates the token's policies, which live in the token's
+// namespace, against the request path relative to that namespace.
+func (v *fakeVault) authorized(tok *fakeToken, ns *fakeNamespace, method, p string) bool {
+	rel := p
+	if ns != tok.ns {
+		prefix := strings.TrimPrefix(strings.TrimPrefix(ns.path, tok.ns.path), "/")
+		rel = prefix + "/" + p
+	}
+	var want []string
+	switch method {
+	case http.MethodGet:
+		want = []string{"read"}
+	case http.MethodDelete:
+		want = []string{"delete"}
+	default:
+		want = []string{"create", "update"}
+	}
+	for _, name := range tok.policies {
+		for _, rule := range parsePolicy(tok.ns.policies[name]) {
+			if !rule.matches(rel) {
+				continue
+			}
+			for _, c := range rule.caps {
+				if c == "deny" {
+					return false
+				}
+				for _, w := range want {
+					if c == w {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+type policyRule struct {
+	path string
+	caps []string
+}
+
+var (
+	policyPathRE = regexp.MustCompile(`path\s+"([^"]+)"\s*\{[^}]*?capabilities\s*=\s*\[([^\]]*)\]`)
+	quotedRE     = regexp.MustCompile(`"([^"]+)"`)
+)
+
+// parsePolicy understands the subset of HCL the provisioner writes: path
+// blocks with a capabilities list.
+func parsePolicy(hcl string) []policyRule {
+	var rules []policyRule
+	for _, m := range policyPathRE.FindAllStringSubmatch(hcl, -1) {
+		rule := policyRule{path: m[1]}
+		for _, c := range quotedRE.FindAllStringSubmatch(m[2], -1) {
+			rule.caps = append(rule.caps, c[1])
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matches supports exact paths, a trailing "*" glob and "+" segments.
+func (r policyRule) matches(p string) bool {
+	if prefix, ok := strings.CutSuffix(r.path, "*"); ok {
+		return strings.HasPrefix(p, prefix)
+	}
+	want, got := strings.Split(r.path, "/"), strings.Split(p, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != "+" && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *fakeVault) login(ns *fakeNamespace, body map[string]any) (map[string]any, error) {
+	if ns.approle == nil {
+		return nil, errf(http.StatusBadRequest, "invalid role ID")
+	}
+	roleID, _ := body["role_id"].(string)
+	secretID, _ := body["secret_id"].(string)
+	for _, role := range ns.approle {
+		if role.roleID != roleID {
+			continue
+		}
+		if !role.secretIDs[secretID] {
+			return nil, errf(http.StatusBadRequest, "invalid secret id")
+		}
+		token := "hvs." + randomHex(12)
+		v.tokens[token] = &fakeToken{ns: ns, policies: role.policies}
+		return map[string]any{"auth": map[string]any{"client_token": token, "policies": role.policies}}, nil
+	}
+	return nil, errf(http.StatusBadRequest, "invalid role ID")
+}
+
+func (v *fakeVault) route(ns *fakeNamespace, method, p string, body map[string]any) (map[string]any, error) {
+	segs := strings.Split(p, "/")
+	switch {
+	case len(segs) == 3 && segs[0] == "sys" && segs[1] == "namespaces":
+		if method == http.MethodGet {
+			c, ok := ns.children[segs[2]]
+			if !ok {
+				return nil, errf(http.StatusNotFound, "namespace not found")
+			}
+			return data(map[string]any{"path": c.path + "/"}), nil
+		}
+		ns.child(segs[2])
+		return nil, nil
+
+	case p == "sys/mounts" && method == http.MethodGet:
+		mounts := map[string]any{}
+		for name := range ns.mounts {
+			mounts[name+"/"] = map[string]any{"type": "transit"}
+		}
+		return data(mounts), nil
+
+	case len(segs) == 3 && segs[0] == "sys" && segs[1] == "mounts":
+		if t, _ := body["type"].(string); t != "transit" {
+			return nil, errf(http.StatusBadRequest, "unsupported mount type %q", t)
+		}
+		if _, ok := ns.mounts[segs[2]]; ok {
+			return nil, errf(http.StatusBadRequest, "path is already in use at %s/", segs[2])
+		}
+		ns.mounts[segs[2]] = &transitMount{keys: map[string]cipher.AEAD{}}
+		return nil, nil
+
+	case p == "sys/auth" && method == http.MethodGet:
+		auths := map[string]any{"token/": map[string]any{"type": "token"}}
+		if ns.approle != nil {
+			auths["approle/"] = map[string]any{"type": "approle"}
+		}
+		return data(auths), nil
+
+	case p == "sys/auth/approle":
+		if ns.approle != nil {
+			return nil, errf(http.StatusBadRequest, "path is already in use at approle/")
+		}
+		ns.approle = map[string]*fakeRole{}
+		return nil, nil
+
+	case len(segs) == 4 && segs[0] == "sys" && segs[1] == "policies" && segs[2] == "acl":
+		if method == http.MethodGet {
+			policy, ok := ns.policies[segs[3]]
+			if !ok {
+				return nil, errf(http.StatusNotFound, "policy not found")
+			}
+			return data(map[string]any{"name": segs[3], "policy": policy}), nil
+		}
+		policy, _ := body["policy"].(string)
+		ns.policies[segs[3]] = policy
+		return nil, nil
+
+	case len(segs) >= 4 && segs[0] == "auth" && segs[1] == "approle" && segs[2] == "role":
+		return v.routeRole(ns, method, segs[3], strings.Join(segs[4:], "/"), body)
+	}
+
+	if mount, ok := ns.mounts[segs[0]]; ok && len(segs) == 3 {
+		return routeTransit(mount, method, segs[1], segs[2], body)
+	}
+	return nil, errf(http.StatusNotFound, "no handler for route %q", p)
+}
+
+func (v *fakeVault) routeRole(ns *fakeNamespace, method, name, sub string, body map[string]any) (map[string]any, error) {
+	if ns.approle == nil {
+		return nil, errf(http.StatusNotFound, "no handler for route \"auth/approle\"")
+	}
+	role := ns.approle[name]
+	switch {
+	case sub == "" && method != http.MethodGet:
+		if role == nil {
+			role = &fakeRole{roleID: randomUUID(), secretIDs: map[string]bool{}}
+			ns.approle[name] = role
+		}
+		switch p := body["token_policies"].(type) {
+		case []any:
+			role.policies = nil
+			for _, s := range p {
+				role.policies = append(role.policies, fmt.Sprint(s))
+			}
+		case string:
+			role.policies = strings.Split(p, ",")
+		}
+		return nil, nil
+	case role == nil:
+		return nil, errf(http.StatusNotFound, "role %q not found", name)
+	case sub == "":
+		return data(map[string]any{"token_policies": role.policies}), nil
+	case sub == "role-id" && method == http.MethodGet:
+		return data(map[string]any{"role_id": role.roleID}), nil
+	case sub == "secret-id" && method != http.MethodGet:
+		id := randomUUID()
+		role.secretIDs[id] = true
+		return data(map[string]any{"secret_id": id}), nil
+	}
+	return nil, errf(http.StatusNotFound, "no handler for route")
+}
+
+func routeTransit(mount *transitMount, method, op, key string, body map[string]any) (map[string]any, error) {
+	aead := mount.keys[key]
+	switch op {
+	case "keys":
+		if method == http.MethodGet {
+			if aead == nil {
+				return nil, errf(http.StatusNotFound, "key not found")
+			}
+			return data(map[string]any{"name": key, "type": "aes256-gcm96", "latest_version": 1}), nil
+		}
+		if aead == nil {
+			k := make([]byte, 32)
+			_, _ = rand.Read(k)
+			block, _ := aes.NewCipher(k)
+			aead, _ = cipher.NewGCM(block)
+			mount.keys[key] = aead
+		}
+		return nil, nil
+
+	case "encrypt":
+		if aead == nil {
+			return nil, errf(http.StatusBadRequest, "encryption key not found")
+		}
+		plaintext, err := unb64(fmt.Sprint(body["plaintext"]))
+		if err != nil {
+			return nil, errf(http.StatusBadRequest, "failed to base64-decode plaintext")
+		}
+		nonce := make([]byte, aead.NonceSize())
+		_, _ = rand.Read(nonce)
+		return data(map[string]any{"ciphertext": "vault:v1:" + b64(aead.Seal(nonce, nonce, plaintext, nil)), "key_version": 1}), nil
+
+	case "decrypt":
+		if aead == nil {
+			return nil, errf(http.StatusBadRequest, "encryption key not found")
+		}
+		raw, err := unb64(strings.TrimPrefix(fmt.Sprint(body["ciphertext"]), "vault:v1:"))
+		if err != nil || len(raw) < aead.NonceSize() {
+			return nil, errf(http.StatusBadRequest, "invalid ciphertext")
+		}
+		plaintext, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, errf(http.StatusBadRequest, "cipher: message authentication failed")
+		}
+		return data(map[string]any{"plaintext": b64(plaintext)}), nil
+	}
+	return nil, errf(http.StatusNotFound, "no handler for route")
+}
+
+func data(d map[string]any) map[string]any { return map[string]any{"data": d} }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomUUID() string {
+	h := randomHex(16)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// namespacePaths lists every namespace, for the startup log.
+func (v *fakeVault) namespacePaths() []string {
+	var out []string
+	var walk func(*fakeNamespace)
+	walk = func(n *fakeNamespace) {
+		if n.path != "" {
+			out = append(out, n.path)
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(v.root)
+	sort.Strings(out)
+	return out
+}
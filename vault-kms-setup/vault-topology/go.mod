@@ -0,0 +1,12 @@
+module github.com/gangwgr/vault-topology
+
+go 1.25.0
+
+require (
+	github.com/gangwgr/report v0.0.0
+	sigs.k8s.io/yaml v1.6.0
+)
+
+require go.yaml.in/yaml/v2 v2.4.2 // indirect
+
+replace github.com/gangwgr/report => ../../report
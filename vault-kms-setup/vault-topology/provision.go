@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gangwgr/report"
+)
+
+// Credentials is what provision writes for each cluster and what verify
+// reads back.
+type Credentials struct {
+	Cluster      string `json:"cluster"`
+	Address      string `json:"address"`
+	Namespace    string `json:"namespace"`
+	TransitMount string `json:"transitMount"`
+	TransitKey   string `json:"transitKey"`
+	AppRole      string `json:"appRole"`
+	RoleID       string `json:"roleID"`
+	SecretID     string `json:"secretID"`
+}
+
+// provisioner creates each cluster's namespace and the objects inside it.
+// Every step checks before it writes, so it can be re-run against a
+// partially provisioned Vault.
+type provisioner struct {
+	topo          *Topology
+	root          *vaultClient
+	outDir        string
+	rotateSecrets bool
+	r             *report.Reporter
+}
+
+func (p *provisioner) run() error {
+	for _, c := range p.topo.Clusters {
+		p.r.Section(fmt.Sprintf("Cluster %s → namespace %s", c.Name, p.topo.FullNamespace(c)))
+		creds, err := p.provisionCluster(c)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", c.Name, err)
+		}
+		if err := p.writeOutputs(c, creds); err != nil {
+			return fmt.Errorf("cluster %s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *provisioner) provisionCluster(c Cluster) (*Credentials, error) {
+	parent := p.root.withNamespace(p.topo.Vault.Namespace)
+	ns := p.root.withNamespace(p.topo.FullNamespace(c))
+
+	if err := ensure(p.r, "namespace "+c.Namespace,
+		func() (bool, error) { return exists(parent, "sys/namespaces/"+c.Namespace) },
+		func() error { _, err := parent.do(http.MethodPost, "sys/namespaces/"+c.Namespace, nil); return err },
+	); err != nil {
+		return nil, err
+	}
+
+	if err := ensure(p.r, "transit mount "+c.TransitMount,
+		func() (bool, error) { return hasMount(ns, "sys/mounts", c.TransitMount) },
+		func() error {
+			_, err := ns.do(http.MethodPost, "sys/mounts/"+c.TransitMount, map[string]string{"type": "transit"})
+			return err
+		},
+	); err != nil {
+		return nil, err
+	}
+
+	if err := ensure(p.r, "transit key "+c.TransitKey,
+		func() (bool, error) { return exists(ns, c.TransitMount+"/keys/"+c.TransitKey) },
+		func() error { _, err := ns.do(http.MethodPost, c.TransitMount+"/keys/"+c.TransitKey, nil); return err },
+	); err != nil {
+		return nil, err
+	}
+
+	// Policies are always rewritten so a changed mount or key name is
+	// picked up.
+	if _, err := ns.do(http.MethodPut, "sys/policies/acl/"+c.Policy, map[string]string{"policy": c.PolicyHCL()}); err != nil {
+		return nil, err
+	}
+	p.r.Info("policy %s written", c.Policy)
+
+	if err := ensure(p.r, "approle auth method",
+		func() (bool, error) { return hasMount(ns, "sys/auth", "approle") },
+		func() error {
+			_, err := ns.do(http.MethodPost, "sys/auth/approle", map[string]string{"type": "approle"})
+			return err
+		},
+	); err != nil {
+		return nil, err
+	}
+
+	rolePath := "auth/approle/role/" + c.AppRole
+	if _, err := ns.do(http.MethodPost, rolePath, map[string]any{
+		"token_policies": []string{c.Policy},
+		"token_ttl":      c.TokenTTL,
+		"token_max_ttl":  c.TokenMaxTTL,
+	}); err != nil {
+		return nil, err
+	}
+	p.r.Info("approle %s written (policies=%s ttl=%s max_ttl=%s)", c.AppRole, c.Policy, c.TokenTTL, c.TokenMaxTTL)
+
+	var role struct {
+		RoleID string `json:"role_id"`
+	}
+	if err := ns.data(http.MethodGet, rolePath+"/role-id", nil, &role); err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{
+		Cluster:      c.Name,
+		Address:      p.topo.Vault.Address,
+		Namespace:    p.topo.FullNamespace(c),
+		TransitMount: c.TransitMount,
+		TransitKey:   c.TransitKey,
+		AppRole:      c.AppRole,
+		RoleID:       role.RoleID,
+	}
+
+	// Keep an existing secret-id as long as it still logs in, so re-running
+	// provision does not invalidate credentials already handed to a cluster.
+	if !p.rotateSecrets {
+		if prev, err := readCredentials(p.clusterDir(c)); err == nil && prev.RoleID == role.RoleID && prev.SecretID != "" {
+			if _, err := ns.withToken("").appRoleLogin(prev.RoleID, prev.SecretID); err == nil {
+				p.r.Info("reusing existing secret-id")
+				creds.SecretID = prev.SecretID
+				return creds, nil
+			}
+			p.r.Warn("existing secret-id no longer logs in, generating a new one")
+		}
+	}
+	var secret struct {
+		SecretID string `json:"secret_id"`
+	}
+	if err := ns.data(http.MethodPost, rolePath+"/secret-id", nil, &secret); err != nil {
+		return nil, err
+	}
+	p.r.Info("secret-id generated")
+	creds.SecretID = secret.SecretID
+	return creds, nil
+}
+
+// ensure creates an object unless check finds it.
+func ensure(r *report.Reporter, what string, check func() (bool, error), create func() error) error {
+	found, err := check()
+	if err != nil {
+		return fmt.Errorf("checking %s: %w", what, err)
+	}
+	if found {
+		r.Info("%s already exists", what)
+		return nil
+	}
+	if err := create(); err != nil {
+		return fmt.Errorf("creating %s: %w", what, err)
+	}
+	r.Info("%s created", what)
+	return nil
+}
+
+func exists(c *vaultClient, path string) (bool, error) {
+	_, err := c.do(http.MethodGet, path, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hasMount looks for "<name>/" in a sys/mounts or sys/auth listing.
+func hasMount(c *vaultClient, listPath, name string) (bool, error) {
+	var mounts map[string]json.RawMessage
+	if err := c.data(http.MethodGet, listPath, nil, &mounts); err != nil {
+		return false, err
+	}
+	_, ok := mounts[strings.Trim(name, "/")+"/"]
+	return ok, nil
+}
+
+func (p *provisioner) clusterDir(c Cluster) string {
+	return filepath.Join(p.outDir, c.Name)
+}
+
+// writeOutputs writes the cluster's credentials in the layouts the rest of
+// the repo uses: vault-approle-credentials.txt and kms-plugin-config.yaml
+// as produced by setup-vault-transit-kms.sh, plus credentials.json for
+// verify.
+func (p *provisioner) writeOutputs(c Cluster, creds *Credentials) error {
+	dir := p.clusterDir(c)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	txt := fmt.Sprintf(`Vault Address: %s
+Vault Namespace: %s
+Transit Mount: %s
+Transit Key: %s
+AppRole Name: %s
+Role ID: %s
+Secret ID: %s
+`, creds.Address, creds.Namespace, creds.TransitMount, creds.TransitKey, creds.AppRole, creds.RoleID, creds.SecretID)
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Secret
+metadata:
+  name: kms-plugin-config
+  namespace: openshift-config
+type: Opaque
+stringData:
+  config.yaml: |
+    kind: VaultConfig
+    apiVersion: apiserver.config.k8s.io/v1
+    vault:
+      address: %q
+      namespace: %q
+      transitMount: %q
+      transitKeyName: %q
+      auth:
+        type: "approle"
+        approle:
+          roleID: %q
+          secretID: %q
+`, creds.Address, creds.Namespace, creds.TransitMount, creds.TransitKey, creds.RoleID, creds.SecretID)
+
+	for name, content := range map[string][]byte{
+		"credentials.json":              append(encoded, '\n'),
+		"vault-approle-credentials.txt": []byte(txt),
+		"kms-plugin-config.yaml":        []byte(config),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			return err
+		}
+	}
+	p.r.Passf("credentials written to %s", dir)
+	return nil
+}
+
+func readCredentials(dir string) (*Credentials, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "credentials.json"))
+	if err != nil {
+		return nil, err
+	}
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	if creds.RoleID == "" || creds.SecretID == "" {
+		return nil, errors.New(dir + ": credentials.json has no role/secret ID")
+	}
+	return &creds, nil
+}
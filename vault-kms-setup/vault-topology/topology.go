@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Topology describes a shared lab Vault: a parent namespace (e.g. "admin"
+// on HCP Vault) with one child namespace per cluster, each holding its own
+// transit mount, key, policy and AppRole.
+type Topology struct {
+	Vault    VaultConfig `json:"vault"`
+	Defaults ClusterSpec `json:"defaults,omitempty"`
+	Clusters []Cluster   `json:"clusters"`
+}
+
+// VaultConfig is where to reach Vault and which namespace to provision
+// under.
+type VaultConfig struct {
+	Address string `json:"address"`
+	// Namespace is the parent namespace the cluster namespaces are created
+	// in. Empty means the root namespace (OSS Vault).
+	Namespace     string `json:"namespace,omitempty"`
+	TLSSkipVerify bool   `json:"tlsSkipVerify,omitempty"`
+}
+
+// ClusterSpec holds the per-cluster Vault objects. Unset fields fall back
+// to Topology.Defaults, then to the built-in defaults.
+type ClusterSpec struct {
+	TransitMount string `json:"transitMount,omitempty"`
+	TransitKey   string `json:"transitKey,omitempty"`
+	Policy       string `json:"policy,omitempty"`
+	AppRole      string `json:"appRole,omitempty"`
+	TokenTTL     string `json:"tokenTTL,omitempty"`
+	TokenMaxTTL  string `json:"tokenMaxTTL,omitempty"`
+}
+
+// Cluster is one tenant of the shared Vault.
+type Cluster struct {
+	Name string `json:"name"`
+	// Namespace is the child namespace name, relative to the parent.
+	// Defaults to Name.
+	Namespace string `json:"namespace,omitempty"`
+	ClusterSpec
+}
+
+var builtinDefaults = ClusterSpec{
+	TransitMount: "transit",
+	TransitKey:   "kubernetes-encryption",
+	Policy:       "kms-plugin",
+	AppRole:      "kms-plugin",
+	TokenTTL:     "1h",
+	TokenMaxTTL:  "4h",
+}
+
+// LoadTopology reads a topology file and fills in defaults.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topology: %w", err)
+	}
+	var t Topology
+	if err := yaml.UnmarshalStrict(data, &t); err != nil {
+		return nil, fmt.Errorf("failed to parse topology %s: %w", path, err)
+	}
+	if t.Vault.Address == "" {
+		t.Vault.Address = os.Getenv("VAULT_ADDR")
+	}
+	if t.Vault.Address == "" {
+		return nil, fmt.Errorf("vault.address is required (or export VAULT_ADDR)")
+	}
+	t.Vault.Namespace = strings.Trim(t.Vault.Namespace, "/")
+	if len(t.Clusters) == 0 {
+		return nil, fmt.Errorf("topology has no clusters")
+	}
+
+	seen := map[string]bool{}
+	for i := range t.Clusters {
+		c := &t.Clusters[i]
+		if c.Name == "" {
+			return nil, fmt.Errorf("cluster %d has no name", i)
+		}
+		if c.Namespace == "" {
+			c.Namespace = c.Name
+		}
+		c.Namespace = strings.Trim(c.Namespace, "/")
+		if strings.Contains(c.Namespace, "/") {
+			return nil, fmt.Errorf("cluster %s: namespace %q must be a single path segment", c.Name, c.Namespace)
+		}
+		if seen[c.Namespace] {
+			return nil, fmt.Errorf("cluster %s: namespace %q is shared with another cluster", c.Name, c.Namespace)
+		}
+		seen[c.Namespace] = true
+		c.ClusterSpec = c.ClusterSpec.withDefaults(t.Defaults).withDefaults(builtinDefaults)
+	}
+	return &t, nil
+}
+
+func (s ClusterSpec) withDefaults(d ClusterSpec) ClusterSpec {
+	pick := func(v, def string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	}
+	return ClusterSpec{
+		TransitMount: pick(s.TransitMount, d.TransitMount),
+		TransitKey:   pick(s.TransitKey, d.TransitKey),
+		Policy:       pick(s.Policy, d.Policy),
+		AppRole:      pick(s.AppRole, d.AppRole),
+		TokenTTL:     pick(s.TokenTTL, d.TokenTTL),
+		TokenMaxTTL:  pick(s.TokenMaxTTL, d.TokenMaxTTL),
+	}
+}
+
+// FullNamespace is the cluster's namespace path as sent in
+// X-Vault-Namespace, e.g. "admin/cluster-a".
+func (t *Topology) FullNamespace(c Cluster) string {
+	if t.Vault.Namespace == "" {
+		return c.Namespace
+	}
+	return t.Vault.Namespace + "/" + c.Namespace
+}
+
+// PolicyHCL renders the cluster's KMS plugin policy, the same one
+// setup-vault-transit-kms.sh writes: encrypt and decrypt on its own key only.
+func (c Cluster) PolicyHCL() string {
+	var b strings.Builder
+	for _, op := range []string{"encrypt", "decrypt"} {
+		fmt.Fprintf(&b, "path %q {\n  capabilities = [\"update\"]\n}\n\n", c.TransitMount+"/"+op+"/"+c.TransitKey)
+	}
+	return b.String()
+}
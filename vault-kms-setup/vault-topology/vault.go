@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vaultClient is a minimal Vault HTTP API client, the same calls the shell
+// scripts make with curl.
+type vaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	http      *http.Client
+}
+
+func newVaultClient(addr, token string, skipVerify bool) *vaultClient {
+	return &vaultClient{
+		addr:  strings.TrimRight(addr, "/"),
+		token: token,
+		http: &http.Client{
+			Timeout: 15 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           nil,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerify},
+			},
+		},
+	}
+}
+
+// withNamespace returns a copy of the client bound to a namespace.
+func (c *vaultClient) withNamespace(ns string) *vaultClient {
+	cp := *c
+	cp.namespace = ns
+	return &cp
+}
+
+// withToken returns a copy of the client using a different token.
+func (c *vaultClient) withToken(token string) *vaultClient {
+	cp := *c
+	cp.token = token
+	return &cp
+}
+
+// vaultError is a non-2xx Vault response.
+type vaultError struct {
+	Method, Path string
+	Namespace    string
+	Status       int
+	Errors       []string
+}
+
+func (e *vaultError) Error() string {
+	ns := e.Namespace
+	if ns == "" {
+		ns = "(root)"
+	}
+	return fmt.Sprintf("%s %s [ns %s]: HTTP %d: %s", e.Method, e.Path, ns, e.Status, strings.Join(e.Errors, "; "))
+}
+
+// vaultResponse is the common envelope of Vault API responses.
+type vaultResponse struct {
+	Data json.RawMessage `json:"data"`
+	Auth *struct {
+		ClientToken string   `json:"client_token"`
+		Policies    []string `json:"policies"`
+	} `json:"auth"`
+}
+
+func (c *vaultClient) do(method, path string, body any) (*vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.addr+"/v1/"+strings.TrimLeft(path, "/"), reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errBody struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(raw, &errBody)
+		return nil, &vaultError{Method: method, Path: path, Namespace: c.namespace, Status: resp.StatusCode, Errors: errBody.Errors}
+	}
+	out := &vaultResponse{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return nil, fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+		}
+	}
+	return out, nil
+}
+
+func (c *vaultClient) data(method, path string, body any, into any) error {
+	resp, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if into == nil || len(resp.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Data, into)
+}
+
+// isStatus reports whether err is a Vault error with the given HTTP status.
+func isStatus(err error, status int) bool {
+	ve, ok := err.(*vaultError)
+	return ok && ve.Status == status
+}
+
+func (c *vaultClient) appRoleLogin(roleID, secretID string) (string, error) {
+	resp, err := c.do(http.MethodPost, "auth/approle/login", map[string]string{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("approle login returned no token")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+func (c *vaultClient) encrypt(mount, key string, plaintext []byte) (string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := c.data(http.MethodPost, mount+"/encrypt/"+key, map[string]string{"plaintext": b64(plaintext)}, &out)
+	return out.Ciphertext, err
+}
+
+func (c *vaultClient) decrypt(mount, key, ciphertext string) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := c.data(http.MethodPost, mount+"/decrypt/"+key, map[string]string{"ciphertext": ciphertext}, &out); err != nil {
+		return nil, err
+	}
+	return unb64(out.Plaintext)
+}
+
+func b64(data []byte) string { return base64.StdEncoding.EncodeToString(data) }
+
+func unb64(s string) ([]byte, error) { return base64.StdEncoding.DecodeString(s) }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gangwgr/report"
+)
+
+// outcome of one cross-tenant probe.
+type outcome int
+
+const (
+	allowed outcome = iota
+	denied
+	errored
+)
+
+// verifier checks tenant isolation using only the credentials provision
+// wrote: every cluster must be able to use its own key, must not be able to
+// do anything else with its token, and must be refused every other
+// cluster's key, however the other namespace is addressed.
+type verifier struct {
+	topo   *Topology
+	base   *vaultClient
+	outDir string
+	r      *report.Reporter
+}
+
+type tenant struct {
+	cluster Cluster
+	creds   *Credentials
+	// ns is a client logged in with the tenant's own AppRole in its own
+	// namespace.
+	ns         *vaultClient
+	ciphertext string
+}
+
+func (v *verifier) run() error {
+	var tenants []*tenant
+	roleOwners := map[string]string{}
+	v.r.Section("Own-namespace access")
+	for _, c := range v.topo.Clusters {
+		creds, err := readCredentials(path.Join(v.outDir, c.Name))
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w (run provision first)", c.Name, err)
+		}
+		t := &tenant{cluster: c, creds: creds}
+		tenants = append(tenants, t)
+		if owner, ok := roleOwners[creds.RoleID]; ok {
+			v.r.Failf("[%s] shares its AppRole (role ID %s) with %s", c.Name, creds.RoleID, owner)
+		}
+		roleOwners[creds.RoleID] = c.Name
+
+		ns := v.base.withNamespace(creds.Namespace).withToken("")
+		token, err := ns.appRoleLogin(creds.RoleID, creds.SecretID)
+		if err != nil {
+			v.r.Failf("[%s] approle login in %s: %v", c.Name, creds.Namespace, err)
+			continue
+		}
+		t.ns = ns.withToken(token)
+
+		plaintext := []byte("isolation check for " + c.Name)
+		ct, err := t.ns.encrypt(creds.TransitMount, creds.TransitKey, plaintext)
+		if err != nil {
+			v.r.Failf("[%s] encrypt with own key: %v", c.Name, err)
+			continue
+		}
+		got, err := t.ns.decrypt(creds.TransitMount, creds.TransitKey, ct)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			v.r.Failf("[%s] decrypt with own key: %v", c.Name, err)
+			continue
+		}
+		t.ciphertext = ct
+		v.r.Passf("[%s] login, encrypt and decrypt in %s", c.Name, creds.Namespace)
+	}
+
+	v.r.Section("Least privilege (all must be denied)")
+	for _, t := range tenants {
+		if t.ns != nil {
+			v.leastPrivilege(t)
+		}
+	}
+
+	v.r.Section("Cross-namespace access (all must be denied)")
+	matrix := make([][]outcome, len(tenants))
+	for i, a := range tenants {
+		matrix[i] = make([]outcome, len(tenants))
+		for j, b := range tenants {
+			if i == j {
+				matrix[i][j] = allowed
+				if a.ns == nil || a.ciphertext == "" {
+					matrix[i][j] = errored
+				}
+				continue
+			}
+			matrix[i][j] = v.crossCheck(a, b)
+		}
+	}
+	v.printMatrix(tenants, matrix)
+	return nil
+}
+
+// leastPrivilege checks that a tenant's token can do nothing in its own
+// namespace beyond encrypt and decrypt with its key. Only reads are tried,
+// so an over-broad policy is reported without being exercised.
+func (v *verifier) leastPrivilege(t *tenant) {
+	label := "[" + t.cluster.Name + "]"
+	for _, p := range []string{
+		"sys/policies/acl/" + t.cluster.Policy,
+		"auth/approle/role/" + t.creds.AppRole + "/role-id",
+		t.creds.TransitMount + "/keys/" + t.creds.TransitKey,
+		"sys/mounts",
+	} {
+		err := t.ns.data(http.MethodGet, p, nil, nil)
+		switch classify(err) {
+		case allowed:
+			v.r.Failf("%s read of %s was allowed", label, p)
+		case errored:
+			v.r.Failf("%s read of %s: %v", label, p, err)
+		default:
+			v.r.Passf("%s read of %s denied", label, p)
+		}
+	}
+}
+
+// crossCheck tries every way tenant a could reach tenant b's key. The
+// result is denied only if all attempts were refused by Vault.
+func (v *verifier) crossCheck(a, b *tenant) outcome {
+	label := fmt.Sprintf("[%s → %s]", a.cluster.Name, b.cluster.Name)
+	result := denied
+	record := func(what string, err error) {
+		switch o := classify(err); o {
+		case allowed:
+			v.r.Failf("%s %s was allowed", label, what)
+			result = allowed
+		case errored:
+			v.r.Failf("%s %s: %v", label, what, err)
+			if result == denied {
+				result = errored
+			}
+		default:
+			v.r.Passf("%s %s denied", label, what)
+		}
+	}
+
+	// a's AppRole credentials must not log in to b's namespace.
+	_, err := v.base.withNamespace(b.creds.Namespace).withToken("").appRoleLogin(a.creds.RoleID, a.creds.SecretID)
+	record("approle login in "+b.creds.Namespace, err)
+
+	if a.ns == nil {
+		return result
+	}
+	probe := []byte("cross-tenant probe")
+
+	// b's namespace selected by header.
+	other := a.ns.withNamespace(b.creds.Namespace)
+	_, err = other.encrypt(b.creds.TransitMount, b.creds.TransitKey, probe)
+	record("encrypt via X-Vault-Namespace "+b.creds.Namespace, err)
+	if b.ciphertext != "" {
+		_, err = other.decrypt(b.creds.TransitMount, b.creds.TransitKey, b.ciphertext)
+		record("decrypt of "+b.cluster.Name+" ciphertext", err)
+	}
+
+	// b's namespace selected by path prefix from the parent namespace.
+	parent := a.ns.withNamespace(v.topo.Vault.Namespace)
+	prefix := strings.TrimPrefix(strings.TrimPrefix(b.creds.Namespace, v.topo.Vault.Namespace), "/")
+	_, err = parent.encrypt(prefix+"/"+b.creds.TransitMount, b.creds.TransitKey, probe)
+	record("encrypt via path "+prefix+"/"+b.creds.TransitMount, err)
+
+	// b's mount and key names inside a's own namespace must not resolve to
+	// b's key. If the names are the same this is a's own key.
+	if b.creds.TransitMount != a.creds.TransitMount || b.creds.TransitKey != a.creds.TransitKey {
+		_, err = a.ns.encrypt(b.creds.TransitMount, b.creds.TransitKey, probe)
+		record("encrypt with "+b.creds.TransitMount+"/"+b.creds.TransitKey+" in own namespace", err)
+	}
+	return result
+}
+
+// classify maps a Vault call result to an outcome: 4xx responses are
+// refusals, anything else that failed is an error.
+func classify(err error) outcome {
+	if err == nil {
+		return allowed
+	}
+	var ve *vaultError
+	if errors.As(err, &ve) && ve.Status >= 400 && ve.Status < 500 && ve.Status != http.StatusTooManyRequests {
+		return denied
+	}
+	return errored
+}
+
+func (v *verifier) printMatrix(tenants []*tenant, matrix [][]outcome) {
+	v.r.Section("Isolation matrix (rows: credentials, columns: keys)")
+	width := len("credentials")
+	for _, t := range tenants {
+		width = max(width, len(t.cluster.Name))
+	}
+	fmt.Printf("  %-*s", width, "credentials")
+	for _, t := range tenants {
+		fmt.Printf("  %-*s", width, t.cluster.Name)
+	}
+	fmt.Println()
+	for i, a := range tenants {
+		fmt.Printf("  %-*s", width, a.cluster.Name)
+		for j := range tenants {
+			expected := denied
+			if i == j {
+				expected = allowed
+			}
+			cell, color := "", report.Green
+			switch matrix[i][j] {
+			case allowed:
+				cell = "allowed"
+			case denied:
+				cell = "denied"
+			default:
+				cell = "error"
+			}
+			if matrix[i][j] != expected {
+				color = report.Red
+			}
+			fmt.Printf("  %s%-*s%s", color, width, cell, report.Reset)
+		}
+		fmt.Println()
+	}
+}